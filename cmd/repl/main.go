@@ -3,17 +3,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	gojson "encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"runtime/trace"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/attic-labs/noms/go/diff"
+	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/spec"
 	"github.com/attic-labs/noms/go/types"
 	"github.com/attic-labs/noms/go/util/outputpager"
@@ -24,7 +27,6 @@ import (
 
 	"roci.dev/diff-server/util/chk"
 	"roci.dev/diff-server/util/log"
-	"roci.dev/diff-server/util/noms/json"
 	"roci.dev/diff-server/util/tbl"
 	rtime "roci.dev/diff-server/util/time"
 	"roci.dev/diff-server/util/version"
@@ -58,6 +60,8 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	sps := app.Flag("db", "The database to connect to. Both local and remote databases are supported. For local databases, specify a directory path to store the database in. For remote databases, specify the http(s) URL to the database (usually https://serve.replicache.dev/<mydb>).").PlaceHolder("/path/to/db").Required().String()
 	tf := app.Flag("trace", "Name of a file to write a trace to").OpenFile(os.O_RDWR|os.O_CREATE, 0644)
 	cpu := app.Flag("cpu", "Name of file to write CPU profile to").OpenFile(os.O_RDWR|os.O_CREATE, 0644)
+	readOnly := app.Flag("read-only", "Open the database read-only, which allows it to be open in other processes at the same time, including one writer. Writes fail.").Bool()
+	seed := app.Flag("seed", "Name of a snapshot export to start the database from if it doesn't exist yet").String()
 
 	var sp *spec.Spec
 	getSpec := func() (spec.Spec, error) {
@@ -73,21 +77,30 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	}
 
 	var rdb *db.DB
-	getDB := func() (db.DB, error) {
+	getDB := func() (*db.DB, error) {
 		if rdb != nil {
-			return *rdb, nil
+			return rdb, nil
 		}
 		sp, err := getSpec()
 		if err != nil {
-			return db.DB{}, err
+			return nil, err
 		}
-		r, err := db.Load(sp)
+		opts := db.Options{Lock: db.LockExclusive, SeedFile: *seed}
+		if *readOnly {
+			opts.Lock = db.LockShared
+		}
+		r, err := db.LoadWithOptions(sp, opts)
 		if err != nil {
-			return db.DB{}, err
+			return nil, err
 		}
 		rdb = r
-		return *r, nil
+		return r, nil
 	}
+	defer func() {
+		if rdb != nil {
+			rdb.Close()
+		}
+	}()
 	app.PreAction(func(pc *kingpin.ParseContext) error {
 		if *v {
 			fmt.Println(version.Version())
@@ -143,8 +156,16 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	scan(app, getDB, out, errs)
 	put(app, getDB, in, l)
 	del(app, getDB, out, l)
+	patch(app, getDB, in, l)
+	batch(app, getDB, in, out, l)
 	drop(app, getSpec, in, out)
 	logCmd(app, getDB, out)
+	diffCmd(app, getDB, out)
+	exportCmd(app, getDB, out)
+	importCmd(app, getDB, in, out)
+	fsck(app, getDB, out, exit)
+	migrate(app, getSpec, getDB, out)
+	stats(app, getDB, out)
 
 	if len(args) == 0 {
 		app.Usage(args)
@@ -158,7 +179,7 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	}
 }
 
-type gdb func() (db.DB, error)
+type gdb func() (*db.DB, error)
 type gsp func() (spec.Spec, error)
 
 func has(parent *kingpin.Application, gdb gdb, out io.Writer) {
@@ -218,20 +239,51 @@ func scan(parent *kingpin.Application, gdb gdb, out, errs io.Writer) {
 	kc.Flag("start-id", "id of the value to start scanning at").StringVar(&opts.Start.ID.Value)
 	kc.Flag("start-id-exclusive", "id of the value to start scanning at").BoolVar(&opts.Start.ID.Exclusive)
 	kc.Flag("start-index", "id of the value to start scanning at").Uint64Var(opts.Start.Index)
+	kc.Flag("end-at-id", "id of the last value to return").StringVar(&opts.EndAtID)
+	kc.Flag("end-before-id", "id of the first value not to return").StringVar(&opts.EndBeforeID)
 	kc.Flag("limit", "maximum number of items to return").IntVar(&opts.Limit)
+	kc.Flag("reverse", "scan in reverse order, starting from the end").BoolVar(&opts.Reverse)
+	kc.Flag("keys-only", "only print the keys of the values").BoolVar(&opts.KeysOnly)
+	count := kc.Flag("count", "only print the number of matching values").Bool()
+	where := kc.Flag("where", `JSON predicate values must match, e.g. {"path":"/age","gte":18}`).String()
 	kc.Action(func(_ *kingpin.ParseContext) error {
+		opts := opts
+		if *where != "" {
+			opts.Where = &db.Predicate{}
+			if err := gojson.Unmarshal([]byte(*where), opts.Where); err != nil {
+				fmt.Fprintf(errs, "could not parse --where: %s\n", err)
+				return nil
+			}
+		}
 		db, err := gdb()
 		if err != nil {
 			return err
 		}
 		tx := db.NewTransaction()
 		defer tx.Close()
+		if *count {
+			n, err := tx.Count(opts)
+			if err != nil {
+				fmt.Fprintln(errs, err)
+				return nil
+			}
+			fmt.Fprintln(out, n)
+			return nil
+		}
 		items, err := tx.Scan(opts)
 		if err != nil {
 			fmt.Fprintln(errs, err)
 			return nil
 		}
 		for _, it := range items {
+			if opts.KeysOnly {
+				fmt.Fprintln(out, it.Key)
+				continue
+			}
+			if it.Blob != nil {
+				fmt.Fprintf(out, "%s: %s\n", it.Key, it.Blob)
+				continue
+			}
 			fmt.Fprintf(out, "%s: %s\n", it.Key, types.EncodedValue(it.Value.Value))
 		}
 		return nil
@@ -252,7 +304,7 @@ func put(parent *kingpin.Application, gdb gdb, in io.Reader, l zl.Logger) {
 		}
 
 		data := v.Bytes()
-		val, err := json.FromJSON(data, db.Noms())
+		val, err := db.FromJSON(data)
 		if err != nil {
 			return fmt.Errorf("could not parse value \"%s\" as json: %s", data, err)
 		}
@@ -293,6 +345,100 @@ func del(parent *kingpin.Application, gdb gdb, out io.Writer, l zl.Logger) {
 	})
 }
 
+func patch(parent *kingpin.Application, gdb gdb, in io.Reader, l zl.Logger) {
+	kc := parent.Command("patch", "Reads a JSON Patch (an array of operations) or JSON Merge Patch from stdin and applies it to a value in the database.")
+	id := kc.Arg("key", "key of the value to patch").Required().String()
+	format := kc.Flag("format", "format of the patch: json-patch or merge-patch").Required().Enum(string(db.JSONPatch), string(db.MergePatch))
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		var p bytes.Buffer
+		if _, err := p.ReadFrom(in); err != nil {
+			return err
+		}
+
+		data := p.Bytes()
+		val, err := d.FromJSON(data)
+		if err != nil {
+			return fmt.Errorf("could not parse patch \"%s\" as json: %s", data, err)
+		}
+		args := types.NewList(d.Noms(), types.String(*id), types.String(*format), val)
+		tx := d.NewTransactionWithArgs(".patchValue", args, nil, nil)
+
+		err = tx.Patch(*id, db.PatchFormat(*format), data)
+		if err == nil {
+			_, err = tx.Commit(l)
+		} else {
+			tx.Close()
+		}
+		return err
+	})
+}
+
+func batch(parent *kingpin.Application, gdb gdb, in io.Reader, out io.Writer, l zl.Logger) {
+	kc := parent.Command("batch", "Reads newline-delimited JSON operations like {\"op\":\"put\",\"key\":\"k\",\"value\":1} or {\"op\":\"del\",\"key\":\"k\"} from stdin and applies them in a single transaction.")
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+
+		ops := []db.BatchOp{}
+		r := bufio.NewReader(in)
+		for n := 1; ; n++ {
+			line, err := r.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if len(bytes.TrimSpace(line)) > 0 {
+				var op db.BatchOp
+				if jerr := gojson.Unmarshal(line, &op); jerr != nil {
+					return fmt.Errorf("could not parse line %d: %s", n, jerr)
+				}
+				ops = append(ops, op)
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+
+		// The values are in the commit already, so only the ops and keys are
+		// recorded as the args.
+		keys := make([]db.BatchOp, len(ops))
+		for i, op := range ops {
+			keys[i] = db.BatchOp{Op: op.Op, Key: op.Key}
+		}
+		args, err := d.FromJSON(mustMarshalOps(keys))
+		if err != nil {
+			return err
+		}
+		tx := d.NewTransactionWithArgs(".batch", args, nil, nil)
+		res, err := tx.Batch(ops)
+		if err != nil {
+			tx.Close()
+			return err
+		}
+		for i, r := range res {
+			if ops[i].Op == db.BatchOpDel && !r.Ok {
+				fmt.Fprintf(out, "No such id: %s\n", ops[i].Key)
+			}
+		}
+		_, err = tx.Commit(l)
+		if err == nil {
+			fmt.Fprintf(out, "Applied %d operations.\n", len(ops))
+		}
+		return err
+	})
+}
+
+func mustMarshalOps(ops []db.BatchOp) []byte {
+	b, err := gojson.Marshal(ops)
+	chk.NoError(err)
+	return b
+}
+
 func drop(parent *kingpin.Application, gsp gsp, in io.Reader, out io.Writer) {
 	kc := parent.Command("drop", "Removes all entries from the cache and deletes its history.")
 
@@ -313,9 +459,11 @@ func drop(parent *kingpin.Application, gsp gsp, in io.Reader, out io.Writer) {
 		if err != nil {
 			return err
 		}
-		noms := sp.GetDatabase()
-		_, err = noms.Delete(noms.GetDataset(db.MASTER_DATASET))
-		return err
+		d, err := db.LoadWithOptions(sp, db.Options{Lock: db.LockExclusive})
+		if err != nil {
+			return err
+		}
+		return d.Drop()
 	})
 }
 
@@ -393,6 +541,189 @@ func logCmd(parent *kingpin.Application, gdb gdb, out io.Writer) {
 	})
 }
 
+func diffCmd(parent *kingpin.Application, gdb gdb, out io.Writer) {
+	kc := parent.Command("diff", "Displays the changes to the data between two commits.")
+	from := kc.Arg("from", "hash of the commit to diff from").Required().String()
+	to := kc.Arg("to", "hash of the commit to diff to (defaults to the current head)").String()
+	prefix := kc.Flag("prefix", "only show changes to keys with this prefix").String()
+	js := kc.Flag("json", "print the changes as JSON").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		fromHash, ok := hash.MaybeParse(*from)
+		if !ok {
+			return fmt.Errorf("invalid hash: %s", *from)
+		}
+		toHash := d.HeadHash()
+		if *to != "" {
+			toHash, ok = hash.MaybeParse(*to)
+			if !ok {
+				return fmt.Errorf("invalid hash: %s", *to)
+			}
+		}
+		changes, err := d.Diff(fromHash, toHash, db.DiffOptions{Prefix: *prefix})
+		if err != nil {
+			return err
+		}
+
+		if *js {
+			enc := gojson.NewEncoder(out)
+			return enc.Encode(changes)
+		}
+		for _, c := range changes {
+			var oldValue, newValue interface{} = c.OldValue, c.NewValue
+			if c.OldBlob != nil {
+				oldValue = c.OldBlob
+			}
+			if c.NewBlob != nil {
+				newValue = c.NewBlob
+			}
+			switch c.Op {
+			case db.DiffOpAdd:
+				fmt.Fprintf(out, "+ %s: %s\n", c.Key, newValue)
+			case db.DiffOpRemove:
+				fmt.Fprintf(out, "- %s: %s\n", c.Key, oldValue)
+			case db.DiffOpChange:
+				fmt.Fprintf(out, "- %s: %s\n+ %s: %s\n", c.Key, oldValue, c.Key, newValue)
+			}
+		}
+		return nil
+	})
+}
+
+func exportCmd(parent *kingpin.Application, gdb gdb, out io.Writer) {
+	kc := parent.Command("export", "Writes the database to stdout as JSON Lines, to back it up or move it to another database with import.")
+	h := kc.Arg("hash", "hash of the commit to export (defaults to the current head)").String()
+	pending := kc.Flag("pending", "also export the local mutations that haven't been synced").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		opts := db.ExportOptions{Pending: *pending}
+		if *h != "" {
+			var ok bool
+			if opts.Commit, ok = hash.MaybeParse(*h); !ok {
+				return fmt.Errorf("invalid hash: %s", *h)
+			}
+		}
+		return d.Export(out, opts)
+	})
+}
+
+func importCmd(parent *kingpin.Application, gdb gdb, in io.Reader, out io.Writer) {
+	kc := parent.Command("import", "Reads an export from stdin into the database, which must be empty.")
+	adopt := kc.Flag("adopt-client-id", "take over the client ID of the exported database, which must then no longer sync").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		if err := d.Import(in, db.ImportOptions{AdoptClientID: *adopt}); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Imported %s.\n", d.HeadHash())
+		return nil
+	})
+}
+
+func fsck(parent *kingpin.Application, gdb gdb, out io.Writer, exit func(int)) {
+	kc := parent.Command("fsck", "Checks the integrity of the database and its history. Exits with status 2 if there are problems.")
+	js := kc.Flag("json", "print the report as JSON").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		r, err := d.Verify()
+		if err != nil {
+			return err
+		}
+		if *js {
+			if err := gojson.NewEncoder(out).Encode(r); err != nil {
+				return err
+			}
+		} else {
+			for _, i := range r.Issues {
+				fmt.Fprintf(out, "%s %s: %s\n", i.Check, i.Hash, i.Message)
+			}
+			fmt.Fprintf(out, "Checked %d commits, found %d problems.\n", r.Commits, len(r.Issues))
+		}
+		if !r.OK() {
+			exit(2)
+		}
+		return nil
+	})
+}
+
+func migrate(parent *kingpin.Application, gsp gsp, gdb gdb, out io.Writer) {
+	kc := parent.Command("migrate", "Upgrades the database to the current format. Every command does this when it opens the database.")
+	dryRun := kc.Flag("dry-run", "only print the migrations that would run").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		sp, err := gsp()
+		if err != nil {
+			return err
+		}
+		plan, err := db.PlanMigrations(sp, db.Options{Lock: db.LockExclusive})
+		if err != nil {
+			return err
+		}
+		for _, s := range plan.Steps {
+			fmt.Fprintf(out, "Migration: %s\n", s)
+		}
+		if *dryRun {
+			fmt.Fprintf(out, "Would migrate from format version %d to %d.\n", plan.From, plan.To)
+			return nil
+		}
+		if _, err := gdb(); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Migrated from format version %d to %d.\n", plan.From, plan.To)
+		return nil
+	})
+}
+
+func stats(parent *kingpin.Application, gdb gdb, out io.Writer) {
+	kc := parent.Command("stats", "Displays how much storage the database uses.")
+	js := kc.Flag("json", "print the stats as JSON").Bool()
+
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		d, err := gdb()
+		if err != nil {
+			return err
+		}
+		s, err := d.Stats()
+		if err != nil {
+			return err
+		}
+		if *js {
+			return gojson.NewEncoder(out).Encode(s)
+		}
+		fmt.Fprintf(out, "Disk bytes:      %d\n", s.DiskBytes)
+		fmt.Fprintf(out, "Chunks:          %d\n", s.Chunks)
+		fmt.Fprintf(out, "Keys:            %d\n", s.Keys)
+		fmt.Fprintf(out, "Value bytes:     %d\n", s.ValueBytes)
+		fmt.Fprintf(out, "Pending commits: %d\n", s.PendingCommits)
+		fmt.Fprintf(out, "History depth:   %d\n", s.HistoryDepth)
+		prefixes := make([]string, 0, len(s.Prefixes))
+		for p := range s.Prefixes {
+			prefixes = append(prefixes, p)
+		}
+		sort.Strings(prefixes)
+		for _, p := range prefixes {
+			fmt.Fprintf(out, "  %q: %d keys, %d value bytes\n", p, s.Prefixes[p].Keys, s.Prefixes[p].ValueBytes)
+		}
+		return nil
+	})
+}
+
 func color(text, color string) string {
 	if outputpager.IsStdoutTty() {
 		return ansi.Color(text, color)
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"strings"
 	"testing"
 
 	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
 	"github.com/stretchr/testify/assert"
 
 	"roci.dev/diff-server/util/log"
@@ -73,6 +75,38 @@ func TestCommands(t *testing.T) {
 			commitA,
 			"",
 		},
+		{
+			"diff good",
+			"",
+			"diff e99uif9c7bpavajrt666es1ki52dv239",
+			0,
+			"+ foo: \"bar\"\n",
+			"",
+		},
+		{
+			"diff json",
+			"",
+			"diff --json e99uif9c7bpavajrt666es1ki52dv239 0edk63ktqf2m2oj9jrsge5mlk7bl39gp",
+			0,
+			`[{"op":"add","key":"foo","newValue":"bar"}]` + "\n",
+			"",
+		},
+		{
+			"diff prefix",
+			"",
+			"diff --prefix=g e99uif9c7bpavajrt666es1ki52dv239",
+			0,
+			"",
+			"",
+		},
+		{
+			"diff bad hash",
+			"",
+			"diff monkey",
+			1,
+			"",
+			"invalid hash: monkey\n",
+		},
 		{
 			"has missing-arg",
 			"",
@@ -177,6 +211,30 @@ func TestCommands(t *testing.T) {
 			"",
 			"",
 		},
+		{
+			"scan end-before-id",
+			"",
+			"scan --end-before-id=foo",
+			0,
+			"",
+			"",
+		},
+		{
+			"scan end-at-id keys-only",
+			"",
+			"scan --end-at-id=foo --keys-only",
+			0,
+			"foo\n",
+			"",
+		},
+		{
+			"scan reverse count",
+			"",
+			"scan --reverse --count",
+			0,
+			"1\n",
+			"",
+		},
 		{
 			"del bad missing-arg",
 			"",
@@ -209,6 +267,22 @@ func TestCommands(t *testing.T) {
 			commitB + commitA,
 			"",
 		},
+		{
+			"fsck",
+			"",
+			"fsck",
+			0,
+			"Checked 3 commits, found 0 problems.\n",
+			"",
+		},
+		{
+			"migrate dry-run",
+			"",
+			"migrate --dry-run",
+			0,
+			"Would migrate from format version 1 to 1.\n",
+			"",
+		},
 	}
 
 	for _, c := range tc {
@@ -289,3 +363,197 @@ func TestEmptyInput(t *testing.T) {
 	args = []string{"--db=/tmp/foo"}
 	impl(args, strings.NewReader(""), ioutil.Discard, ioutil.Discard, func(_ int) {})
 }
+
+func TestBatch(t *testing.T) {
+	assert := assert.New(t)
+	_, dir := db.LoadTempDB(assert)
+
+	tc := []struct {
+		label string
+		in    string
+		code  int
+		out   string
+		err   string
+		data  string
+	}{
+		{"empty", "", 0, "Applied 0 operations.\n", "", `[]`},
+		{"good", "{\"op\":\"put\",\"key\":\"a\",\"value\":1}\n\n{\"op\":\"put\",\"key\":\"b\",\"value\":{\"x\":true}}\n{\"op\":\"del\",\"key\":\"nope\"}", 0, "No such id: nope\nApplied 3 operations.\n", "", `[{"key":"a","value":1},{"key":"b","value":{"x":true}}]`},
+		{"del", "{\"op\":\"del\",\"key\":\"a\"}\n", 0, "Applied 1 operations.\n", "", `[{"key":"b","value":{"x":true}}]`},
+		{"bad line", "{\"op\":\"del\",\"key\":\"b\"}\nmonkey\n", 1, "", "could not parse line 2: invalid character 'm' looking for beginning of value\n", `[{"key":"b","value":{"x":true}}]`},
+		{"bad op", "{\"op\":\"del\",\"key\":\"b\"}\n{\"op\":\"put\",\"key\":\"c\"}\n", 1, "", "op 1: value field is required\n", `[{"key":"b","value":{"x":true}}]`},
+	}
+
+	for _, c := range tc {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl([]string{"--db=" + dir, "batch"}, strings.NewReader(c.in), ob, eb, func(c int) {
+			code = c
+		})
+		assert.Equal(c.code, code, c.label)
+		assert.Equal(c.out, ob.String(), c.label)
+		assert.Equal(c.err, eb.String(), c.label)
+
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+		d, err := db.Load(sp)
+		assert.NoError(err)
+		tx := d.NewTransaction()
+		items, err := tx.Scan(db.ScanOptions{})
+		assert.NoError(err)
+		assert.NoError(tx.Close())
+		js, err := json.Marshal(items)
+		assert.NoError(err)
+		assert.Equal(c.data, string(js), c.label)
+		if c.label == "good" {
+			args, err := d.FromJSON([]byte(`[{"op":"put","key":"a"},{"op":"put","key":"b"},{"op":"del","key":"nope"}]`))
+			assert.NoError(err)
+			assert.Equal(".batch", d.Head().Meta.Local.Name)
+			assert.True(args.Equals(d.Head().Meta.Local.Args), types.EncodedValue(d.Head().Meta.Local.Args))
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	assert := assert.New(t)
+	_, dir := db.LoadTempDB(assert)
+
+	tc := []struct {
+		label string
+		in    string
+		args  string
+		code  int
+		out   string
+		err   string
+	}{
+		{"put", `{"a":1,"b":[1]}`, "put foo", 0, "", ""},
+		{"missing key", `{}`, "patch --format=merge-patch", 1, "", "required argument 'key' not provided\n"},
+		{"missing format", `{}`, "patch foo", 1, "", "required flag --format not provided\n"},
+		{"bad json", `{`, "patch --format=merge-patch foo", 1, "", "could not parse patch \"{\" as json: couldn't parse value '{' as json: unexpected end of JSON input\n"},
+		{"json patch", `[{"op":"add","path":"/b/-","value":2}]`, "patch --format=json-patch foo", 0, "", ""},
+		{"merge patch", `{"a":null}`, "patch --format=merge-patch foo", 0, "", ""},
+		{"get", "", "get foo", 0, `{"b":[1,2]}`, ""},
+		{"test fails", `[{"op":"test","path":"/b/0","value":2}]`, "patch --format=json-patch foo", 1, "", "test operation 0 failed: value at '/b/0' is 1, expected 2\n"},
+		{"missing value", `{}`, "patch --format=merge-patch bar", 1, "", "could not Patch 'bar': key does not exist\n"},
+		{"merge patch array", `[3]`, "patch --format=merge-patch foo", 0, "", ""},
+		{"get array", "", "get foo", 0, `[3]`, ""},
+	}
+
+	for _, c := range tc {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		args := append([]string{"--db=" + dir}, strings.Split(c.args, " ")...)
+		impl(args, strings.NewReader(c.in), ob, eb, func(c int) {
+			code = c
+		})
+		assert.Equal(c.code, code, c.label)
+		assert.Equal(c.out, ob.String(), c.label)
+		assert.Equal(c.err, eb.String(), c.label)
+	}
+}
+
+func TestScanWhere(t *testing.T) {
+	assert := assert.New(t)
+	_, dir := db.LoadTempDB(assert)
+
+	tc := []struct {
+		label string
+		in    string
+		args  string
+		code  int
+		out   string
+		err   string
+	}{
+		{"put a", `{"age":17}`, "put a", 0, "", ""},
+		{"put b", `{"age":30}`, "put b", 0, "", ""},
+		{"put c", `{"name":"c"}`, "put c", 0, "", ""},
+		{"range", "", `scan --keys-only --where={"path":"/age","gte":18}`, 0, "b\n", ""},
+		{"exists", "", `scan --keys-only --where={"path":"/age","exists":false}`, 0, "c\n", ""},
+		{"or", "", `scan --keys-only --where={"or":[{"path":"/age","eq":17},{"path":"/name","eq":"c"}]}`, 0, "a\nc\n", ""},
+		{"limit counts matches", "", `scan --keys-only --limit=1 --where={"path":"/age","exists":true}`, 0, "a\n", ""},
+		{"count", "", `scan --count --where={"path":"/age","lt":100}`, 0, "2\n", ""},
+		{"bad json", "", `scan --where={`, 0, "", "could not parse --where: unexpected end of JSON input\n"},
+		{"bad predicate", "", `scan --where={}`, 0, "", "invalid predicate: must have a test, and or or\n"},
+	}
+
+	for _, c := range tc {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		args := append([]string{"--db=" + dir}, strings.Split(c.args, " ")...)
+		impl(args, strings.NewReader(c.in), ob, eb, func(c int) {
+			code = c
+		})
+		assert.Equal(c.code, code, c.label)
+		assert.Equal(c.out, ob.String(), c.label)
+		assert.Equal(c.err, eb.String(), c.label)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	_, dir := db.LoadTempDB(assert)
+
+	tc := []struct {
+		label string
+		in    string
+		args  string
+		code  int
+		out   string
+		err   string
+	}{
+		{"put", `"bar"`, "put foo", 0, "", ""},
+		{"read", "", "--read-only get foo", 0, `"bar"`, ""},
+		{"write", `"baz"`, "--read-only put foo", 1, "", "Database is read-only\n"},
+		{"unchanged", "", "get foo", 0, `"bar"`, ""},
+	}
+
+	for _, c := range tc {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		args := append([]string{"--db=" + dir}, strings.Split(c.args, " ")...)
+		impl(args, strings.NewReader(c.in), ob, eb, func(c int) {
+			code = c
+		})
+		assert.Equal(c.code, code, c.label)
+		assert.Equal(c.out, ob.String(), c.label)
+		assert.Equal(c.err, eb.String(), c.label)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+	_, from := db.LoadTempDB(assert)
+	_, to := db.LoadTempDB(assert)
+
+	run := func(dir, args, in string) (int, string, string) {
+		ob := &strings.Builder{}
+		eb := &strings.Builder{}
+		code := 0
+		impl(append([]string{"--db=" + dir}, strings.Split(args, " ")...), strings.NewReader(in), ob, eb, func(c int) {
+			code = c
+		})
+		return code, ob.String(), eb.String()
+	}
+
+	code, _, _ := run(from, "put foo", `"bar"`)
+	assert.Equal(0, code)
+	code, export, errs := run(from, "export --pending", "")
+	assert.Equal(0, code)
+	assert.Equal("", errs)
+	assert.Regexp(`^{"header":{"version":1,`, export)
+
+	code, out, errs := run(to, "import", export)
+	assert.Equal(0, code)
+	assert.Regexp(`^Imported \w{32}\.\n$`, out)
+	assert.Equal("", errs)
+	code, out, _ = run(to, "get foo", "")
+	assert.Equal(0, code)
+	assert.Equal(`"bar"`, out)
+
+	code, _, errs = run(to, "import", export)
+	assert.Equal(1, code)
+	assert.Equal("can only import into an empty database\n", errs)
+}
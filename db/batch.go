@@ -0,0 +1,130 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/attic-labs/noms/go/types"
+
+	"roci.dev/diff-server/util/chk"
+)
+
+// BatchOpType is the kind of write done by a BatchOp.
+type BatchOpType string
+
+const (
+	BatchOpPut BatchOpType = "put"
+	BatchOpDel BatchOpType = "del"
+)
+
+// BatchOp is a single write of a batch. Value is required for puts and
+// ignored for dels.
+type BatchOp struct {
+	Op    BatchOpType     `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// BatchResult is the result of a BatchOp. For dels Ok is true if the entry
+// existed, for puts it is always true.
+type BatchResult struct {
+	Ok bool `json:"ok"`
+}
+
+// Batch applies ops to the transaction in order and returns their results. If
+// any op is invalid an error is returned and the ops before it are rolled back,
+// so that none of the ops are applied.
+func (tx *Transaction) Batch(ops []BatchOp) ([]BatchResult, error) {
+	defer tx.lock()()
+
+	if tx.closed {
+		return nil, ErrClosed
+	}
+
+	res := make([]BatchResult, len(ops))
+	undo := make([]batchUndo, 0, len(ops))
+	wrote := tx.wrote
+	for i, op := range ops {
+		if err := tx.applyBatchOp(op, &res[i], &undo); err != nil {
+			tx.rollbackBatch(undo, wrote)
+			return nil, fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+	return res, nil
+}
+
+// applyBatchOp applies op, stores its result in res and appends what is needed
+// to roll it back to undo. The caller must hold the write lock.
+func (tx *Transaction) applyBatchOp(op BatchOp, res *BatchResult, undo *[]batchUndo) error {
+	switch op.Op {
+	case BatchOpPut:
+		if len(op.Value) == 0 {
+			return errors.New("value field is required")
+		}
+		v, err := tx.db.codec.fromJSON(op.Value, tx.db.noms)
+		if err != nil {
+			return fmt.Errorf("could not Put '%s'='%s': %w", op.Key, op.Value, err)
+		}
+		*undo = append(*undo, tx.saveBatchUndo(op.Key))
+		if err := tx.set(op.Key, v); err != nil {
+			return err
+		}
+		res.Ok = true
+	case BatchOpDel:
+		*undo = append(*undo, tx.saveBatchUndo(op.Key))
+		ok, err := tx.remove(op.Key)
+		if err != nil {
+			return err
+		}
+		res.Ok = ok
+	case "":
+		return errors.New("op field is required")
+	default:
+		return fmt.Errorf("unknown op: %s", op.Op)
+	}
+	return nil
+}
+
+// batchUndo is the state of a key before a batch op wrote it.
+type batchUndo struct {
+	key    string
+	value  types.Value // nil if there was no entry.
+	edit   types.Value
+	edited bool        // whether the key had a pending edit, which is edit.
+	expiry types.Value // nil if the entry had no TTL.
+}
+
+// saveBatchUndo returns the state of key. The caller must hold the write lock.
+func (tx *Transaction) saveBatchUndo(key string) batchUndo {
+	k := types.String(key)
+	u := batchUndo{key: key, value: tx.me.Get(k)}
+	u.edit, u.edited = tx.edits.values[key]
+	if tx.expires != nil {
+		u.expiry = tx.expires.Get(k)
+	}
+	return u
+}
+
+// rollbackBatch restores the states in undo, in reverse order, and whether the
+// transaction wrote. The caller must hold the write lock.
+func (tx *Transaction) rollbackBatch(undo []batchUndo, wrote bool) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		k := types.String(u.key)
+		if u.value != nil {
+			chk.NoError(tx.me.Set(k, u.value))
+		} else if tx.me.Has(k) {
+			chk.NoError(tx.me.Remove(k))
+		}
+		tx.edits.restore(u.key, u.edit, u.edited)
+		if tx.expires != nil {
+			if u.expiry != nil {
+				tx.expires.Set(k, u.expiry.(types.Number))
+			} else {
+				tx.expires.Remove(k)
+			}
+		}
+	}
+	tx.wrote = wrote
+}
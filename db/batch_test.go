@@ -0,0 +1,129 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestBatch(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	db, err := Load(sp)
+	assert.NoError(err)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	tc := []struct {
+		label    string
+		ops      []BatchOp
+		expected []BatchResult
+		err      string
+		data     string
+	}{
+		{"empty", []BatchOp{}, []BatchResult{}, "", `map {"foo": "bar"}`},
+		{"put", []BatchOp{{Op: BatchOpPut, Key: "a", Value: []byte(`1`)}, {Op: BatchOpPut, Key: "b", Value: []byte(`true`)}},
+			[]BatchResult{{true}, {true}}, "", `map {"a": 1, "b": true, "foo": "bar"}`},
+		{"del", []BatchOp{{Op: BatchOpDel, Key: "foo"}, {Op: BatchOpDel, Key: "nope"}},
+			[]BatchResult{{true}, {false}}, "", `map {}`},
+		{"in order", []BatchOp{{Op: BatchOpDel, Key: "foo"}, {Op: BatchOpPut, Key: "foo", Value: []byte(`"baz"`)}, {Op: BatchOpDel, Key: "foo"}, {Op: BatchOpDel, Key: "foo"}},
+			[]BatchResult{{true}, {true}, {true}, {false}}, "", `map {}`},
+		{"bad json", []BatchOp{{Op: BatchOpDel, Key: "foo"}, {Op: BatchOpPut, Key: "a", Value: []byte(`{`)}},
+			nil, "op 1: could not Put 'a'='{'", `map {"foo": "bar"}`},
+		{"missing value", []BatchOp{{Op: BatchOpPut, Key: "a"}},
+			nil, "op 0: value field is required", `map {"foo": "bar"}`},
+		{"missing op", []BatchOp{{Key: "a"}},
+			nil, "op 0: op field is required", `map {"foo": "bar"}`},
+		{"unknown op", []BatchOp{{Op: "get", Key: "a"}},
+			nil, "op 0: unknown op: get", `map {"foo": "bar"}`},
+	}
+
+	for _, t := range tc {
+		tx := db.NewTransaction()
+		res, err := tx.Batch(t.ops)
+		if t.err != "" {
+			assert.Error(err, t.label)
+			assert.Contains(err.Error(), t.err, t.label)
+			assert.NoError(tx.Close())
+		} else {
+			assert.NoError(err, t.label)
+			_, err = tx.Commit(log.Default())
+			assert.NoError(err, t.label)
+		}
+		assert.Equal(t.expected, res, t.label)
+		assertDataEquals(assert, db, t.data)
+
+		// Restore the original state.
+		tx = db.NewTransaction()
+		_, err = tx.Batch([]BatchOp{{Op: BatchOpDel, Key: "a"}, {Op: BatchOpDel, Key: "b"}, {Op: BatchOpPut, Key: "foo", Value: []byte(`"bar"`)}})
+		assert.NoError(err)
+		_, err = tx.Commit(log.Default())
+		assert.NoError(err)
+	}
+
+	tx = db.NewTransaction()
+	assert.NoError(tx.Close())
+	_, err = tx.Batch([]BatchOp{{Op: BatchOpDel, Key: "foo"}})
+	assert.Equal(ErrClosed, err)
+}
+
+func TestBatchRollback(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	db, err := Load(sp)
+	assert.NoError(err)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	tx = db.NewTransaction()
+	assert.NoError(tx.Put("b", []byte(`"pending"`)))
+	_, err = tx.Batch([]BatchOp{
+		{Op: BatchOpPut, Key: "a", Value: []byte(`1`)},
+		{Op: BatchOpDel, Key: "foo"},
+		{Op: BatchOpPut, Key: "b", Value: []byte(`2`)},
+		{Op: BatchOpDel, Key: "b"},
+		{Op: BatchOpPut, Key: "c", Value: []byte(`{`)},
+	})
+	assert.Error(err)
+	assert.Contains(err.Error(), "op 4: could not Put 'c'='{'")
+
+	// The transaction is as it was before the batch.
+	items, err := tx.Scan(ScanOptions{})
+	assert.NoError(err)
+	keys := []string{}
+	for _, it := range items {
+		keys = append(keys, it.Key)
+	}
+	assert.Equal([]string{"b", "foo"}, keys)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assertDataEquals(assert, db, `map {"b": "pending", "foo": "bar"}`)
+
+	// A batch that fails in a transaction without other writes doesn't write.
+	tx = db.NewTransaction()
+	_, err = tx.Batch([]BatchOp{{Op: BatchOpDel, Key: "foo"}, {Op: "get", Key: "a"}})
+	assert.Error(err)
+	assert.False(tx.wrote)
+	assert.NoError(tx.Close())
+
+	local := db.NewTransaction().Local()
+	assert.NoError(local.PutWithTTL("t", []byte(`1`), time.Hour))
+	_, err = local.Batch([]BatchOp{{Op: BatchOpPut, Key: "t", Value: []byte(`2`)}, {Op: BatchOpPut, Key: "u"}})
+	assert.Error(err)
+	v, err := local.Get("t")
+	assert.NoError(err)
+	assert.Equal(`1`, string(v))
+	assert.NotNil(local.expires.Get(types.String("t")))
+}
@@ -21,3 +21,33 @@ func BenchmarkPut(b *testing.B) {
 		assert.NoError(err)
 	}
 }
+
+// BenchmarkScanWithWrites scans a transaction after each of its writes. The
+// build variant measures scanning by building the transaction's map first.
+func BenchmarkScanWithWrites(b *testing.B) {
+	for _, build := range []bool{false, true} {
+		b.Run(fmt.Sprintf("build=%t", build), func(b *testing.B) {
+			assert := assert.New(b)
+			db, _ := LoadTempDB(assert)
+			tx := db.NewTransaction()
+			for i := 0; i < 10000; i++ {
+				assert.NoError(tx.Put(fmt.Sprintf("k%05d", i), []byte("true")))
+			}
+			_, err := tx.Commit(log.Default())
+			assert.NoError(err)
+
+			tx = db.NewTransaction()
+			defer tx.Close()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				assert.NoError(tx.Put(fmt.Sprintf("k%05d", n%10000), []byte("false")))
+				if build {
+					_, err = scan(tx.me.Build().NomsMap(), nil, ScanOptions{Limit: 10}, nil)
+				} else {
+					_, err = tx.Scan(ScanOptions{Limit: 10})
+				}
+				assert.NoError(err)
+			}
+		})
+	}
+}
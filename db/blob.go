@@ -0,0 +1,132 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// ErrBlob is returned when reading a blob value as JSON.
+var ErrBlob = errors.New("value is a blob")
+
+// BlobInfo describes a blob value without its data. Scan and diff results carry
+// a BlobInfo in place of the value for blobs.
+type BlobInfo struct {
+	Size uint64 `json:"size"`
+	Hash string `json:"hash"`
+}
+
+func (b BlobInfo) String() string {
+	return fmt.Sprintf("blob(size=%d, hash=%s)", b.Size, b.Hash)
+}
+
+// blobInfo returns the BlobInfo of v if it is a blob.
+func blobInfo(v types.Value) (*BlobInfo, bool) {
+	b, ok := v.(types.Blob)
+	if !ok {
+		return nil, false
+	}
+	return &BlobInfo{b.Len(), b.Hash().String()}, true
+}
+
+// PutBlob stores the data read from r as a blob at key, replacing any value
+// that is there. The data is chunked while it is read, so it need not fit in
+// memory.
+func (tx *Transaction) PutBlob(key string, r io.Reader) (BlobInfo, error) {
+	if tx.Closed() {
+		return BlobInfo{}, ErrClosed
+	}
+
+	b := types.NewBlob(tx.db.noms, r)
+
+	defer tx.lock()()
+
+	if tx.closed {
+		return BlobInfo{}, ErrClosed
+	}
+	if err := tx.set(key, b); err != nil {
+		return BlobInfo{}, err
+	}
+	info, _ := blobInfo(b)
+	return *info, nil
+}
+
+// WriteBlob writes data into the blob at key starting at offset, overwriting
+// existing bytes and extending the blob as needed. If there is no value at key
+// a new blob is created, in which case offset must be 0.
+func (tx *Transaction) WriteBlob(key string, offset uint64, data []byte) (BlobInfo, error) {
+	defer tx.lock()()
+
+	if tx.closed {
+		return BlobInfo{}, ErrClosed
+	}
+	var b types.Blob
+	current := tx.me.Get(types.String(key))
+	if current == nil {
+		b = types.NewEmptyBlob(tx.db.noms)
+	} else {
+		var ok bool
+		if b, ok = current.(types.Blob); !ok {
+			return BlobInfo{}, fmt.Errorf("value at '%s' is not a blob", key)
+		}
+	}
+	if offset > b.Len() {
+		return BlobInfo{}, fmt.Errorf("offset %d is beyond the end of the blob at '%s' (size %d)", offset, key, b.Len())
+	}
+	del := b.Len() - offset
+	if del > uint64(len(data)) {
+		del = uint64(len(data))
+	}
+	b = b.Edit().Splice(offset, del, data).Blob()
+	if err := tx.set(key, b); err != nil {
+		return BlobInfo{}, err
+	}
+	info, _ := blobInfo(b)
+	return *info, nil
+}
+
+// ReadBlob returns up to length bytes of the blob at key starting at offset. If
+// length is 0 the rest of the blob is returned. It returns an error wrapping
+// ErrNoSuchKey if there is no value at key.
+func (tx *Transaction) ReadBlob(key string, offset, length uint64) ([]byte, BlobInfo, error) {
+	r, info, err := tx.BlobReader(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	if offset > info.Size {
+		return nil, BlobInfo{}, fmt.Errorf("offset %d is beyond the end of the blob at '%s' (size %d)", offset, key, info.Size)
+	}
+	if length == 0 || length > info.Size-offset {
+		length = info.Size - offset
+	}
+	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, BlobInfo{}, err
+	}
+	p := make([]byte, length)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, BlobInfo{}, err
+	}
+	return p, info, nil
+}
+
+// BlobReader returns a reader over the blob at key, for streaming. The reader
+// reads the blob as of this call and is not affected by later writes.
+func (tx *Transaction) BlobReader(key string) (io.ReadSeeker, BlobInfo, error) {
+	defer tx.rlock()()
+
+	if tx.closed {
+		return nil, BlobInfo{}, ErrClosed
+	}
+	v := tx.me.Get(types.String(key))
+	if v == nil {
+		return nil, BlobInfo{}, fmt.Errorf("%w: %s", ErrNoSuchKey, key)
+	}
+	b, ok := v.(types.Blob)
+	if !ok {
+		return nil, BlobInfo{}, fmt.Errorf("value at '%s' is not a blob", key)
+	}
+	info, _ := blobInfo(b)
+	return b.Reader(), *info, nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestBlob(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	// Large enough to be chunked.
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+
+	tx := db.NewTransaction()
+	info, err := tx.PutBlob("b", bytes.NewReader(data))
+	assert.NoError(err)
+	assert.Equal(uint64(len(data)), info.Size)
+	assert.NoError(tx.Put("j", []byte(`"x"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	from := db.HeadHash()
+
+	tx = db.NewTransaction()
+	r, info2, err := tx.BlobReader("b")
+	assert.NoError(err)
+	assert.Equal(info, info2)
+	all, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(data, all)
+
+	p, _, err := tx.ReadBlob("b", 500005, 10)
+	assert.NoError(err)
+	assert.Equal("5678901234", string(p))
+	p, _, err = tx.ReadBlob("b", uint64(len(data))-3, 0)
+	assert.NoError(err)
+	assert.Equal("789", string(p))
+	_, _, err = tx.ReadBlob("b", uint64(len(data))+1, 0)
+	assert.Error(err)
+	_, _, err = tx.ReadBlob("nope", 0, 0)
+	assert.True(errors.Is(err, ErrNoSuchKey))
+	_, _, err = tx.ReadBlob("j", 0, 0)
+	assert.EqualError(err, "value at 'j' is not a blob")
+	_, err = tx.Get("b")
+	assert.Equal(ErrBlob, err)
+
+	// Range writes overwrite and extend.
+	info, err = tx.WriteBlob("b", uint64(len(data))-2, []byte("abcd"))
+	assert.NoError(err)
+	assert.Equal(uint64(len(data)+2), info.Size)
+	p, _, err = tx.ReadBlob("b", uint64(len(data))-4, 0)
+	assert.NoError(err)
+	assert.Equal("67abcd", string(p))
+	info, err = tx.WriteBlob("new", 0, []byte("hi"))
+	assert.NoError(err)
+	assert.Equal(uint64(2), info.Size)
+	_, err = tx.WriteBlob("other", 1, []byte("hi"))
+	assert.Error(err)
+	_, err = tx.WriteBlob("j", 0, []byte("hi"))
+	assert.Error(err)
+
+	// Scan and diff describe blobs instead of inlining them.
+	items, err := tx.Scan(ScanOptions{})
+	assert.NoError(err)
+	assert.Equal(3, len(items))
+	assert.Equal("b", items[0].Key)
+	assert.Nil(items[0].Value)
+	assert.Equal(uint64(len(data)+2), items[0].Blob.Size)
+	assert.Equal(&BlobInfo{2, info.Hash}, items[1].Blob)
+	assert.NotNil(items[2].Value)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	changes, err := db.Diff(from, db.HeadHash(), DiffOptions{})
+	assert.NoError(err)
+	assert.Equal(2, len(changes))
+	assert.Equal(DiffOpChange, changes[0].Op)
+	assert.Equal(&info2, changes[0].OldBlob)
+	assert.Nil(changes[0].OldValue)
+	assert.Equal(uint64(len(data)+2), changes[0].NewBlob.Size)
+	assert.Equal(DiffOpAdd, changes[1].Op)
+	assert.Equal("new", changes[1].Key)
+	assert.True(strings.HasPrefix(changes[1].NewBlob.String(), "blob(size=2, hash="))
+}
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/attic-labs/noms/go/types"
+
+	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/chk"
+	nomsjson "roci.dev/diff-server/util/noms/json"
+)
+
+const (
+	// losslessIntKey is the key of the single member of the JSON object that
+	// stands in for an integer in lossless integer mode.
+	losslessIntKey = losslessIntEscape + "int"
+
+	// losslessIntEscape starts losslessIntKey. It is prepended to the keys of
+	// objects from the host that start with it.
+	losslessIntEscape = "\u0000"
+
+	// maxExactInt is the largest integer such that it and all smaller integers
+	// can be represented exactly as float64.
+	maxExactInt = 1 << 53
+)
+
+// jsonCodec converts between JSON and stored noms values. nomsjson decodes all
+// JSON numbers to noms Numbers, which are float64, so integers beyond 2^53
+// are silently rounded. With losslessInts set such integers are instead
+// stored as an object {"\u0000int": "<decimal>"}, which is converted back when
+// the value is encoded as JSON again. So that objects of the host can't be
+// mistaken for such integers, the keys of their members that start with
+// "\u0000" are escaped by prepending another "\u0000". Integers that are
+// exactly representable are stored as Numbers in either mode, so only values
+// with large integers or such keys differ between modes.
+type jsonCodec struct {
+	losslessInts bool
+}
+
+// fromJSON returns the noms value for the JSON data.
+func (c jsonCodec) fromJSON(data []byte, noms types.ValueReadWriter) (types.Value, error) {
+	data, err := c.importJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return nomsjson.FromJSON(data, noms)
+}
+
+// toJSON returns the JSON encoding of the noms value v. Blobs have no JSON
+// encoding, ErrBlob is returned for them.
+func (c jsonCodec) toJSON(v types.Value) ([]byte, error) {
+	if v.Kind() == types.BlobKind {
+		return nil, ErrBlob
+	}
+	var b bytes.Buffer
+	if err := nomsjson.ToJSON(v, &b); err != nil {
+		return nil, err
+	}
+	return c.exportJSON(b.Bytes())
+}
+
+// importJSON converts JSON from the host to the JSON that nomsjson decodes.
+func (c jsonCodec) importJSON(data []byte) ([]byte, error) {
+	if !c.losslessInts {
+		return data, nil
+	}
+	return mapJSON(data, importValue)
+}
+
+// exportJSON converts JSON that nomsjson encoded, possibly embedded in a larger
+// document, to the JSON that was imported.
+func (c jsonCodec) exportJSON(data []byte) ([]byte, error) {
+	if !c.losslessInts {
+		return data, nil
+	}
+	return mapJSON(data, exportValue)
+}
+
+// serverValue returns v as the server stores it, which is how nomsjson decodes
+// the JSON of v that is pushed to it.
+func (c jsonCodec) serverValue(v types.Value, noms types.ValueReadWriter) (types.Value, error) {
+	if !c.losslessInts || v.Kind() == types.BlobKind {
+		return v, nil
+	}
+	b, err := c.toJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return nomsjson.FromJSON(b, noms)
+}
+
+// serverChecksum returns the checksum of m with its values as the server
+// stores them. It differs from the checksum of m only if m has values that
+// serverValue changes.
+func (c jsonCodec) serverChecksum(m kv.Map, noms types.ValueReadWriter) (string, error) {
+	if !c.losslessInts {
+		return m.Checksum(), nil
+	}
+	var err error
+	ed := kv.NewMap(noms).Edit()
+	m.NomsMap().IterAll(func(k, v types.Value) {
+		if err != nil {
+			return
+		}
+		if v, err = c.serverValue(v, noms); err == nil {
+			err = ed.Set(k, v)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return ed.Build().Checksum(), nil
+}
+
+// mapJSON returns data with its decoded value v replaced by f(v) if f returns
+// true. If f returns false data is returned unchanged.
+func mapJSON(data []byte, f func(v interface{}) (interface{}, bool)) ([]byte, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	v, changed := f(v)
+	if !changed {
+		return data, nil
+	}
+	r, err := json.Marshal(v)
+	chk.NoError(err)
+	return r, nil
+}
+
+// importValue replaces the integers within v that can't be represented as
+// float64 exactly, and escapes the keys that start with losslessIntEscape.
+func importValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return encodeInt(v)
+	case map[string]interface{}:
+		changed := false
+		r := make(map[string]interface{}, len(v))
+		for k, c := range v {
+			if nc, ok := importValue(c); ok {
+				c = nc
+				changed = true
+			}
+			if strings.HasPrefix(k, losslessIntEscape) {
+				k = losslessIntEscape + k
+				changed = true
+			}
+			r[k] = c
+		}
+		return r, changed
+	case []interface{}:
+		return mapElements(v, importValue)
+	}
+	return v, false
+}
+
+// exportValue reverses importValue.
+func exportValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if n, ok := decodeInt(v); ok {
+			return n, true
+		}
+		changed := false
+		r := make(map[string]interface{}, len(v))
+		for k, c := range v {
+			if nc, ok := exportValue(c); ok {
+				c = nc
+				changed = true
+			}
+			if strings.HasPrefix(k, losslessIntEscape) {
+				k = k[len(losslessIntEscape):]
+				changed = true
+			}
+			r[k] = c
+		}
+		return r, changed
+	case []interface{}:
+		return mapElements(v, exportValue)
+	}
+	return v, false
+}
+
+// mapElements replaces the elements of a with f(e) where f returns true.
+func mapElements(a []interface{}, f func(v interface{}) (interface{}, bool)) (interface{}, bool) {
+	changed := false
+	for i, e := range a {
+		if r, ok := f(e); ok {
+			a[i] = r
+			changed = true
+		}
+	}
+	return a, changed
+}
+
+// encodeInt replaces integers that can't be represented as float64 exactly.
+func encodeInt(n json.Number) (interface{}, bool) {
+	if strings.ContainsAny(string(n), ".eE") {
+		return n, false
+	}
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		if i >= -maxExactInt && i <= maxExactInt {
+			return n, false
+		}
+	} else if u, err := strconv.ParseUint(string(n), 10, 64); err != nil || u <= maxExactInt {
+		// Beyond 64 bits we keep the float like before.
+		return n, false
+	}
+	return map[string]interface{}{losslessIntKey: string(n)}, true
+}
+
+// decodeInt reverses encodeInt. Since importValue escapes the keys of the
+// host's objects, only objects made by encodeInt have the key losslessIntKey.
+func decodeInt(m map[string]interface{}) (interface{}, bool) {
+	if len(m) != 1 {
+		return nil, false
+	}
+	s, ok := m[losslessIntKey].(string)
+	if !ok {
+		return nil, false
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+		if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, false
+		}
+	}
+	return json.Number(s), true
+}
+
+// decodeJSON decodes the single JSON value in b, keeping numbers as json.Number
+// so that they are not rounded.
+func decodeJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if err := d.Decode(&struct{}{}); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+func mustMarshalJSON(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	chk.NoError(err)
+	return b
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/kv"
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
+	nomsjson "roci.dev/diff-server/util/noms/json"
+)
+
+func loadLossless(assert *assert.Assertions) *DB {
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	db, err := LoadWithOptions(sp, Options{LosslessIntegers: true})
+	assert.NoError(err)
+	return db
+}
+
+func TestLosslessIntegers(t *testing.T) {
+	assert := assert.New(t)
+	db := loadLossless(assert)
+
+	tc := []string{
+		`0`,
+		`-1`,
+		`9007199254740992`,
+		`-9007199254740992`,
+		`9007199254740993`,
+		`-9007199254740993`,
+		`9223372036854775807`,
+		`-9223372036854775808`,
+		`18446744073709551615`,
+		`1.5`,
+		`[1,9007199254740993,{"a":-9223372036854775808}]`,
+		`{"a":{"b":[18446744073709551615]},"c":"9007199254740993"}`,
+		// Objects like the ones that stand in for integers are not integers.
+		`{"\u0000int":"9007199254740993"}`,
+		`{"\u0000int":"1","a":{"\u0000\u0000":2}}`,
+	}
+
+	for _, v := range tc {
+		tx := db.NewTransaction()
+		assert.NoError(tx.Put("k", []byte(v)), v)
+		_, err := tx.Commit(log.Default())
+		assert.NoError(err, v)
+
+		tx = db.NewTransaction()
+		actual, err := tx.Get("k")
+		assert.NoError(err, v)
+		assert.Equal(v, string(actual), v)
+
+		items, err := tx.Scan(ScanOptions{})
+		assert.NoError(err, v)
+		js, err := db.ExportJSON(mustMarshalJSON(items))
+		assert.NoError(err, v)
+		assert.Equal(fmt.Sprintf(`[{"key":"k","value":%s}]`, v), string(js), v)
+		assert.NoError(tx.Close())
+	}
+
+	// Preconditions, patches and paths see the exact values too.
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("k", []byte(`{"id":9007199254740993}`)))
+	assert.Error(tx.PutIf("k", []byte(`1`), Precondition{Equals: []byte(`{"id":9007199254740992}`)}))
+	assert.NoError(tx.Patch("k", JSONPatch, []byte(`[{"op":"test","path":"/id","value":9007199254740993},{"op":"add","path":"/next","value":9007199254740995}]`)))
+	actual, err := tx.GetPath("k", "/next")
+	assert.NoError(err)
+	assert.Equal(`9007199254740995`, string(actual))
+	assert.NoError(tx.Close())
+
+	// Without the option large integers are rounded, as before.
+	db, _ = LoadTempDB(assert)
+	tx = db.NewTransaction()
+	assert.NoError(tx.Put("k", []byte(`9007199254740993`)))
+	actual, err = tx.Get("k")
+	assert.NoError(err)
+	assert.NotEqual(`9007199254740993`, string(actual))
+	assert.NoError(tx.Close())
+}
+
+func TestLosslessIntegersRecorded(t *testing.T) {
+	assert := assert.New(t)
+	for _, lossless := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "")
+		assert.NoError(err)
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+
+		// The setting is recorded when the database is created.
+		db, err := LoadWithOptions(sp, Options{LosslessIntegers: lossless})
+		assert.NoError(err)
+		assert.NoError(db.Close())
+		_, err = LoadWithOptions(sp, Options{LosslessIntegers: !lossless})
+		assert.True(errors.Is(err, ErrIntegerMode), "%v", err)
+		db, err = LoadWithOptions(sp, Options{LosslessIntegers: lossless})
+		assert.NoError(err)
+		assert.NoError(db.Close())
+	}
+}
+
+func TestLosslessIntegersSync(t *testing.T) {
+	assert := assert.New(t)
+	db := loadLossless(assert)
+
+	// The server stores the value rounded, and its checksum is of that.
+	sv, err := nomsjson.FromJSON([]byte(`9007199254740993`), db.noms)
+	assert.NoError(err)
+	sed := kv.NewMap(db.noms).Edit()
+	assert.NoError(sed.Set(types.String("big"), sv))
+	serverChecksum := sed.Build().Checksum()
+
+	ed := kv.NewMap(db.noms).Edit()
+	v, err := db.codec.fromJSON([]byte(`9007199254740993`), db.noms)
+	assert.NoError(err)
+	assert.NoError(ed.Set(types.String("big"), v))
+	expected := ed.Build()
+	assert.NotEqual(serverChecksum, expected.Checksum())
+
+	var pullReq servetypes.PullRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(json.NewDecoder(r.Body).Decode(&pullReq))
+		fmt.Fprintf(w, `{"patch":[{"op":"add","path":"/big","value":9007199254740993}],"stateID":"1","checksum":"%s","lastMutationID":0}`, serverChecksum)
+	}))
+	defer server.Close()
+
+	snapshot, _, err := db.puller.Pull(db.noms, db.Head(), server.URL, "", "", db.clientID, "1")
+	assert.NoError(err)
+	assert.Equal(expected.NomsMap().Hash(), snapshot.Value.Data.TargetHash())
+	assert.Equal(serverChecksum, snapshot.Meta.Snapshot.ServerChecksum)
+
+	// The next pull sends the server's checksum.
+	_, _, err = db.puller.Pull(db.noms, snapshot, server.URL, "", "", db.clientID, "2")
+	assert.NoError(err)
+	assert.Equal(serverChecksum, pullReq.Checksum)
+
+	// Exports keep it, for imports and seeds.
+	assert.NoError(db.setHead(snapshot))
+	var buf bytes.Buffer
+	assert.NoError(db.Export(&buf, ExportOptions{}))
+	imported := loadLossless(assert)
+	assert.NoError(imported.Import(bytes.NewReader(buf.Bytes()), ImportOptions{}))
+	assert.Equal(serverChecksum, imported.Head().serverChecksum())
+	seed, err := ioutil.TempFile("", "")
+	assert.NoError(err)
+	_, err = seed.Write(buf.Bytes())
+	assert.NoError(err)
+	assert.NoError(seed.Close())
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	seeded, err := LoadWithOptions(sp, Options{LosslessIntegers: true, SeedFile: seed.Name()})
+	assert.NoError(err)
+	assert.Equal(serverChecksum, seeded.Head().serverChecksum())
+
+	// A wrong checksum is still caught.
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"patch":[{"op":"add","path":"/big","value":9007199254740995}],"stateID":"1","checksum":"%s","lastMutationID":0}`, serverChecksum)
+	}))
+	defer server.Close()
+	_, _, err = db.puller.Pull(db.noms, db.Head(), server.URL, "", "", db.clientID, "3")
+	assert.Error(err)
+	assert.Contains(err.Error(), "checksum mismatch")
+
+	args, err := db.FromJSON([]byte(`[18446744073709551615]`))
+	assert.NoError(err)
+	var body []byte
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err = ioutil.ReadAll(r.Body)
+		assert.NoError(err)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	info := db.pusher.Push([]Local{{MutationID: 1, Name: "m", Args: args}}, server.URL, "", "", "1")
+	assert.Equal(200, info.HTTPStatusCode)
+	assert.Equal(`{"clientID":"","mutations":[{"id":1,"name":"m","args":[18446744073709551615]}]}`, string(body))
+}
@@ -24,6 +24,7 @@ Struct Commit {
 	meta: Struct Snapshot {
 		lastMutationID?: Number,
 		serverStateID?: String,
+		serverChecksum?: String,
 	} |
 	Struct Local {
 		date:   Struct DateTime {
@@ -35,6 +36,13 @@ Struct Commit {
 	value: Struct {
 		data: Ref<Map<String, Value>>,
 		checksum: String,
+		indexes?: Ref<Map<String, Struct Index {
+			definition: Struct IndexDefinition {
+				keyPrefix: String,
+				jsonPath: String,
+			},
+			data: Ref<Map<String, String>>,
+		}>>,
 	},
 }`)
 )
@@ -51,6 +59,10 @@ type Local struct {
 type Snapshot struct {
 	LastMutationID uint64 `noms:",omitempty"`
 	ServerStateID  string `noms:",omitempty"`
+	// ServerChecksum is the checksum of the data as the server stores it, if
+	// it differs from the checksum of the commit's data. See
+	// jsonCodec.serverChecksum.
+	ServerChecksum string `noms:",omitempty"`
 }
 
 type Meta struct {
@@ -80,6 +92,8 @@ type Commit struct {
 	Value   struct {
 		Data     types.Ref `noms:",omitempty"`
 		Checksum types.String
+		// Indexes is a Ref<Map<String, Index>> of the secondary indexes over Data, keyed by name.
+		Indexes types.Ref `noms:",omitempty"`
 	}
 	NomsStruct types.Struct `noms:",original"`
 }
@@ -196,30 +210,48 @@ func pendingCommits(noms types.ValueReadWriter, head Commit) ([]Commit, error) {
 	return append(pending, head), nil
 }
 
-func makeSnapshot(noms types.ValueReadWriter, basis types.Ref, serverStateID string, dataRef types.Ref, checksum types.String, lastMutationID uint64) Commit {
+func makeSnapshot(noms types.ValueReadWriter, basis types.Ref, serverStateID string, dataRef types.Ref, checksum types.String, lastMutationID uint64, indexes types.Ref) Commit {
 	c := Commit{}
 	c.Parents = []types.Ref{basis}
 	c.Meta.Snapshot.LastMutationID = lastMutationID
 	c.Meta.Snapshot.ServerStateID = serverStateID
 	c.Value.Data = dataRef
 	c.Value.Checksum = checksum
+	c.Value.Indexes = indexes
 	c.NomsStruct = marshal.MustMarshal(noms, c).(types.Struct)
 	return c
 }
 
+// withServerChecksum returns the snapshot c with its ServerChecksum set.
+func withServerChecksum(noms types.ValueReadWriter, c Commit, serverChecksum string) Commit {
+	c.Meta.Snapshot.ServerChecksum = serverChecksum
+	c.NomsStruct = marshal.MustMarshal(noms, c).(types.Struct)
+	return c
+}
+
+// serverChecksum returns the checksum of the data of the snapshot c as the
+// server stores it.
+func (c Commit) serverChecksum() string {
+	if c.Meta.Snapshot.ServerChecksum != "" {
+		return c.Meta.Snapshot.ServerChecksum
+	}
+	return string(c.Value.Checksum)
+}
+
 // makeGenesis makes the first Snapshot, the Snapshot with no parents.
-func makeGenesis(noms types.ValueReadWriter, serverStateID string, dataRef types.Ref, checksum types.String, lastMutationID uint64) Commit {
+func makeGenesis(noms types.ValueReadWriter, serverStateID string, dataRef types.Ref, checksum types.String, lastMutationID uint64, indexes types.Ref) Commit {
 	c := Commit{}
 	// Note: no c.Parents.
 	c.Meta.Snapshot.LastMutationID = lastMutationID
 	c.Meta.Snapshot.ServerStateID = serverStateID
 	c.Value.Data = dataRef
 	c.Value.Checksum = checksum
+	c.Value.Indexes = indexes
 	c.NomsStruct = marshal.MustMarshal(noms, c).(types.Struct)
 	return c
 }
 
-func makeLocal(noms types.ValueReadWriter, basis types.Ref, d datetime.DateTime, mutationID uint64, f string, args types.Value, newData types.Ref, checksum types.String) Commit {
+func makeLocal(noms types.ValueReadWriter, basis types.Ref, d datetime.DateTime, mutationID uint64, f string, args types.Value, newData types.Ref, checksum types.String, indexes types.Ref) Commit {
 	c := Commit{}
 	c.Parents = []types.Ref{basis}
 	c.Meta.Local.MutationID = mutationID
@@ -228,11 +260,12 @@ func makeLocal(noms types.ValueReadWriter, basis types.Ref, d datetime.DateTime,
 	c.Meta.Local.Args = args
 	c.Value.Data = newData
 	c.Value.Checksum = checksum
+	c.Value.Indexes = indexes
 	c.NomsStruct = marshal.MustMarshal(noms, c).(types.Struct)
 	return c
 }
 
-func makeReplayedLocal(noms types.ValueReadWriter, basis types.Ref, d datetime.DateTime, mutationID uint64, f string, args types.Value, newData types.Ref, checksum types.String, original types.Ref) Commit {
+func makeReplayedLocal(noms types.ValueReadWriter, basis types.Ref, d datetime.DateTime, mutationID uint64, f string, args types.Value, newData types.Ref, checksum types.String, original types.Ref, indexes types.Ref) Commit {
 	c := Commit{}
 	c.Parents = []types.Ref{basis}
 	c.Meta.Local.MutationID = mutationID
@@ -242,6 +275,7 @@ func makeReplayedLocal(noms types.ValueReadWriter, basis types.Ref, d datetime.D
 	c.Meta.Local.Original = original
 	c.Value.Data = newData
 	c.Value.Checksum = checksum
+	c.Value.Indexes = indexes
 	c.NomsStruct = marshal.MustMarshal(noms, c).(types.Struct)
 	return c
 }
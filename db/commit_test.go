@@ -28,8 +28,8 @@ func TestMarshal(t *testing.T) {
 	drChecksum := dr.NomsChecksum()
 	drRef := noms.WriteValue(dr.NomsMap())
 	args := types.NewList(noms, types.Bool(true), types.String("monkey"))
-	g := makeGenesis(noms, "", emRef, emChecksum, emLTID)
-	tx := makeLocal(noms, g.Ref(), d, g.NextMutationID(), "func", args, drRef, drChecksum)
+	g := makeGenesis(noms, "", emRef, emChecksum, emLTID, types.Ref{})
+	tx := makeLocal(noms, g.Ref(), d, g.NextMutationID(), "func", args, drRef, drChecksum, types.Ref{})
 	noms.WriteValue(g.NomsStruct)
 
 	tc := []struct {
@@ -37,7 +37,7 @@ func TestMarshal(t *testing.T) {
 		exp types.Value
 	}{
 		{
-			makeGenesis(noms, "", emRef, emChecksum, uint64(0)),
+			makeGenesis(noms, "", emRef, emChecksum, uint64(0), types.Ref{}),
 			types.NewStruct("Commit", types.StructData{
 				"meta":    types.NewStruct("Snapshot", types.StructData{}),
 				"parents": types.NewSet(noms),
@@ -48,7 +48,7 @@ func TestMarshal(t *testing.T) {
 			}),
 		},
 		{
-			makeSnapshot(noms, g.Ref(), "foo", emRef, emChecksum, emLTID),
+			makeSnapshot(noms, g.Ref(), "foo", emRef, emChecksum, emLTID, types.Ref{}),
 			types.NewStruct("Commit", types.StructData{
 				"meta": types.NewStruct("Snapshot", types.StructData{
 					"lastMutationID": types.Number(emLTID),
@@ -78,7 +78,7 @@ func TestMarshal(t *testing.T) {
 			}),
 		},
 		{
-			makeLocal(noms, g.Ref(), d, g.NextMutationID(), "func", args, drRef, drChecksum),
+			makeLocal(noms, g.Ref(), d, g.NextMutationID(), "func", args, drRef, drChecksum, types.Ref{}),
 			types.NewStruct("Commit", types.StructData{
 				"parents": types.NewSet(noms, g.Ref()),
 				"meta": types.NewStruct("Local", types.StructData{
@@ -94,7 +94,7 @@ func TestMarshal(t *testing.T) {
 			}),
 		},
 		{
-			makeReplayedLocal(noms, g.Ref(), d, g.NextMutationID(), "func", args, drRef, drChecksum, tx.Ref()),
+			makeReplayedLocal(noms, g.Ref(), d, g.NextMutationID(), "func", args, drRef, drChecksum, tx.Ref(), types.Ref{}),
 			types.NewStruct("Commit", types.StructData{
 				"parents": types.NewSet(noms, g.Ref()),
 				"meta": types.NewStruct("Local", types.StructData{
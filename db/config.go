@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/attic-labs/noms/go/datas"
@@ -10,19 +11,71 @@ import (
 )
 
 func initClientID(noms datas.Database) (string, error) {
-	ds := noms.GetDataset("config")
+	cc, err := readConfig(noms)
+	if err != nil {
+		return "", err
+	}
+	if cc.ClientID == "" {
+		cc.ClientID = uuid()
+		if err := writeConfig(noms, cc); err != nil {
+			return "", err
+		}
+	}
+	return cc.ClientID, nil
+}
+
+// ErrIntegerMode is returned when loading a database with another
+// LosslessIntegers setting than it was created with.
+var ErrIntegerMode = errors.New("database was created with another LosslessIntegers setting")
+
+const (
+	integersRounded  = "rounded"
+	integersLossless = "lossless"
+)
+
+// initIntegerMode records in the config how the database stores integers, on
+// the first load that can write it, and returns an error wrapping
+// ErrIntegerMode if it was recorded differently than lossless says.
+func initIntegerMode(noms datas.Database, lossless, readOnly bool) error {
+	cc, err := readConfig(noms)
+	if err != nil {
+		return err
+	}
+	mode := integersRounded
+	if lossless {
+		mode = integersLossless
+	}
+	if cc.Integers == "" {
+		if readOnly {
+			return nil
+		}
+		cc.Integers = mode
+		return writeConfig(noms, cc)
+	}
+	if cc.Integers != mode {
+		return fmt.Errorf("%w: its integers are %s", ErrIntegerMode, cc.Integers)
+	}
+	return nil
+}
+
+// readConfig returns the config stored in noms, or the zero config if there is
+// none.
+func readConfig(noms datas.Database) (ClientConfig, error) {
+	ds := noms.GetDataset(CONFIG_DATASET)
 	var cc ClientConfig
 	if ds.HasHead() {
 		err := marshal.Unmarshal(ds.HeadValue(), &cc)
 		if err != nil {
-			return "", fmt.Errorf("Could not unmarshal config: %s", err.Error())
+			return ClientConfig{}, fmt.Errorf("Could not unmarshal config: %s", err.Error())
 		}
 	}
-	if cc.ClientID == "" {
-		cc.ClientID = uuid()
-		noms.CommitValue(ds, marshal.MustMarshal(noms, cc))
-	}
-	return cc.ClientID, nil
+	return cc, nil
+}
+
+// writeConfig stores cc as the config.
+func writeConfig(noms datas.Database, cc ClientConfig) error {
+	_, err := noms.CommitValue(noms.GetDataset(CONFIG_DATASET), marshal.MustMarshal(noms, cc))
+	return err
 }
 
 var uuid = func() string {
@@ -33,6 +86,13 @@ var uuid = func() string {
 // or other nodes.
 type ClientConfig struct {
 	ClientID string
+	// FormatVersion is the version of the on-disk format. Databases from before
+	// it was recorded have no version, which means version 1. See migrations.
+	FormatVersion uint64 `noms:",omitempty"`
+	// Integers is how values store integers, "rounded" or "lossless", which
+	// is decided by Options.LosslessIntegers when the database is created.
+	// Databases from before it was recorded have none.
+	Integers string       `noms:",omitempty"`
 	Original types.Struct `noms:",original"`
 }
 
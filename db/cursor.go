@@ -0,0 +1,116 @@
+package db
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// ScanCursor iterates the entries matched by a ScanOptions in batches. A cursor
+// reads from the data of its transaction as of when it was opened, so later
+// writes in the transaction do not affect it. A cursor becomes unusable when its
+// transaction is closed.
+type ScanCursor struct {
+	tx       *Transaction
+	data     types.Map
+	edits    *edits
+	opts     ScanOptions
+	filter   scanFilter
+	last     string
+	started  bool
+	returned int
+	done     bool
+}
+
+// OpenScan returns a cursor over the entries matched by opts. If continuation
+// is non-empty it must be a token returned by ScanCursor.Continuation for the
+// same opts and the cursor resumes after the last item returned before it.
+func (tx *Transaction) OpenScan(opts ScanOptions, continuation string) (*ScanCursor, error) {
+	defer tx.rlock()()
+
+	if tx.closed {
+		return nil, ErrClosed
+	}
+	f, err := tx.db.codec.compile(opts.Where)
+	if err != nil {
+		return nil, err
+	}
+	data, ed := tx.scanData(opts)
+	c := &ScanCursor{
+		tx:     tx,
+		data:   data,
+		edits:  ed.clone(),
+		opts:   opts,
+		filter: f,
+	}
+	if continuation != "" {
+		last, err := base64.RawURLEncoding.DecodeString(continuation)
+		if err != nil {
+			return nil, fmt.Errorf("invalid continuation token: %w", err)
+		}
+		c.last = string(last)
+		c.started = true
+	}
+	return c, nil
+}
+
+// Next returns up to n more items. If n is 0, the default scan limit is used.
+// An empty result means the cursor is exhausted.
+func (c *ScanCursor) Next(n int) ([]ScanItem, error) {
+	if c.tx.Closed() {
+		return nil, ErrClosed
+	}
+	if c.done {
+		return []ScanItem{}, nil
+	}
+
+	if n == 0 {
+		n = defaultScanLimit
+	}
+	if c.opts.Limit > 0 && c.opts.Limit-c.returned < n {
+		n = c.opts.Limit - c.returned
+	}
+
+	opts := c.opts
+	opts.Limit = n
+	if c.started {
+		if opts.Reverse {
+			opts.EndBeforeID = c.last
+		} else {
+			start := ScanBound{ID: &ScanID{Value: c.last, Exclusive: true}}
+			if opts.Start != nil {
+				start.Index = opts.Start.Index
+			}
+			opts.Start = &start
+		}
+	}
+
+	items, err := scan(c.data, c.edits, opts, c.filter)
+	if err != nil {
+		return nil, err
+	}
+	c.returned += len(items)
+	if len(items) < n || (c.opts.Limit > 0 && c.returned >= c.opts.Limit) {
+		c.done = true
+	}
+	if len(items) > 0 {
+		c.last = items[len(items)-1].Key
+		c.started = true
+	}
+	return items, nil
+}
+
+// Done returns true if the cursor has returned all of its items.
+func (c *ScanCursor) Done() bool {
+	return c.done
+}
+
+// Continuation returns an opaque token that can be passed to OpenScan, also
+// in a later transaction, to resume after the last item returned so far.
+func (c *ScanCursor) Continuation() string {
+	if !c.started {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(c.last))
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestScanCursor(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	d, err := Load(sp)
+	assert.NoError(err)
+
+	tx := d.NewTransaction()
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(tx.Put(k, []byte(fmt.Sprintf(`"%s"`, k))))
+	}
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	keys := func(items []ScanItem) []string {
+		r := []string{}
+		for _, it := range items {
+			r = append(r, it.Key)
+		}
+		return r
+	}
+
+	tc := []struct {
+		opts     ScanOptions
+		batch    int
+		expected [][]string
+	}{
+		{ScanOptions{}, 2, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{ScanOptions{}, 5, [][]string{{"a", "b", "c", "d", "e"}, {}}},
+		{ScanOptions{Limit: 3}, 2, [][]string{{"a", "b"}, {"c"}}},
+		{ScanOptions{Start: &ScanBound{ID: &ScanID{Value: "b"}}, EndAtID: "d"}, 2, [][]string{{"b", "c"}, {"d"}}},
+		{ScanOptions{Reverse: true}, 2, [][]string{{"e", "d"}, {"c", "b"}, {"a"}}},
+		{ScanOptions{Reverse: true, EndBeforeID: "e", Limit: 3}, 2, [][]string{{"d", "c"}, {"b"}}},
+	}
+
+	for i, c := range tc {
+		msg := fmt.Sprintf("case %d", i)
+		tx := d.NewTransaction()
+		cur, err := tx.OpenScan(c.opts, "")
+		assert.NoError(err, msg)
+		for j, exp := range c.expected {
+			assert.False(cur.Done(), msg)
+			items, err := cur.Next(c.batch)
+			assert.NoError(err, msg)
+			assert.Equal(exp, keys(items), "%s batch %d", msg, j)
+		}
+		assert.True(cur.Done(), msg)
+		assert.NoError(tx.Close())
+	}
+
+	// Cursors read the transaction's data as of when they were opened.
+	tx = d.NewTransaction()
+	cur, err := tx.OpenScan(ScanOptions{}, "")
+	assert.NoError(err)
+	items, err := cur.Next(2)
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, keys(items))
+	assert.NoError(tx.Put("bb", []byte("true")))
+	_, err = tx.Del("c")
+	assert.NoError(err)
+	items, err = cur.Next(2)
+	assert.NoError(err)
+	assert.Equal([]string{"c", "d"}, keys(items))
+
+	// Continuation tokens resume in another transaction.
+	token := cur.Continuation()
+	assert.NoError(tx.Close())
+	_, err = cur.Next(2)
+	assert.Equal(ErrClosed, err)
+
+	tx = d.NewTransaction()
+	cur, err = tx.OpenScan(ScanOptions{}, token)
+	assert.NoError(err)
+	items, err = cur.Next(2)
+	assert.NoError(err)
+	assert.Equal([]string{"e"}, keys(items))
+	assert.True(cur.Done())
+	_, err = tx.OpenScan(ScanOptions{}, "!!!")
+	assert.Regexp("invalid continuation token", err.Error())
+	assert.NoError(tx.Close())
+}
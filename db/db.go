@@ -18,46 +18,147 @@ import (
 
 	"roci.dev/diff-server/kv"
 	jsnoms "roci.dev/diff-server/util/noms/json"
+	rtime "roci.dev/diff-server/util/time"
+)
+
+var (
+	// ErrDBClosed is returned from operations on a DB that has been closed.
+	ErrDBClosed = errors.New("Database is closed")
 )
 
 const (
 	MASTER_DATASET = "master"
+	LOCAL_DATASET  = "local"
+	CONFIG_DATASET = "config"
 )
 
+// Options configure how a DB is loaded.
+type Options struct {
+	// LosslessIntegers preserves integers in values that can't be represented
+	// exactly as float64 instead of rounding them. A database must always be
+	// loaded with the setting it was created with, otherwise loading fails
+	// with ErrIntegerMode. See jsonCodec.
+	LosslessIntegers bool
+	// Now returns the current time, which decides when keys put with a TTL
+	// expire. Defaults to the system clock.
+	Now func() time.Time
+	// Lock is the lock Load takes on the directory of an on-disk database.
+	// Close releases it.
+	Lock LockMode
+	// ReloadInterval, if non-zero, makes Load poll an on-disk database at this
+	// interval and reload the DB when another process has committed to it.
+	// See SetReloadListener.
+	ReloadInterval time.Duration
+	// EncryptionKey, if set, encrypts every chunk of the database at rest. It
+	// must be EncryptionKeySize bytes, and the same key must be passed every time
+	// the database is loaded. See RotateKey.
+	EncryptionKey []byte
+	// SeedFile is the path of a snapshot export, written by Export, that a new
+	// database starts from instead of being empty. The first pull then only
+	// fetches the changes since the snapshot. It is ignored for existing
+	// databases.
+	SeedFile string
+	// Quota, if positive, is the size in bytes that an on-disk database may
+	// grow to. Commits that would exceed it fail with a QuotaError.
+	Quota int64
+}
+
 type DB struct {
 	noms      datas.Database
+	codec     jsonCodec
 	clientID  string
 	pusher    pusher
 	puller    puller
 	sessionID int64
 	numSyncs  uint32
+	now       func() time.Time
+	readOnly  bool
+	dirLock   *dirLock
+	key       []byte
+	seedFile  string
+	dir       string // the directory of an on-disk database.
+	quota     int64
 
-	mu   sync.Mutex
-	head Commit
+	stopReload chan struct{} // closed by Close to stop polling for reloads.
+
+	mu             sync.Mutex
+	head           Commit
+	local          localState
+	closed         bool
+	usage          usageCache // the disk usage, for checking the quota.
+	reloadListener func(oldHead, newHead hash.Hash)
+	txs            map[*txState]bool // the open transactions, which Close aborts.
+	ops            sync.WaitGroup    // the in-flight operations, which Close waits for.
 }
 
 func Load(sp spec.Spec) (*DB, error) {
+	return LoadWithOptions(sp, Options{})
+}
+
+// LoadWithOptions is like Load but configures the DB with opts.
+func LoadWithOptions(sp spec.Spec, opts Options) (*DB, error) {
 	if !sp.Path.IsEmpty() {
 		return nil, errors.New("Invalid spec - must not specify a path")
 	}
 
-	var noms datas.Database
-	err := d.Try(func() {
-		noms = sp.GetDatabase()
-	})
+	var dl *dirLock
+	if sp.Protocol == "nbs" {
+		var err error
+		if dl, err = lockDir(sp.DatabaseName, opts.Lock); err != nil {
+			return nil, err
+		}
+	}
+
+	noms, err := openNoms(sp, opts.EncryptionKey)
+	if err != nil {
+		dl.unlock()
+		return nil, err
+	}
+	var r *DB
+	// noms panics on data it can't read, which must not leak the lock.
+	if perr := d.Try(func() { r, err = NewWithOptions(noms, opts) }); perr != nil {
+		err = perr
+		if we, ok := perr.(d.WrappedError); ok {
+			err = we.Cause()
+		}
+	}
 	if err != nil {
-		err = err.(d.WrappedError).Cause()
+		noms.Close()
+		dl.unlock()
 		return nil, err
 	}
-	return New(noms)
+	r.dirLock = dl
+	r.key = opts.EncryptionKey
+	if sp.Protocol == "nbs" {
+		r.dir = sp.DatabaseName
+	}
+	if opts.ReloadInterval > 0 && sp.Protocol == "nbs" {
+		r.startReloader(sp.DatabaseName, opts.ReloadInterval)
+	}
+	return r, nil
 }
 
 func New(noms datas.Database) (*DB, error) {
+	return NewWithOptions(noms, Options{})
+}
+
+// NewWithOptions is like New but configures the DB with opts.
+func NewWithOptions(noms datas.Database, opts Options) (*DB, error) {
+	codec := jsonCodec{losslessInts: opts.LosslessIntegers}
+	now := opts.Now
+	if now == nil {
+		now = rtime.Now
+	}
 	r := DB{
 		noms:      noms,
-		pusher:    &defaultPusher{},
-		puller:    &defaultPuller{},
+		codec:     codec,
+		pusher:    &defaultPusher{codec: codec},
+		puller:    &defaultPuller{codec: codec},
 		sessionID: time.Now().Unix(),
+		now:       now,
+		readOnly:  opts.Lock == LockShared,
+		seedFile:  opts.SeedFile,
+		quota:     opts.Quota,
 	}
 	// Of course nothing could have a handle on r yet, but still good practice.
 	defer r.lock()()
@@ -73,6 +174,18 @@ func New(noms datas.Database) (*DB, error) {
 func (db *DB) initLocked() error {
 	var err error
 
+	if db.readOnly && !db.noms.GetDataset(MASTER_DATASET).HasHead() {
+		return errors.New("Cannot load empty database read-only")
+	}
+
+	if err = db.migrateLocked(); err != nil {
+		return err
+	}
+
+	if err = initIntegerMode(db.noms, db.codec.losslessInts, db.readOnly); err != nil {
+		return err
+	}
+
 	cid := db.clientID
 	if cid == "" {
 		// TODO create obfuscated clientID for data layer here as well.
@@ -86,16 +199,44 @@ func (db *DB) initLocked() error {
 	ds := db.noms.GetDataset(MASTER_DATASET)
 	if !ds.HasHead() {
 		m := kv.NewMap(db.noms)
-		genesis := makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0 /*lastMutationID*/)
+		genesis := makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0 /*lastMutationID*/, types.Ref{})
+		if db.seedFile != "" {
+			if genesis, err = db.readSeed(db.seedFile); err != nil {
+				return err
+			}
+		}
 		genRef := db.noms.WriteValue(genesis.NomsStruct)
 		_, err := db.noms.FastForward(ds, genRef)
 		if err != nil {
 			return err
 		}
-		db.head = genesis
-		return nil
 	}
 
+	if err = db.loadHeadsLocked(!db.readOnly); err != nil {
+		return err
+	}
+	if !db.readOnly {
+		if _, err = db.sweepLocked(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadHeadsLocked reads the head commit and the local keyspace from noms,
+// without writing. If repair is true a commit that stopped before
+// fast-forwarding the master dataset is finished, otherwise its head is only
+// used in memory. The mutex must be held when called.
+func (db *DB) loadHeadsLocked(repair bool) error {
+	local, localHead, err := loadLocal(db.noms)
+	if err != nil {
+		return err
+	}
+
+	ds := db.noms.GetDataset(MASTER_DATASET)
+	if !ds.HasHead() {
+		return errors.New("Cannot load database: it has no head")
+	}
 	headType := types.TypeOf(ds.Head())
 	if !types.IsSubtype(schema, headType) {
 		return fmt.Errorf("Cannot load database. Specified head has non-Replicache data of type: %s", headType.Describe())
@@ -107,13 +248,27 @@ func (db *DB) initLocked() error {
 		return err
 	}
 	db.head = head
-	return nil
+	db.local = local
+	return db.recoverHeadLocked(localHead, repair)
 }
 
 func (db *DB) Noms() types.ValueReadWriter {
 	return db.noms
 }
 
+// FromJSON returns the noms value to store for the JSON data, for example
+// for transaction args.
+func (db *DB) FromJSON(data []byte) (types.Value, error) {
+	return db.codec.fromJSON(data, db.noms)
+}
+
+// ExportJSON converts JSON that embeds stored values encoded by jsnoms, such
+// as marshaled ScanItems, to the JSON of the values as they were put. It
+// returns data unchanged unless the DB uses lossless integers.
+func (db *DB) ExportJSON(data []byte) ([]byte, error) {
+	return db.codec.exportJSON(data)
+}
+
 func (db DB) ClientID() string {
 	return db.clientID
 }
@@ -126,6 +281,10 @@ func (db *DB) Head() Commit {
 // setHead sets the head commit to newHead and fast-forwards the underlying dataset.
 func (db *DB) setHead(newHead Commit) error {
 	defer db.lock()()
+	return db.setHeadLocked(newHead)
+}
+
+func (db *DB) setHeadLocked(newHead Commit) error {
 	_, err := db.noms.FastForward(db.noms.GetDataset(MASTER_DATASET), newHead.Ref())
 	if err != nil {
 		return err
@@ -134,14 +293,137 @@ func (db *DB) setHead(newHead Commit) error {
 	return nil
 }
 
+// commit sets the head commit to newHead, if non-nil, and the local keyspace to
+// newLocal, if non-nil. localBasis is the local data newLocal was derived from:
+// if the local keyspace has changed since, nothing is written and
+// datas.ErrOptimisticLockFailed is returned.
+//
+// The local keyspace is written together with the new head, in a single
+// commit of the local dataset, so either both change or neither does. Once
+// that succeeded the master dataset is fast-forwarded to the new head; if
+// that doesn't happen, loading the DB finishes it (see recoverHeadLocked).
+func (db *DB) commit(newHead *Commit, localBasis types.Map, newLocal *localState) error {
+	defer db.lock()()
+	// Check that newHead follows the head before writing anything, as the
+	// local keyspace is written first.
+	if newHead != nil && newHead.BasisRef().TargetHash() != db.head.NomsStruct.Hash() {
+		return datas.ErrMergeNeeded
+	}
+	if newLocal == nil {
+		if newHead == nil {
+			return nil
+		}
+		return db.setHeadLocked(*newHead)
+	}
+	if !db.local.data.NomsMap().Equals(localBasis) {
+		return datas.ErrOptimisticLockFailed
+	}
+	head := db.head
+	if newHead != nil {
+		head = *newHead
+	}
+	if err := db.writeLocalLocked(*newLocal, head); err != nil {
+		return err
+	}
+	if newHead == nil {
+		return nil
+	}
+	return db.setHeadLocked(head)
+}
+
 func (db *DB) HeadHash() hash.Hash {
 	return db.Head().NomsStruct.Hash()
 }
 
+// Reload reads the head and the local keyspace again, to see the commits of
+// other processes. It doesn't write, so it is safe while another process
+// writes: expired entries are not swept and the database is not migrated.
 func (db *DB) Reload() error {
 	defer db.lock()()
+	if db.closed {
+		return ErrDBClosed
+	}
 	db.noms.Rebase()
-	return db.initLocked()
+	plan, _, err := planMigrations(db.noms)
+	if err != nil {
+		return err
+	}
+	if len(plan.Steps) > 0 {
+		return fmt.Errorf("Cannot reload database: it needs to be migrated from format version %d to %d", plan.From, plan.To)
+	}
+	return db.loadHeadsLocked(false)
+}
+
+// Close aborts the open transactions, waits for in-flight syncs and commits,
+// and then closes the underlying noms database. Later operations on the DB and
+// its transactions fail. Closing a closed DB is a no-op.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	txs := db.txs
+	db.txs = nil
+	if db.stopReload != nil {
+		close(db.stopReload)
+	}
+	db.mu.Unlock()
+
+	for tx := range txs {
+		tx.abort()
+	}
+	db.ops.Wait()
+	err := db.noms.Close()
+	if uerr := db.dirLock.unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// Drop deletes the synced data and the local keyspace of the database along
+// with their history, and closes the DB. The next load starts from an empty
+// database.
+func (db *DB) Drop() error {
+	done, err := db.beginOp()
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer done()
+		if db.readOnly {
+			return ErrReadOnly
+		}
+		defer db.lock()()
+		for _, ds := range []string{MASTER_DATASET, LOCAL_DATASET} {
+			if _, err := db.noms.Delete(db.noms.GetDataset(ds)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// beginOp registers an in-flight operation that Close waits for, and returns
+// the func that ends it. It returns ErrDBClosed if the DB is closed.
+func (db *DB) beginOp() (func(), error) {
+	defer db.lock()()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	db.ops.Add(1)
+	return db.ops.Done, nil
+}
+
+// forget unregisters the transaction tx when it is closed or committed.
+func (db *DB) forget(tx *txState) {
+	defer db.lock()()
+	delete(db.txs, tx)
 }
 
 // TODO: add date and random source to this so that sync can set it up correctly when replaying.
@@ -212,19 +494,37 @@ func (db *DB) NewTransaction() *Transaction {
 // The name and the arguments are used when replaying transactions. Basis and
 // original should be non-nil for replay transactions.
 func (db *DB) NewTransactionWithArgs(name string, args types.Value, basis *Commit, original *Commit) *Transaction {
-	head := db.Head()
+	db.mu.Lock()
+	head, local := db.head, db.local
+	db.mu.Unlock()
 	if basis != nil {
 		head = *basis
 	}
 
-	return &Transaction{
+	synced := newKeyspace(head.Data(db.noms), false)
+	ts := &txState{
 		db:       db,
 		basis:    head,
-		me:       head.Data(db.noms).Edit(),
 		name:     name,
 		args:     args,
 		original: original,
+		synced:   synced,
+		local:    newLocalKeyspace(local, db.now()),
 	}
+
+	// A transaction on a closed DB starts out closed.
+	db.mu.Lock()
+	if db.closed {
+		ts.closed = true
+	} else {
+		if db.txs == nil {
+			db.txs = map[*txState]bool{}
+		}
+		db.txs[ts] = true
+	}
+	db.mu.Unlock()
+
+	return &Transaction{txState: ts, keyspace: synced}
 }
 
 func (db *DB) lock() func() {
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
 	"github.com/attic-labs/noms/go/util/datetime"
 	"github.com/stretchr/testify/assert"
 	"roci.dev/diff-server/kv"
@@ -48,7 +49,7 @@ func TestGenesis(t *testing.T) {
 	assert.Nil(v)
 	assert.NoError(err)
 	m := kv.NewMap(db.noms)
-	assert.True(db.Head().NomsStruct.Equals(makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0).NomsStruct))
+	assert.True(db.Head().NomsStruct.Equals(makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0, types.Ref{}).NomsStruct))
 
 	cid := db.clientID
 	assert.NotEqual("", cid)
@@ -135,3 +136,69 @@ func TestConflictingCommits(t *testing.T) {
 	assert.True(errors.As(err, &commitErrror))
 	assert.True(ref2.IsZeroValue())
 }
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("a", []byte("1")))
+	committed := db.NewTransaction()
+	assert.NoError(committed.Put("b", []byte("2")))
+	_, err := committed.Commit(log.Default())
+	assert.NoError(err)
+	assert.Equal(1, len(db.txs))
+
+	assert.NoError(db.Close())
+	assert.True(tx.Closed())
+	_, err = tx.Get("a")
+	assert.Equal(ErrClosed, err)
+	_, err = tx.Commit(log.Default())
+	assert.Equal(ErrClosed, err)
+
+	tx = db.NewTransaction()
+	assert.True(tx.Closed())
+	assert.Equal(ErrClosed, tx.Put("c", []byte("3")))
+
+	_, _, err = db.BeginSync("", "", "", "", log.Default())
+	assert.Equal(ErrDBClosed, err)
+	_, _, err = db.MaybeEndSync(db.HeadHash(), "")
+	assert.Equal(ErrDBClosed, err)
+	assert.Equal(ErrDBClosed, db.Reload())
+	assert.NoError(db.Close())
+
+	// The uncommitted write was dropped.
+	db = reloadDB(assert, dir)
+	tx = db.NewTransaction()
+	defer tx.Close()
+	has, err := tx.Has("a")
+	assert.NoError(err)
+	assert.False(has)
+	has, err = tx.Has("b")
+	assert.NoError(err)
+	assert.True(has)
+}
+
+func TestDrop(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("a", []byte("1")))
+	assert.NoError(tx.Local().Put("b", []byte("2")))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+
+	assert.NoError(db.Drop())
+	assert.Equal(ErrDBClosed, db.Drop())
+
+	db = reloadDB(assert, dir)
+	assert.Equal(0, len(db.Head().Parents))
+	tx = db.NewTransaction()
+	defer tx.Close()
+	has, err := tx.Has("a")
+	assert.NoError(err)
+	assert.False(has)
+	has, err = tx.Local().Has("b")
+	assert.NoError(err)
+	assert.False(has)
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+)
+
+// DiffOp describes the kind of change made to a key.
+type DiffOp string
+
+const (
+	DiffOpAdd    DiffOp = "add"
+	DiffOpChange DiffOp = "change"
+	DiffOpRemove DiffOp = "remove"
+)
+
+type DiffOptions struct {
+	// Prefix restricts the diff to keys starting with Prefix.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// DiffChange is a key-level change between two commits. OldValue is
+// omitted for adds and NewValue is omitted for removes. Blob values are
+// described by OldBlob and NewBlob instead.
+type DiffChange struct {
+	Op       DiffOp          `json:"op"`
+	Key      string          `json:"key"`
+	OldValue json.RawMessage `json:"oldValue,omitempty"`
+	NewValue json.RawMessage `json:"newValue,omitempty"`
+	OldBlob  *BlobInfo       `json:"oldBlob,omitempty"`
+	NewBlob  *BlobInfo       `json:"newBlob,omitempty"`
+}
+
+// Diff returns the changes to the data between the commits with hashes from
+// and to, in key order.
+func (db *DB) Diff(from, to hash.Hash, opts DiffOptions) ([]DiffChange, error) {
+	done, err := db.beginOp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	fromCommit, err := ReadCommit(db.noms, from)
+	if err != nil {
+		return nil, err
+	}
+	toCommit, err := ReadCommit(db.noms, to)
+	if err != nil {
+		return nil, err
+	}
+	return db.codec.diffMaps(fromCommit.Data(db.noms).NomsMap(), toCommit.Data(db.noms).NomsMap(), opts)
+}
+
+func (c jsonCodec) diffMaps(from, to types.Map, opts DiffOptions) ([]DiffChange, error) {
+	res := []DiffChange{}
+	for _, ch := range mapChanges(from, to) {
+		key := string(ch.Key.(types.String))
+		if !strings.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+		dc := DiffChange{Key: key}
+		switch ch.ChangeType {
+		case types.DiffChangeAdded:
+			dc.Op = DiffOpAdd
+		case types.DiffChangeModified:
+			dc.Op = DiffOpChange
+		case types.DiffChangeRemoved:
+			dc.Op = DiffOpRemove
+		}
+		var err error
+		if dc.OldValue, dc.OldBlob, err = c.encodeValue(ch.OldValue); err != nil {
+			return nil, err
+		}
+		if dc.NewValue, dc.NewBlob, err = c.encodeValue(ch.NewValue); err != nil {
+			return nil, err
+		}
+		res = append(res, dc)
+	}
+	return res, nil
+}
+
+// mapChanges returns the changes between the maps from and to in key order.
+func mapChanges(from, to types.Map) []types.ValueChanged {
+	var res []types.ValueChanged
+	if from.Equals(to) {
+		return res
+	}
+	changes := make(chan types.ValueChanged)
+	go func() {
+		defer close(changes)
+		to.Diff(from, changes, nil)
+	}()
+	for c := range changes {
+		res = append(res, c)
+	}
+	return res
+}
+
+// encodeValue returns the JSON encoding of v, or the BlobInfo if v is a blob.
+// Both are nil if v is nil.
+func (c jsonCodec) encodeValue(v types.Value) (json.RawMessage, *BlobInfo, error) {
+	if v == nil {
+		return nil, nil, nil
+	}
+	if b, ok := blobInfo(v); ok {
+		return nil, b, nil
+	}
+	js, err := c.toJSON(v)
+	return js, nil, err
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	d, err := Load(sp)
+	assert.NoError(err)
+
+	commit := func(puts map[string]string, dels ...string) hash.Hash {
+		tx := d.NewTransaction()
+		for k, v := range puts {
+			assert.NoError(tx.Put(k, []byte(v)))
+		}
+		for _, k := range dels {
+			_, err := tx.Del(k)
+			assert.NoError(err)
+		}
+		ref, err := tx.Commit(log.Default())
+		assert.NoError(err)
+		return ref.TargetHash()
+	}
+
+	h0 := d.HeadHash()
+	h1 := commit(map[string]string{"a/1": `"one"`, "a/2": `"two"`, "b/1": `true`})
+	h2 := commit(map[string]string{"a/1": `"uno"`, "b/2": `{"x":1}`}, "a/2")
+
+	tc := []struct {
+		from, to hash.Hash
+		opts     DiffOptions
+		expected []DiffChange
+	}{
+		{h0, h0, DiffOptions{}, []DiffChange{}},
+		{h0, h1, DiffOptions{}, []DiffChange{
+			{Op: DiffOpAdd, Key: "a/1", NewValue: []byte(`"one"`)},
+			{Op: DiffOpAdd, Key: "a/2", NewValue: []byte(`"two"`)},
+			{Op: DiffOpAdd, Key: "b/1", NewValue: []byte(`true`)},
+		}},
+		{h1, h2, DiffOptions{}, []DiffChange{
+			{Op: DiffOpChange, Key: "a/1", OldValue: []byte(`"one"`), NewValue: []byte(`"uno"`)},
+			{Op: DiffOpRemove, Key: "a/2", OldValue: []byte(`"two"`)},
+			{Op: DiffOpAdd, Key: "b/2", NewValue: []byte(`{"x":1}`)},
+		}},
+		{h1, h2, DiffOptions{Prefix: "b/"}, []DiffChange{
+			{Op: DiffOpAdd, Key: "b/2", NewValue: []byte(`{"x":1}`)},
+		}},
+		{h2, h1, DiffOptions{Prefix: "a/2"}, []DiffChange{
+			{Op: DiffOpAdd, Key: "a/2", NewValue: []byte(`"two"`)},
+		}},
+	}
+
+	for i, c := range tc {
+		act, err := d.Diff(c.from, c.to, c.opts)
+		assert.NoError(err, "case %d", i)
+		assert.Equal(len(c.expected), len(act), "case %d", i)
+		for j := range c.expected {
+			if j >= len(act) {
+				break
+			}
+			assert.Equal(c.expected[j].Op, act[j].Op, "case %d.%d", i, j)
+			assert.Equal(c.expected[j].Key, act[j].Key, "case %d.%d", i, j)
+			assert.Equal(string(c.expected[j].OldValue), string(act[j].OldValue), "case %d.%d", i, j)
+			assert.Equal(string(c.expected[j].NewValue), string(act[j].NewValue), "case %d.%d", i, j)
+		}
+	}
+
+	_, err = d.Diff(h0, hash.Of([]byte("nope")), DiffOptions{})
+	assert.Regexp("not found", err.Error())
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LockMode is the kind of advisory lock a DB takes on its directory, so that
+// several processes can't modify an on-disk database at the same time.
+type LockMode int
+
+const (
+	// LockNone takes no lock.
+	LockNone LockMode = iota
+	// LockExclusive makes the DB the only writer: it excludes the other
+	// processes that lock the directory with LockExclusive, but not readers
+	// that use LockShared.
+	LockExclusive
+	// LockShared only excludes operations that replace the whole directory,
+	// such as RotateKey. A DB loaded with a shared lock is read-only, and sees
+	// the commits of the writer when it reloads.
+	LockShared
+	// lockAll excludes every other process that locks the directory.
+	lockAll
+)
+
+const (
+	// lockFileName is the name of the lock file in the database directory,
+	// which everyone that locks the directory locks, shared unless they use
+	// lockAll. noms uses LOCK for its own purposes.
+	lockFileName = "replicache.lock"
+	// writerLockFileName is the name of the lock file that writers lock
+	// exclusively.
+	writerLockFileName = "replicache.writer.lock"
+)
+
+var (
+	// ErrDatabaseInUse is returned when loading a database whose directory is
+	// locked by another process.
+	ErrDatabaseInUse = errors.New("database in use")
+	// ErrReadOnly is returned from writes to a DB loaded with LockShared.
+	ErrReadOnly = errors.New("Database is read-only")
+)
+
+// dirLock is an advisory lock held on a database directory.
+type dirLock struct {
+	files []*os.File
+}
+
+// lockDir takes a lock on the database directory dir, creating it if needed,
+// and recovers from a RotateKey of dir that stopped part way while holding it.
+// With LockNone the lock is only held while recovering, and nil is returned.
+// It returns an error wrapping ErrDatabaseInUse if the directory is locked
+// incompatibly.
+func lockDir(dir string, mode LockMode) (*dirLock, error) {
+	l := &dirLock{}
+	_, err := os.Stat(dir)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// A rotation that stopped before its copy replaced dir leaves no dir, and
+	// recovering moves the original back, so dir is only created after.
+	if exists {
+		if err := l.lock(dir, mode); err != nil {
+			return nil, err
+		}
+	}
+	if err := recoverRotateKey(dir); err != nil {
+		l.unlock()
+		return nil, err
+	}
+	if !exists {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := l.lock(dir, mode); err != nil {
+			return nil, err
+		}
+	}
+	if mode == LockNone {
+		return nil, l.unlock()
+	}
+	return l, nil
+}
+
+// lock locks the files of dir for mode. LockNone takes the shared lock, which
+// only excludes operations that replace the whole directory.
+func (l *dirLock) lock(dir string, mode LockMode) error {
+	if err := l.lockFile(dir, lockFileName, mode != lockAll); err != nil {
+		return err
+	}
+	if mode == LockExclusive || mode == lockAll {
+		if err := l.lockFile(dir, writerLockFileName, false); err != nil {
+			l.unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// lockFile locks the file name in dir and adds it to l.
+func (l *dirLock) lockFile(dir, name string, shared bool) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := flock(f, shared); err != nil {
+		f.Close()
+		if err == errWouldBlock {
+			return fmt.Errorf("%w: %s", ErrDatabaseInUse, dir)
+		}
+		return fmt.Errorf("could not lock %s: %w", dir, err)
+	}
+	l.files = append(l.files, f)
+	return nil
+}
+
+// unlock releases the lock. It is a no-op on a nil dirLock.
+func (l *dirLock) unlock() error {
+	if l == nil {
+		return nil
+	}
+	var err error
+	for i := len(l.files) - 1; i >= 0; i-- {
+		if cerr := l.files[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	l.files = nil
+	return err
+}
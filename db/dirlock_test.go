@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestLock(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	load := func(mode LockMode) (*DB, error) {
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+		return LoadWithOptions(sp, Options{Lock: mode})
+	}
+
+	_, err = load(LockShared)
+	assert.EqualError(err, "Cannot load empty database read-only")
+
+	db1, err := load(LockExclusive)
+	assert.NoError(err)
+	tx := db1.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	// There is one writer at a time, but readers can load the database while
+	// it is written, and see its commits when they reload.
+	_, err = load(LockExclusive)
+	assert.True(errors.Is(err, ErrDatabaseInUse), "%v", err)
+	reader, err := load(LockShared)
+	assert.NoError(err)
+	tx = db1.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"baz"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NoError(reader.Reload())
+	assert.Equal(db1.HeadHash(), reader.HeadHash())
+	unlocked, err := load(LockNone)
+	assert.NoError(err)
+	assert.NoError(unlocked.Close())
+	assert.NoError(db1.Close())
+
+	// Nor do readers exclude the writer, only operations that replace the
+	// directory.
+	db1, err = load(LockExclusive)
+	assert.NoError(err)
+	assert.NoError(db1.Close())
+	assert.True(errors.Is(RotateKey(dir, nil, nil), ErrDatabaseInUse))
+	assert.NoError(reader.Close())
+
+	db1, err = load(LockShared)
+	assert.NoError(err)
+	db2, err := load(LockShared)
+	assert.NoError(err)
+
+	tx = db2.NewTransaction()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"baz"`, string(v))
+	assert.NoError(tx.Put("foo", []byte(`"qux"`)))
+	_, err = tx.Commit(log.Default())
+	assert.Equal(ErrReadOnly, err)
+	tx = db2.NewTransaction()
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	_, _, err = db2.BeginSync("", "", "", "", log.Default())
+	assert.Equal(ErrReadOnly, err)
+
+	assert.NoError(db1.Close())
+	assert.NoError(db2.Close())
+	db1, err = load(LockExclusive)
+	assert.NoError(err)
+	assert.NoError(db1.Close())
+}
@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+// errWouldBlock is ERROR_LOCK_VIOLATION, which LockFileEx fails with when the
+// range is locked and it was asked not to wait.
+var errWouldBlock error = syscall.Errno(33)
+
+// flock takes a non-blocking LockFileEx lock on the first byte of f, the
+// equivalent of a flock. Closing f releases it.
+func flock(f *os.File, shared bool) error {
+	flags := uint32(lockfileFailImmediately)
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -30,15 +30,6 @@ func (ed editor) Get(id string) (types.Value, error) {
 	return vv.Value(), nil
 }
 
-func (ed editor) Scan(opts ScanOptions) (r []ScanItem, err error) {
-	// Blech, this sucks. We need to build the map because Noms MapEditor doesn't support scans.
-	// Implementing them is more effort than I have avaiable right now.
-	m := ed.data.Map()
-	r, err = scan(m, opts)
-	ed.data = m.Edit()
-	return
-}
-
 // This interface has to be in terms of values because pull is going to call it with values.
 func (ed *editor) Put(id string, v types.Value) error {
 	ed.receivedMutAttempt = true
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/attic-labs/noms/go/chunks"
+	"github.com/attic-labs/noms/go/d"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+)
+
+// EncryptionKeySize is the size of the keys that encrypt databases at rest.
+const EncryptionKeySize = 32
+
+// ErrWrongKey is returned when loading a database with a key that doesn't
+// decrypt it.
+var ErrWrongKey = errors.New("wrong encryption key or database is not encrypted")
+
+// encryptingStore is a ChunkStore that encrypts the data of every chunk it
+// stores with AES-256-GCM. Chunks keep the address of their plaintext, which is
+// also authenticated, so a chunk can't be swapped for another one.
+type encryptingStore struct {
+	chunks.ChunkStore
+	aead cipher.AEAD
+}
+
+// newEncryptingStore returns cs wrapped to encrypt with key. It returns
+// ErrWrongKey if cs has data that key doesn't decrypt.
+func newEncryptingStore(cs chunks.ChunkStore, key []byte) (*encryptingStore, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &encryptingStore{cs, aead}
+	if root := cs.Root(); !root.IsEmpty() {
+		if c := cs.Get(root); !c.IsEmpty() {
+			if _, err := s.open(c); err != nil {
+				return nil, ErrWrongKey
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *encryptingStore) seal(c chunks.Chunk) chunks.Chunk {
+	h := c.Hash()
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	d.PanicIfError(err)
+	return chunks.NewChunkWithHash(h, s.aead.Seal(nonce, nonce, c.Data(), h[:]))
+}
+
+func (s *encryptingStore) open(c chunks.Chunk) (chunks.Chunk, error) {
+	h := c.Hash()
+	data := c.Data()
+	ns := s.aead.NonceSize()
+	if len(data) < ns {
+		return chunks.EmptyChunk, fmt.Errorf("chunk %s is too short to be encrypted", h)
+	}
+	plain, err := s.aead.Open(nil, data[:ns], data[ns:], h[:])
+	if err != nil {
+		return chunks.EmptyChunk, fmt.Errorf("could not decrypt chunk %s: %w", h, err)
+	}
+	return chunks.NewChunkWithHash(h, plain), nil
+}
+
+// mustOpen decrypts c. Chunks that don't decrypt have been tampered with, as the
+// key was checked when the store was created.
+func (s *encryptingStore) mustOpen(c chunks.Chunk) chunks.Chunk {
+	if c.IsEmpty() {
+		return c
+	}
+	p, err := s.open(c)
+	d.PanicIfError(err)
+	return p
+}
+
+func (s *encryptingStore) Get(h hash.Hash) chunks.Chunk {
+	return s.mustOpen(s.ChunkStore.Get(h))
+}
+
+func (s *encryptingStore) GetMany(hashes hash.HashSet, foundChunks chan *chunks.Chunk) {
+	found := make(chan *chunks.Chunk)
+	go func() {
+		defer close(found)
+		s.ChunkStore.GetMany(hashes, found)
+	}()
+	for c := range found {
+		p := s.mustOpen(*c)
+		foundChunks <- &p
+	}
+}
+
+func (s *encryptingStore) Put(c chunks.Chunk) {
+	s.ChunkStore.Put(s.seal(c))
+}
+
+// openNoms opens the noms database sp, encrypted with key if it is non-nil.
+func openNoms(sp spec.Spec, key []byte) (noms datas.Database, err error) {
+	if key == nil {
+		err = d.Try(func() {
+			noms = sp.GetDatabase()
+		})
+		if err == nil && !readable(noms) {
+			noms.Close()
+			return nil, ErrWrongKey
+		}
+	} else {
+		var kerr error
+		err = d.Try(func() {
+			cs := sp.NewChunkStore()
+			ecs, err := newEncryptingStore(cs, key)
+			if err != nil {
+				cs.Close()
+				kerr = err
+				return
+			}
+			noms = datas.NewDatabase(ecs)
+		})
+		if err == nil {
+			err = kerr
+		}
+	}
+	if err != nil {
+		if we, ok := err.(d.WrappedError); ok {
+			err = we.Cause()
+		}
+		return nil, err
+	}
+	return noms, nil
+}
+
+// readable returns false if the root of noms can't be decoded, which is the
+// case for an encrypted database opened without a key.
+func readable(noms datas.Database) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	noms.Datasets().IterAll(func(k, v types.Value) {})
+	return true
+}
+
+// RotateKey re-encrypts the on-disk database in dir, which must not be loaded,
+// from oldKey to newKey. A nil oldKey encrypts a database that isn't encrypted
+// yet and a nil newKey decrypts it. The database is copied to a sibling
+// directory which then replaces dir, so dir is never partially re-encrypted.
+// If the process stops before the copy replaced dir, the next load or rotation
+// restores the database encrypted with oldKey; see recoverRotateKey.
+func RotateKey(dir string, oldKey, newKey []byte) error {
+	dl, err := lockDir(dir, lockAll)
+	if err != nil {
+		return err
+	}
+	defer dl.unlock()
+
+	sp, err := spec.ForDatabase(dir)
+	if err != nil {
+		return err
+	}
+	src, err := openNoms(sp, oldKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := dir + ".rekey"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	tsp, err := spec.ForDatabase(tmp)
+	if err != nil {
+		return err
+	}
+	sink, err := openNoms(tsp, newKey)
+	if err != nil {
+		return err
+	}
+	err = copyDatasets(src, sink)
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	old := dir + ".old"
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// recoverRotateKey finishes with a RotateKey of dir that stopped part way. The
+// rotation is complete once the copy has replaced dir: if it stopped before,
+// the original database is moved back to dir, otherwise what is left of it is
+// removed.
+func recoverRotateKey(dir string) error {
+	old := dir + ".old"
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// A rotation that is still running holds the lock in old.
+	l := &dirLock{}
+	if err := l.lockFile(old, lockFileName, false); err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.Rename(old, dir); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir + ".rekey")
+}
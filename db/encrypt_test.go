@@ -0,0 +1,137 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestEncryption(t *testing.T) {
+	assert := assert.New(t)
+	keyA := bytes.Repeat([]byte{'a'}, EncryptionKeySize)
+	keyB := bytes.Repeat([]byte{'b'}, EncryptionKeySize)
+
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	load := func(key []byte) (*DB, error) {
+		return LoadWithOptions(sp, Options{EncryptionKey: key})
+	}
+
+	_, err = load([]byte("short"))
+	assert.Regexp("encryption key must be 32 bytes", err.Error())
+
+	db, err := load(keyA)
+	assert.NoError(err)
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("secret", []byte(`"supersecretvalue"`)))
+	assert.NoError(tx.Local().Put("draft", []byte(`"supersecretdraft"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	head, cid := db.HeadHash(), db.ClientID()
+	assert.NoError(db.Close())
+
+	// Neither keys nor values, including the local keyspace, are stored in the
+	// clear.
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		assert.NoError(err)
+		assert.False(bytes.Contains(b, []byte("supersecret")), path)
+		assert.False(bytes.Contains(b, []byte(cid)), path)
+		return nil
+	})
+	assert.NoError(err)
+
+	_, err = load(keyB)
+	assert.Equal(ErrWrongKey, err)
+
+	// Loading without a key fails too, and leaves the directory unlocked.
+	_, err = LoadWithOptions(sp, Options{Lock: LockExclusive})
+	assert.Equal(ErrWrongKey, err)
+	db, err = LoadWithOptions(sp, Options{Lock: LockExclusive, EncryptionKey: keyA})
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	assert.NoError(RotateKey(dir, keyA, keyB))
+	_, err = load(keyA)
+	assert.Equal(ErrWrongKey, err)
+	db, err = load(keyB)
+	assert.NoError(err)
+	assert.Equal(head, db.HeadHash())
+	assert.Equal(cid, db.ClientID())
+	tx = db.NewTransaction()
+	v, err := tx.Get("secret")
+	assert.NoError(err)
+	assert.Equal(`"supersecretvalue"`, string(v))
+	v, err = tx.Local().Get("draft")
+	assert.NoError(err)
+	assert.Equal(`"supersecretdraft"`, string(v))
+	tx.Close()
+	assert.NoError(db.Close())
+
+	// Decrypting and encrypting again.
+	assert.NoError(RotateKey(dir, keyB, nil))
+	db = reloadDB(assert, dir)
+	assert.Equal(head, db.HeadHash())
+	assert.NoError(db.Close())
+	_, err = load(keyA)
+	assert.Equal(ErrWrongKey, err)
+	assert.NoError(RotateKey(dir, nil, keyA))
+	db, err = load(keyA)
+	assert.NoError(err)
+	assert.Equal(head, db.HeadHash())
+	assert.NoError(db.Close())
+}
+
+func TestRotateKeyRecovery(t *testing.T) {
+	assert := assert.New(t)
+	keyA := bytes.Repeat([]byte{'a'}, EncryptionKeySize)
+	keyB := bytes.Repeat([]byte{'b'}, EncryptionKeySize)
+
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	db, err := LoadWithOptions(sp, Options{EncryptionKey: keyA})
+	assert.NoError(err)
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	head := db.HeadHash()
+	assert.NoError(db.Close())
+
+	// A rotation that stopped before the copy replaced dir is undone.
+	assert.NoError(os.Rename(dir, dir+".old"))
+	assert.NoError(os.MkdirAll(dir+".rekey", 0755))
+	for _, lock := range []LockMode{LockNone, LockExclusive} {
+		db, err = LoadWithOptions(sp, Options{EncryptionKey: keyA, Lock: lock})
+		assert.NoError(err)
+		assert.Equal(head, db.HeadHash())
+		assert.NoError(db.Close())
+		assert.NoError(os.Rename(dir, dir+".old"))
+	}
+	assert.NoError(RotateKey(dir, keyA, keyB))
+
+	// What a complete rotation left behind is removed.
+	assert.NoError(os.MkdirAll(dir+".old", 0755))
+	db, err = LoadWithOptions(sp, Options{EncryptionKey: keyB})
+	assert.NoError(err)
+	assert.Equal(head, db.HeadHash())
+	assert.NoError(db.Close())
+	for _, p := range []string{dir + ".old", dir + ".rekey"} {
+		_, err = os.Stat(p)
+		assert.True(os.IsNotExist(err), p)
+	}
+}
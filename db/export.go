@@ -0,0 +1,373 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/attic-labs/noms/go/util/datetime"
+
+	"roci.dev/diff-server/kv"
+)
+
+// exportVersion is the version of the export format written by Export.
+const exportVersion = 1
+
+// ErrNotEmpty is returned when importing into a database that has data.
+var ErrNotEmpty = errors.New("can only import into an empty database")
+
+// ExportOptions configure Export.
+type ExportOptions struct {
+	// Commit is the hash of the commit to export. Defaults to the head.
+	Commit hash.Hash
+	// Pending also exports the local mutations between the last snapshot and
+	// Commit. Without it only the snapshot is exported.
+	Pending bool
+}
+
+// ImportOptions configure Import.
+type ImportOptions struct {
+	// AdoptClientID makes the DB take over the client ID of the exported
+	// database, along with its last mutation ID, so that it syncs as the
+	// exported client. The two must then not both sync. By default the DB keeps
+	// its own client ID, of which the server hasn't seen any mutation yet, so
+	// the snapshot's last mutation ID is reset to 0 and the pending mutations
+	// are renumbered after it.
+	AdoptClientID bool
+}
+
+// ExportHeader is the first line of an export. It describes the snapshot whose
+// entries follow.
+type ExportHeader struct {
+	Version        int                        `json:"version"`
+	ClientID       string                     `json:"clientID"`
+	ServerStateID  string                     `json:"serverStateID"`
+	LastMutationID uint64                     `json:"lastMutationID"`
+	Checksum       string                     `json:"checksum"`
+	Indexes        map[string]IndexDefinition `json:"indexes,omitempty"`
+	// ServerChecksum is the checksum of the data as the server stores it, if
+	// it differs from Checksum. See Snapshot.ServerChecksum.
+	ServerChecksum string `json:"serverChecksum,omitempty"`
+}
+
+// exportEntry is an entry of the data, or a change to it in a mutation. Blob
+// values are base64 encoded in Blob instead of Value.
+type exportEntry struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Blob    *[]byte         `json:"blob,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// exportMutation is a pending local mutation, with the changes it made to the
+// data and the indexes after it.
+type exportMutation struct {
+	ID       uint64                     `json:"id"`
+	Name     string                     `json:"name"`
+	Args     json.RawMessage            `json:"args"`
+	Date     time.Time                  `json:"date"`
+	Changes  []exportEntry              `json:"changes"`
+	Checksum string                     `json:"checksum"`
+	Indexes  map[string]IndexDefinition `json:"indexes,omitempty"`
+}
+
+// exportLine is a line of an export. Exactly one field is set: the header on
+// the first line, then an entry per key of the snapshot, then the mutations in
+// order.
+type exportLine struct {
+	Header   *ExportHeader   `json:"header,omitempty"`
+	Entry    *exportEntry    `json:"entry,omitempty"`
+	Mutation *exportMutation `json:"mutation,omitempty"`
+}
+
+// Export writes the commit chosen by opts to w as JSON Lines: a header with the
+// client ID and sync state of the last snapshot, the snapshot's entries in key
+// order and, with opts.Pending, the local mutations since. The local keyspace
+// isn't exported. See Import.
+func (db *DB) Export(w io.Writer, opts ExportOptions) error {
+	done, err := db.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	c := db.Head()
+	if !opts.Commit.IsEmpty() {
+		if c, err = ReadCommit(db.noms, opts.Commit); err != nil {
+			return err
+		}
+	}
+	pending, err := pendingCommits(db.noms, c)
+	if err != nil {
+		return err
+	}
+	snapshot := c
+	if len(pending) > 0 {
+		if snapshot, err = pending[0].Basis(db.noms); err != nil {
+			return err
+		}
+	}
+	defs, err := indexDefinitions(db.noms, snapshot)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(exportLine{Header: &ExportHeader{
+		Version:        exportVersion,
+		ClientID:       db.ClientID(),
+		ServerStateID:  snapshot.Meta.Snapshot.ServerStateID,
+		LastMutationID: snapshot.MutationID(),
+		Checksum:       string(snapshot.Value.Checksum),
+		ServerChecksum: snapshot.Meta.Snapshot.ServerChecksum,
+		Indexes:        defs,
+	}})
+	if err != nil {
+		return err
+	}
+	snapshot.Data(db.noms).NomsMap().IterAll(func(k, v types.Value) {
+		if err != nil {
+			return
+		}
+		var e exportEntry
+		if e, err = db.exportEntry(k, v); err == nil {
+			err = enc.Encode(exportLine{Entry: &e})
+		}
+	})
+	if err != nil || !opts.Pending {
+		return err
+	}
+
+	prev := snapshot
+	for _, p := range pending {
+		m := exportMutation{
+			ID:       p.MutationID(),
+			Name:     p.Meta.Local.Name,
+			Date:     p.Meta.Local.Date.Time,
+			Changes:  []exportEntry{},
+			Checksum: string(p.Value.Checksum),
+		}
+		if m.Args, err = db.codec.toJSON(p.Meta.Local.Args); err != nil {
+			return err
+		}
+		for _, ch := range mapChanges(prev.Data(db.noms).NomsMap(), p.Data(db.noms).NomsMap()) {
+			e, err := db.exportEntry(ch.Key, ch.NewValue)
+			if err != nil {
+				return err
+			}
+			m.Changes = append(m.Changes, e)
+		}
+		if m.Indexes, err = indexDefinitions(db.noms, p); err != nil {
+			return err
+		}
+		if err := enc.Encode(exportLine{Mutation: &m}); err != nil {
+			return err
+		}
+		prev = p
+	}
+	return nil
+}
+
+// exportEntry returns the entry for key k with value v, or a deleted entry if v
+// is nil.
+func (db *DB) exportEntry(k, v types.Value) (exportEntry, error) {
+	e := exportEntry{Key: string(k.(types.String))}
+	if v == nil {
+		e.Deleted = true
+		return e, nil
+	}
+	if b, ok := v.(types.Blob); ok {
+		data, err := ioutil.ReadAll(b.Reader())
+		if err != nil {
+			return exportEntry{}, err
+		}
+		e.Blob = &data
+		return e, nil
+	}
+	var err error
+	e.Value, err = db.codec.toJSON(v)
+	return e, err
+}
+
+// importEntry applies e to me.
+func (db *DB) importEntry(me *kv.MapEditor, e exportEntry) error {
+	k := types.String(e.Key)
+	if e.Deleted {
+		return me.Remove(k)
+	}
+	var v types.Value
+	if e.Blob != nil {
+		v = types.NewBlob(db.noms, bytes.NewReader(*e.Blob))
+	} else {
+		var err error
+		if v, err = db.codec.fromJSON(e.Value, db.noms); err != nil {
+			return fmt.Errorf("could not parse value of '%s': %w", e.Key, err)
+		}
+	}
+	return me.Set(k, v)
+}
+
+// indexDefinitions returns the definitions of the indexes of c, or nil if it has
+// none.
+func indexDefinitions(noms types.ValueReader, c Commit) (map[string]IndexDefinition, error) {
+	indexes, err := c.Indexes(noms)
+	if err != nil || len(indexes) == 0 {
+		return nil, err
+	}
+	defs := make(map[string]IndexDefinition, len(indexes))
+	for name, idx := range indexes {
+		defs[name] = idx.Definition
+	}
+	return defs, nil
+}
+
+// importIndexes returns the indexes defined by defs over the data to, updating
+// those in prev over the data from where the definition didn't change.
+func importIndexes(noms types.ValueReadWriter, prev map[string]Index, defs map[string]IndexDefinition, from, to types.Map) map[string]Index {
+	kept := map[string]Index{}
+	for name, idx := range prev {
+		if def, ok := defs[name]; ok && def == idx.Definition {
+			kept[name] = idx
+		}
+	}
+	r := updateIndexes(noms, kept, from, to)
+	for name, def := range defs {
+		if _, ok := r[name]; !ok {
+			r[name] = buildIndex(noms, def, to)
+		}
+	}
+	return r
+}
+
+// Import reads an export written by Export from r and makes it the content of
+// the DB, which must be empty: the snapshot and the pending mutations on top
+// of it. See ImportOptions for the client ID. The data is verified against the
+// exported checksums, and the DB only changes once the whole export has been
+// read.
+func (db *DB) Import(r io.Reader, opts ImportOptions) error {
+	done, err := db.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	basis := db.Head()
+	if len(basis.Parents) > 0 || !basis.Data(db.noms).NomsMap().Empty() {
+		return ErrNotEmpty
+	}
+
+	h, data, indexes, mutations, err := db.readExport(r)
+	if err != nil {
+		return err
+	}
+	lastMutationID := uint64(0)
+	if opts.AdoptClientID {
+		lastMutationID = h.LastMutationID
+	}
+	head := makeSnapshot(db.noms, basis.Ref(), h.ServerStateID, db.noms.WriteValue(data.NomsMap()), data.NomsChecksum(), lastMutationID, writeIndexes(db.noms, indexes))
+	if h.ServerChecksum != "" {
+		head = withServerChecksum(db.noms, head, h.ServerChecksum)
+	}
+	db.noms.WriteValue(head.NomsStruct)
+
+	prevID := h.LastMutationID
+	for _, m := range mutations {
+		if m.ID != prevID+1 {
+			return fmt.Errorf("mutation %d does not follow mutation %d", m.ID, prevID)
+		}
+		prevID = m.ID
+		args, err := db.codec.fromJSON(m.Args, db.noms)
+		if err != nil {
+			return fmt.Errorf("could not parse args of mutation %d: %w", m.ID, err)
+		}
+		me := data.Edit()
+		for _, e := range m.Changes {
+			if err := db.importEntry(me, e); err != nil {
+				return err
+			}
+		}
+		next := me.Build()
+		if next.NomsChecksum() != types.String(m.Checksum) {
+			return fmt.Errorf("checksum mismatch in mutation %d! Expected %s, got %s", m.ID, m.Checksum, next.NomsChecksum())
+		}
+		indexes = importIndexes(db.noms, indexes, m.Indexes, data.NomsMap(), next.NomsMap())
+		head = makeLocal(db.noms, head.Ref(), datetime.DateTime{Time: m.Date}, head.NextMutationID(), m.Name, args, db.noms.WriteValue(next.NomsMap()), next.NomsChecksum(), writeIndexes(db.noms, indexes))
+		db.noms.WriteValue(head.NomsStruct)
+		data = next
+	}
+
+	defer db.lock()()
+	if db.head.NomsStruct.Hash() != basis.NomsStruct.Hash() {
+		return ErrNotEmpty
+	}
+	if opts.AdoptClientID && h.ClientID != "" && h.ClientID != db.clientID {
+		cc, err := readConfig(db.noms)
+		if err != nil {
+			return err
+		}
+		cc.ClientID = h.ClientID
+		if err := writeConfig(db.noms, cc); err != nil {
+			return err
+		}
+		db.clientID = h.ClientID
+	}
+	return db.setHeadLocked(head)
+}
+
+// readExport reads an export written by Export from r. It returns the header,
+// the data of the snapshot verified against its checksum, the snapshot's
+// indexes and the mutations, which are not applied.
+func (db *DB) readExport(r io.Reader) (ExportHeader, kv.Map, map[string]Index, []exportMutation, error) {
+	fail := func(err error) (ExportHeader, kv.Map, map[string]Index, []exportMutation, error) {
+		return ExportHeader{}, kv.Map{}, nil, nil, err
+	}
+	dec := json.NewDecoder(r)
+	var line exportLine
+	if err := dec.Decode(&line); err != nil {
+		return fail(fmt.Errorf("could not read export header: %w", err))
+	}
+	h := line.Header
+	if h == nil {
+		return fail(errors.New("export does not start with a header"))
+	}
+	if h.Version != exportVersion {
+		return fail(fmt.Errorf("unsupported export version %d", h.Version))
+	}
+
+	me := kv.NewMap(db.noms).Edit()
+	var mutations []exportMutation
+	for n := 2; ; n++ {
+		line = exportLine{}
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(fmt.Errorf("could not read line %d of export: %w", n, err))
+		}
+		switch {
+		case line.Entry != nil && len(mutations) == 0:
+			if err := db.importEntry(me, *line.Entry); err != nil {
+				return fail(err)
+			}
+		case line.Mutation != nil:
+			mutations = append(mutations, *line.Mutation)
+		default:
+			return fail(fmt.Errorf("unexpected line %d of export", n))
+		}
+	}
+
+	data := me.Build()
+	if data.NomsChecksum() != types.String(h.Checksum) {
+		return fail(fmt.Errorf("checksum mismatch in snapshot! Expected %s, got %s", h.Checksum, data.NomsChecksum()))
+	}
+	indexes := importIndexes(db.noms, nil, h.Indexes, types.NewMap(db.noms), data.NomsMap())
+	return *h, data, indexes, mutations, nil
+}
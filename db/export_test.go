@@ -0,0 +1,99 @@
+package db
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	ed := kv.NewMap(db.noms).Edit()
+	assert.NoError(ed.Set(types.String("a"), types.String("x")))
+	assert.NoError(ed.Set(types.String("b"), types.Number(1)))
+	m := ed.Build()
+	snapshot := makeSnapshot(db.noms, db.Head().Ref(), "ssid1", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 3, types.Ref{})
+	db.noms.WriteValue(snapshot.NomsStruct)
+	assert.NoError(db.setHead(snapshot))
+
+	tx := db.NewTransactionWithArgs("m1", types.String("arg1"), nil, nil)
+	assert.NoError(tx.Put("c", []byte(`{"name":"c"}`)))
+	_, err := tx.PutBlob("blob", strings.NewReader("blobdata"))
+	assert.NoError(err)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	tx = db.NewTransactionWithArgs("m2", types.String("arg2"), nil, nil)
+	_, err = tx.Del("a")
+	assert.NoError(err)
+	assert.NoError(tx.CreateIndex("byName", IndexDefinition{JSONPath: "/name"}))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	head := db.Head()
+
+	// Only the snapshot.
+	var buf bytes.Buffer
+	assert.NoError(db.Export(&buf, ExportOptions{}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(3, len(lines))
+	assert.Regexp(`^{"header":{"version":1,"clientID":"`+db.ClientID()+`","serverStateID":"ssid1","lastMutationID":3,"checksum":"\w+"}}$`, lines[0])
+	assert.Equal(`{"entry":{"key":"a","value":"x"}}`, lines[1])
+	assert.Equal(`{"entry":{"key":"b","value":1}}`, lines[2])
+
+	// A snapshot isn't imported over data.
+	assert.Equal(ErrNotEmpty, db.Import(bytes.NewReader(buf.Bytes()), ImportOptions{}))
+
+	// The DB keeps its own client ID unless it adopts the exported one.
+	db2, _ := LoadTempDB(assert)
+	cid := db2.ClientID()
+	assert.NoError(db2.Import(bytes.NewReader(buf.Bytes()), ImportOptions{}))
+	assert.Equal(cid, db2.ClientID())
+	assert.Equal(snapshot.Value.Data.TargetHash(), db2.Head().Value.Data.TargetHash())
+	assert.Equal(Snapshot{ServerStateID: "ssid1"}, db2.Head().Meta.Snapshot)
+	db2, dir2 := LoadTempDB(assert)
+	assert.NoError(db2.Import(bytes.NewReader(buf.Bytes()), ImportOptions{AdoptClientID: true}))
+	assert.Equal(db.ClientID(), db2.ClientID())
+	assert.Equal(snapshot.Meta.Snapshot, db2.Head().Meta.Snapshot)
+	assert.NoError(db2.Close())
+	assert.Equal(db.ClientID(), reloadDB(assert, dir2).ClientID())
+
+	// With the pending mutations.
+	buf.Reset()
+	assert.NoError(db.Export(&buf, ExportOptions{Pending: true}))
+	db3, _ := LoadTempDB(assert)
+	assert.NoError(db3.Import(bytes.NewReader(buf.Bytes()), ImportOptions{}))
+	got := db3.Head()
+	assert.Equal(head.Value.Data.TargetHash(), got.Value.Data.TargetHash())
+	assert.Equal(head.Value.Checksum, got.Value.Checksum)
+	assert.Equal(head.Value.Indexes.TargetHash(), got.Value.Indexes.TargetHash())
+	assert.Equal(uint64(2), got.MutationID())
+	assert.Equal("m2", got.Meta.Local.Name)
+	pending, err := pendingCommits(db3.noms, got)
+	assert.NoError(err)
+	assert.Equal(2, len(pending))
+	assert.Equal("m1", pending[0].Meta.Local.Name)
+	assert.True(types.String("arg1").Equals(pending[0].Meta.Local.Args))
+	tx = db3.NewTransaction()
+	v, err := tx.Get("c")
+	assert.NoError(err)
+	assert.Equal(`{"name":"c"}`, string(v))
+	items, err := tx.ScanIndex("byName", ScanOptions{})
+	assert.NoError(err)
+	assert.Equal(1, len(items))
+	tx.Close()
+
+	// Corrupted exports are rejected and leave the DB unchanged.
+	db4, _ := LoadTempDB(assert)
+	genesis := db4.HeadHash()
+	corrupt := strings.Replace(buf.String(), `"value":1`, `"value":2`, 1)
+	assert.Regexp("checksum mismatch in snapshot", db4.Import(strings.NewReader(corrupt), ImportOptions{}).Error())
+	assert.Regexp("export does not start with a header", db4.Import(strings.NewReader(`{"entry":{"key":"a","value":1}}`), ImportOptions{}).Error())
+	assert.Equal(genesis, db4.HeadHash())
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
+)
+
+const (
+	// indexKeySeparator separates the secondary key from the primary key in
+	// the keys of an index map. To find the entries with secondary key exactly
+	// "x", scan the index with prefix "x\x00".
+	indexKeySeparator = "\x00"
+)
+
+// IndexDefinition describes a secondary index over the values of the entries
+// whose keys start with KeyPrefix. The secondary key of an entry is the string
+// at the JSON Pointer JSONPath within its value. Entries that have no string at
+// JSONPath are not indexed.
+type IndexDefinition struct {
+	KeyPrefix string `json:"keyPrefix" noms:"keyPrefix"`
+	JSONPath  string `json:"jsonPath" noms:"jsonPath"`
+}
+
+// Index is an index definition and its data, which is stored in the commit
+// alongside the primary data. Data is a Ref<Map<String, String>> from
+// secondary key + indexKeySeparator + primary key to primary key.
+type Index struct {
+	Definition IndexDefinition
+	Data       types.Ref
+}
+
+// ErrNoSuchIndex is returned when referring to an index that does not exist.
+var ErrNoSuchIndex = errors.New("no such index")
+
+// Indexes returns the indexes stored in c, keyed by name.
+func (c Commit) Indexes(noms types.ValueReader) (map[string]Index, error) {
+	r := map[string]Index{}
+	if c.Value.Indexes.IsZeroValue() {
+		return r, nil
+	}
+	err := marshal.Unmarshal(c.Value.Indexes.TargetValue(noms), &r)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal indexes of %s: %w", c.NomsStruct.Hash(), err)
+	}
+	return r, nil
+}
+
+// writeIndexes writes indexes and returns a ref to them. If there are no indexes
+// the zero ref is returned so that commits without indexes don't change.
+func writeIndexes(noms types.ValueReadWriter, indexes map[string]Index) types.Ref {
+	if len(indexes) == 0 {
+		return types.Ref{}
+	}
+	return noms.WriteValue(marshal.MustMarshal(noms, indexes))
+}
+
+// indexKey returns the key in the index map for the entry k, v, if the entry is
+// indexed by def.
+func indexKey(def IndexDefinition, k string, v types.Value) (types.String, bool) {
+	if !strings.HasPrefix(k, def.KeyPrefix) {
+		return "", false
+	}
+	sv, err := evalJSONPointer(v, def.JSONPath)
+	if err != nil || sv == nil || sv.Kind() != types.StringKind {
+		return "", false
+	}
+	return types.String(string(sv.(types.String)) + indexKeySeparator + k), true
+}
+
+// buildIndex returns a new index of data described by def.
+func buildIndex(noms types.ValueReadWriter, def IndexDefinition, data types.Map) Index {
+	ed := types.NewMap(noms).Edit()
+	for it := data.IteratorFrom(types.String(def.KeyPrefix)); it.Valid(); it.Next() {
+		k, v := it.Entry()
+		ks := string(k.(types.String))
+		if !strings.HasPrefix(ks, def.KeyPrefix) {
+			break
+		}
+		if ik, ok := indexKey(def, ks, v); ok {
+			ed.Set(ik, k)
+		}
+	}
+	return Index{def, noms.WriteValue(ed.Map())}
+}
+
+// updateIndexes returns indexes updated for the changes between the data maps
+// from and to. Only the changed entries are visited.
+func updateIndexes(noms types.ValueReadWriter, indexes map[string]Index, from, to types.Map) map[string]Index {
+	if len(indexes) == 0 || from.Equals(to) {
+		return indexes
+	}
+	changes := mapChanges(from, to)
+	r := make(map[string]Index, len(indexes))
+	for name, idx := range indexes {
+		ed := idx.Data.TargetValue(noms).(types.Map).Edit()
+		for _, c := range changes {
+			k := string(c.Key.(types.String))
+			if c.OldValue != nil {
+				if ik, ok := indexKey(idx.Definition, k, c.OldValue); ok {
+					ed.Remove(ik)
+				}
+			}
+			if c.NewValue != nil {
+				if ik, ok := indexKey(idx.Definition, k, c.NewValue); ok {
+					ed.Set(ik, c.Key)
+				}
+			}
+		}
+		r[name] = Index{idx.Definition, noms.WriteValue(ed.Map())}
+	}
+	return r
+}
+
+// indexOverlay is an index as modified by a transaction: the index map of the
+// basis and the pending edits to it.
+type indexOverlay struct {
+	data  types.Map
+	edits *edits
+}
+
+// newIndexOverlay returns the overlay of the index defined by def, whose map in
+// the basis is data, for the pending writes ed to the basis data base. If the
+// index is new, data is empty and the overlay indexes the whole of base too.
+// Nothing is written.
+func newIndexOverlay(def IndexDefinition, data, base types.Map, isNew bool, ed *edits) indexOverlay {
+	r := indexOverlay{data, &edits{}}
+	if isNew {
+		for it := base.IteratorFrom(types.String(def.KeyPrefix)); it.Valid(); it.Next() {
+			k, v := it.Entry()
+			ks := string(k.(types.String))
+			if !strings.HasPrefix(ks, def.KeyPrefix) {
+				break
+			}
+			if ik, ok := indexKey(def, ks, v); ok {
+				r.edits.set(string(ik), k)
+			}
+		}
+	}
+	for _, k := range ed.sortedKeys() {
+		if ov := base.Get(types.String(k)); ov != nil {
+			if ik, ok := indexKey(def, k, ov); ok {
+				r.edits.remove(string(ik))
+			}
+		}
+		if nv := ed.values[k]; nv != nil {
+			if ik, ok := indexKey(def, k, nv); ok {
+				r.edits.set(string(ik), types.String(k))
+			}
+		}
+	}
+	return r
+}
+
+// scanIndex scans idx with opts, which apply to the secondary keys. The returned
+// items carry the primary key and the value from get. f filters the primary
+// values.
+func scanIndex(idx indexOverlay, get func(types.String) types.Value, opts ScanOptions, f scanFilter) ([]ScanItem, error) {
+	lim := opts.Limit
+	if lim == 0 {
+		lim = defaultScanLimit
+	}
+
+	res := []ScanItem{}
+	opts, ok := resolveIndexBound(idx.data, idx.edits, opts)
+	if !ok {
+		return res, nil
+	}
+	iterate(idx.data, idx.edits, opts, func(k string, v types.Value) bool {
+		pk := v.(types.String)
+		var pv types.Value
+		if !opts.KeysOnly || f != nil {
+			pv = get(pk)
+			if !f.match(pv) {
+				return true
+			}
+		}
+		it := ScanItem{
+			Key:          string(pk),
+			SecondaryKey: strings.TrimSuffix(k, indexKeySeparator+string(pk)),
+		}
+		if !opts.KeysOnly {
+			it.setValue(pv)
+		}
+		res = append(res, it)
+		return len(res) < lim
+	})
+	return res, nil
+}
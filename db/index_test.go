@@ -0,0 +1,194 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/log"
+	nomsjson "roci.dev/diff-server/util/noms/json"
+)
+
+func scanIndexKeys(assert *assert.Assertions, db *DB, name string, opts ScanOptions) []string {
+	tx := db.NewTransaction()
+	defer tx.Close()
+	items, err := tx.ScanIndex(name, opts)
+	assert.NoError(err)
+	r := []string{}
+	for _, it := range items {
+		r = append(r, it.SecondaryKey+"="+it.Key)
+	}
+	return r
+}
+
+func TestIndex(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("todo/1", []byte(`{"listID":"a","text":"one"}`)))
+	assert.NoError(tx.Put("todo/2", []byte(`{"listID":"b","text":"two"}`)))
+	assert.NoError(tx.Put("todo/3", []byte(`{"listID":"a","text":"three"}`)))
+	assert.NoError(tx.Put("todo/4", []byte(`{"text":"four"}`)))
+	assert.NoError(tx.Put("todo/5", []byte(`{"listID":42}`)))
+	assert.NoError(tx.Put("list/a", []byte(`{"listID":"a"}`)))
+	assert.Error(tx.CreateIndex("bad", IndexDefinition{KeyPrefix: "todo/", JSONPath: "listID"}))
+	assert.NoError(tx.CreateIndex("todosByList", IndexDefinition{KeyPrefix: "todo/", JSONPath: "/listID"}))
+
+	// Indexes see the transaction's own writes.
+	items, err := tx.ScanIndex("todosByList", ScanOptions{Prefix: "a\x00"})
+	assert.NoError(err)
+	assert.Equal(2, len(items))
+	assert.Equal("todo/1", items[0].Key)
+	assert.Equal("a", items[0].SecondaryKey)
+	assert.Equal("todo/3", items[1].Key)
+	text, err := evalJSONPointer(items[1].Value.Value, "/text")
+	assert.NoError(err)
+	assert.Equal(types.String("three"), text)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	indexes, err := db.Head().Indexes(db.noms)
+	assert.NoError(err)
+	assert.Equal(1, len(indexes))
+	assert.Equal(IndexDefinition{"todo/", "/listID"}, indexes["todosByList"].Definition)
+
+	assert.Equal([]string{"a=todo/1", "a=todo/3", "b=todo/2"}, scanIndexKeys(assert, db, "todosByList", ScanOptions{}))
+	assert.Equal([]string{"a=todo/3", "b=todo/2"}, scanIndexKeys(assert, db, "todosByList", ScanOptions{Start: &ScanBound{ID: &ScanID{Value: "a\x00todo/1", Exclusive: true}}}))
+	assert.Equal([]string{"a=todo/1"}, scanIndexKeys(assert, db, "todosByList", ScanOptions{Limit: 1}))
+	assert.Equal([]string{"b=todo/2"}, scanIndexKeys(assert, db, "todosByList", ScanOptions{Prefix: "b"}))
+
+	// Incremental maintenance on commit.
+	tx = db.NewTransaction()
+	assert.NoError(tx.Put("todo/1", []byte(`{"listID":"b","text":"one"}`)))
+	_, err = tx.Del("todo/2")
+	assert.NoError(err)
+	assert.NoError(tx.Put("todo/4", []byte(`{"listID":"c"}`)))
+	assert.NoError(tx.CreateIndex("todosByList", IndexDefinition{KeyPrefix: "todo/", JSONPath: "/listID"}))
+	assert.Error(tx.CreateIndex("todosByList", IndexDefinition{KeyPrefix: "todo/", JSONPath: "/text"}))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.Equal([]string{"a=todo/3", "b=todo/1", "c=todo/4"}, scanIndexKeys(assert, db, "todosByList", ScanOptions{}))
+
+	// Drop.
+	tx = db.NewTransaction()
+	assert.NoError(tx.DropIndex("todosByList"))
+	assert.True(errors.Is(tx.DropIndex("todosByList"), ErrNoSuchIndex))
+	_, err = tx.ScanIndex("todosByList", ScanOptions{})
+	assert.True(errors.Is(err, ErrNoSuchIndex))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.True(db.Head().Value.Indexes.IsZeroValue())
+}
+
+func TestIndexReload(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("todo/1", []byte(`{"listID":"a"}`)))
+	assert.NoError(tx.Put("todo/2", []byte(`{"listID":"b"}`)))
+	assert.NoError(tx.CreateIndex("todosByList", IndexDefinition{KeyPrefix: "todo/", JSONPath: "/listID"}))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	db = reloadDB(assert, dir)
+	assert.Equal([]string{"a=todo/1", "b=todo/2"}, scanIndexKeys(assert, db, "todosByList", ScanOptions{}))
+	indexes, err := db.Head().Indexes(db.noms)
+	assert.NoError(err)
+	assert.Equal(IndexDefinition{KeyPrefix: "todo/", JSONPath: "/listID"}, indexes["todosByList"].Definition)
+}
+
+func TestIndexPendingWrites(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("todo/1", []byte(`{"listID":"a"}`)))
+	assert.NoError(tx.Put("todo/2", []byte(`{"listID":"b"}`)))
+	assert.NoError(tx.Put("todo/3", []byte(`{"listID":"c"}`)))
+	assert.NoError(tx.CreateIndex("todosByList", IndexDefinition{KeyPrefix: "todo/", JSONPath: "/listID"}))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+
+	keys := func(tx *Transaction, name string, opts ScanOptions) []string {
+		items, err := tx.ScanIndex(name, opts)
+		assert.NoError(err)
+		r := []string{}
+		for _, it := range items {
+			r = append(r, it.SecondaryKey+"="+it.Key)
+		}
+		return r
+	}
+	index := func(v uint64) *uint64 {
+		return &v
+	}
+
+	tx = db.NewTransaction()
+	defer tx.Close()
+	assert.NoError(tx.Put("todo/1", []byte(`{"listID":"d"}`)))
+	_, err = tx.Del("todo/2")
+	assert.NoError(err)
+	assert.NoError(tx.Put("todo/4", []byte(`{"listID":"a"}`)))
+	assert.NoError(tx.CreateIndex("byList", IndexDefinition{KeyPrefix: "todo/", JSONPath: "/listID"}))
+	want := []string{"a=todo/4", "c=todo/3", "d=todo/1"}
+	assert.Equal(want, keys(tx, "todosByList", ScanOptions{}))
+	assert.Equal(want, keys(tx, "byList", ScanOptions{}))
+	assert.Equal([]string{"c=todo/3", "d=todo/1"}, keys(tx, "todosByList", ScanOptions{Start: &ScanBound{Index: index(1)}}))
+	assert.Equal([]string{"d=todo/1"}, keys(tx, "todosByList", ScanOptions{Start: &ScanBound{ID: &ScanID{Value: "c\x00todo/3", Exclusive: true}, Index: index(1)}}))
+	assert.Equal([]string{}, keys(tx, "todosByList", ScanOptions{Start: &ScanBound{Index: index(3)}}))
+
+	// Scans don't change the basis indexes and are cached until the next write.
+	basis, err := tx.basis.Indexes(db.noms)
+	assert.NoError(err)
+	assert.Equal(3, int(basis["todosByList"].Data.TargetValue(db.noms).(types.Map).Len()))
+	assert.Equal(2, len(tx.scannedIndexes))
+	assert.NoError(tx.Put("todo/3", []byte(`{"listID":"a"}`)))
+	assert.Nil(tx.scannedIndexes)
+	assert.Equal([]string{"a=todo/3", "a=todo/4", "d=todo/1"}, keys(tx, "todosByList", ScanOptions{}))
+	assert.Equal(1, len(tx.scannedIndexes))
+}
+
+func TestIndexPull(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("todo-1", []byte(`{"listID":"a"}`)))
+	assert.NoError(tx.Put("todo-2", []byte(`{"listID":"b"}`)))
+	assert.NoError(tx.CreateIndex("todosByList", IndexDefinition{KeyPrefix: "todo-", JSONPath: "/listID"}))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+
+	// Make a snapshot with the same data and indexes to pull from.
+	head := db.Head()
+	base := makeSnapshot(db.noms, head.Ref(), "1", head.Value.Data, head.Value.Checksum, 0, head.Value.Indexes)
+
+	ed := kv.NewMap(db.noms).Edit()
+	for k, v := range map[string]string{"todo-2": `{"listID":"c"}`, "todo-3": `{"listID":"a"}`} {
+		nv, err := nomsjson.FromJSON([]byte(v), db.noms)
+		assert.NoError(err)
+		assert.NoError(ed.Set(types.String(k), nv))
+	}
+	expected := ed.Build()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"patch":[{"op":"remove","path":"/todo-1"},{"op":"remove","path":"/todo-2"},{"op":"add","path":"/todo-2","value":{"listID":"c"}},{"op":"add","path":"/todo-3","value":{"listID":"a"}}],"stateID":"2","checksum":"%s","lastMutationID":0}`, expected.Checksum())
+	}))
+	defer server.Close()
+
+	puller := &defaultPuller{}
+	snapshot, _, err := puller.Pull(db.noms, base, server.URL, "", "", db.clientID, "1")
+	assert.NoError(err)
+
+	indexes, err := snapshot.Indexes(db.noms)
+	assert.NoError(err)
+	assert.Equal(expected.NomsMap().Hash(), snapshot.Value.Data.TargetHash())
+	assert.Equal(buildIndex(db.noms, indexes["todosByList"].Definition, expected.NomsMap()), indexes["todosByList"])
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
+
+	"roci.dev/diff-server/kv"
+)
+
+// ErrLocalIndex is returned from index operations on the local keyspace.
+var ErrLocalIndex = errors.New("indexes are not supported in the local keyspace")
+
+// localData is the head value of the local dataset. The local keyspace holds
+// device-only state: it is not part of any commit, so it is never pushed and
+// survives pulls.
+type localData struct {
+	Data     types.Ref
+	Checksum types.String
+	// Expires is a Ref<Map<String, Number>> of the expiry times of the keys
+	// put with a TTL, in unix milliseconds.
+	Expires types.Ref `noms:",omitempty"`
+	// ExpiresByTime is a Ref<Map<String, String>> of the same keys ordered by
+	// when they expire. See expiryKey.
+	ExpiresByTime types.Ref `noms:",omitempty"`
+	// Head is the head commit the local keyspace was written with. A commit
+	// that changes both keyspaces records its new head here, so that a single
+	// write covers both. See DB.commit.
+	Head types.Ref `noms:",omitempty"`
+}
+
+// localState is the local keyspace as loaded in memory.
+type localState struct {
+	data    kv.Map
+	expires expiries
+}
+
+// loadLocal returns the local keyspace stored in noms and the head it was
+// written with, which is the zero Ref if none was recorded.
+func loadLocal(noms datas.Database) (localState, types.Ref, error) {
+	ds := noms.GetDataset(LOCAL_DATASET)
+	if !ds.HasHead() {
+		m := kv.NewMap(noms)
+		noms.WriteValue(m.NomsMap())
+		return localState{m, newExpiries(noms)}, types.Ref{}, nil
+	}
+	var ld localData
+	if err := marshal.Unmarshal(ds.HeadValue(), &ld); err != nil {
+		return localState{}, types.Ref{}, fmt.Errorf("Could not unmarshal local data: %s", err.Error())
+	}
+	checksum, err := kv.ChecksumFromString(string(ld.Checksum))
+	if err != nil {
+		return localState{}, types.Ref{}, err
+	}
+	ls := localState{
+		data:    kv.FromNoms(noms, ld.Data.TargetValue(noms).(types.Map), checksum),
+		expires: newExpiries(noms),
+	}
+	if !ld.ExpiresByTime.IsZeroValue() {
+		ls.expires = expiries{ld.Expires.TargetValue(noms).(types.Map), ld.ExpiresByTime.TargetValue(noms).(types.Map)}
+	} else if !ld.Expires.IsZeroValue() {
+		// Written before the index by time was kept.
+		ls.expires = indexExpiries(noms, ld.Expires.TargetValue(noms).(types.Map))
+	}
+	return ls, ld.Head, nil
+}
+
+// writeLocalLocked stores ls as the local keyspace, together with head, the
+// head commit it belongs to. The caller must hold the lock.
+func (db *DB) writeLocalLocked(ls localState, head Commit) error {
+	ld := localData{
+		Data:     db.noms.WriteValue(ls.data.NomsMap()),
+		Checksum: ls.data.NomsChecksum(),
+		Head:     db.noms.WriteValue(head.NomsStruct),
+	}
+	if !ls.expires.Empty() {
+		ld.Expires = db.noms.WriteValue(ls.expires.byKey)
+		ld.ExpiresByTime = db.noms.WriteValue(ls.expires.byTime)
+	}
+	_, err := db.noms.CommitValue(db.noms.GetDataset(LOCAL_DATASET), marshal.MustMarshal(db.noms, ld))
+	if err != nil {
+		return err
+	}
+	db.local = ls
+	return nil
+}
+
+// recoverHeadLocked finishes a commit that stopped after writing the local
+// keyspace but before fast-forwarding the master dataset: if localHead, the
+// head the local keyspace was written with, is a child of the master head, it
+// is the committed head. The master dataset is only fast-forwarded to it if
+// repair is true. The caller must hold the lock.
+func (db *DB) recoverHeadLocked(localHead types.Ref, repair bool) error {
+	current := db.head.NomsStruct.Hash()
+	if localHead.IsZeroValue() || localHead.TargetHash() == current {
+		return nil
+	}
+	c, err := ReadCommit(db.noms, localHead.TargetHash())
+	if err != nil {
+		return err
+	}
+	if len(c.Parents) != 1 || c.Parents[0].TargetHash() != current {
+		// The master dataset moved on since, for example by a sync.
+		return nil
+	}
+	if !repair {
+		db.head = c
+		return nil
+	}
+	return db.setHeadLocked(c)
+}
+
+// LocalHash returns the hash of the data in the local keyspace.
+func (db *DB) LocalHash() hash.Hash {
+	defer db.lock()()
+	return db.local.data.NomsMap().Hash()
+}
+
+// DiffLocal is like Diff but returns the changes between the local keyspace
+// data with hashes from and to, as returned by LocalHash.
+func (db *DB) DiffLocal(from, to hash.Hash, opts DiffOptions) ([]DiffChange, error) {
+	done, err := db.beginOp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var maps [2]types.Map
+	for i, h := range []hash.Hash{from, to} {
+		m, ok := db.noms.ReadValue(h).(types.Map)
+		if !ok {
+			return nil, fmt.Errorf("local data %s not found", h)
+		}
+		maps[i] = m
+	}
+	return db.codec.diffMaps(maps[0], maps[1], opts)
+}
+
+// Local returns a view of tx that reads and writes the local keyspace instead
+// of the synced data. Both views belong to the same transaction: committing or
+// closing either commits or closes both. Local writes don't create a commit,
+// so they are never pushed, and pulls leave them in place.
+func (tx *Transaction) Local() *Transaction {
+	return &Transaction{tx.txState, tx.local}
+}
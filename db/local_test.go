@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestLocal(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	head := db.HeadHash()
+
+	// Local writes don't create a commit.
+	tx := db.NewTransaction()
+	assert.NoError(tx.Local().Put("draft", []byte(`"hello"`)))
+	has, err := tx.Has("draft")
+	assert.NoError(err)
+	assert.False(has)
+	ref, err := tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.Equal(head, ref.TargetHash())
+	assert.Equal(head, db.HeadHash())
+
+	// A transaction spans both keyspaces.
+	tx = db.NewTransaction()
+	local := tx.Local()
+	v, err := local.Get("draft")
+	assert.NoError(err)
+	assert.Equal(`"hello"`, string(v))
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	ok, err := local.Del("draft")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.NoError(local.Put("cursor", []byte(`42`)))
+	items, err := local.Scan(ScanOptions{})
+	assert.NoError(err)
+	assert.Equal(1, len(items))
+	assert.Equal("cursor", items[0].Key)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NotEqual(head, db.HeadHash())
+
+	// The local keyspace is durable.
+	db = reloadDB(assert, dir)
+	tx = db.NewTransaction()
+	defer tx.Close()
+	v, err = tx.Local().Get("cursor")
+	assert.NoError(err)
+	assert.Equal(`42`, string(v))
+	v, err = tx.Local().Get("foo")
+	assert.NoError(err)
+	assert.Nil(v)
+
+	assert.True(errors.Is(tx.Local().CreateIndex("i", IndexDefinition{}), ErrLocalIndex))
+	_, err = tx.Local().ScanIndex("i", ScanOptions{})
+	assert.True(errors.Is(err, ErrLocalIndex))
+}
+
+func TestLocalConflict(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx1 := db.NewTransaction()
+	tx2 := db.NewTransaction()
+	assert.NoError(tx1.Local().Put("a", []byte(`1`)))
+	assert.NoError(tx2.Local().Put("a", []byte(`2`)))
+	from := db.LocalHash()
+	_, err := tx1.Commit(log.Default())
+	assert.NoError(err)
+	_, err = tx2.Commit(log.Default())
+	var commitErr CommitError
+	assert.True(errors.As(err, &commitErr))
+
+	changes, err := db.DiffLocal(from, db.LocalHash(), DiffOptions{})
+	assert.NoError(err)
+	assert.Equal([]DiffChange{{Op: DiffOpAdd, Key: "a", NewValue: []byte(`1`)}}, changes)
+}
+
+func TestLocalCommitAtomic(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	basis := db.Head()
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	assert.NoError(tx.Local().Put("cursor", []byte(`1`)))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+	head := db.HeadHash()
+
+	// Undo the fast-forward of the master dataset, as if the process stopped
+	// right after writing the local keyspace.
+	_, err = db.noms.SetHead(db.noms.GetDataset(MASTER_DATASET), basis.Ref())
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	// Loading finishes the commit.
+	db = reloadDB(assert, dir)
+	assert.Equal(head, db.HeadHash())
+	assert.Equal(head, db.noms.GetDataset(MASTER_DATASET).HeadRef().TargetHash())
+	tx = db.NewTransaction()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"bar"`, string(v))
+	v, err = tx.Local().Get("cursor")
+	assert.NoError(err)
+	assert.Equal(`1`, string(v))
+	assert.NoError(tx.Close())
+
+	// Later commits that don't write the local keyspace are kept.
+	tx = db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"baz"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	head = db.HeadHash()
+	assert.NoError(db.Close())
+	db = reloadDB(assert, dir)
+	assert.Equal(head, db.HeadHash())
+	assert.NoError(db.Close())
+}
+
+func TestLocalCommitConflict(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+
+	tx1 := db.NewTransaction()
+	tx2 := db.NewTransaction()
+	assert.NoError(tx1.Put("a", []byte(`1`)))
+	assert.NoError(tx2.Put("b", []byte(`2`)))
+	assert.NoError(tx2.Local().Put("c", []byte(`3`)))
+	_, err := tx1.Commit(log.Default())
+	assert.NoError(err)
+	head, local := db.HeadHash(), db.LocalHash()
+
+	// tx2 started before tx1 committed, so none of it is written.
+	_, err = tx2.Commit(log.Default())
+	var commitErr CommitError
+	assert.True(errors.As(err, &commitErr))
+	assert.Equal(datas.ErrMergeNeeded, commitErr.error)
+	assert.Equal(head, db.HeadHash())
+	assert.Equal(local, db.LocalHash())
+	assert.NoError(db.Close())
+
+	db = reloadDB(assert, dir)
+	assert.Equal(head, db.HeadHash())
+	assert.Equal(local, db.LocalHash())
+	assert.NoError(db.Close())
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/spec"
+)
+
+// ErrNewerFormat is returned when loading a database that a newer version of
+// Replicache has written in a format this version doesn't support.
+var ErrNewerFormat = errors.New("database format is newer than supported")
+
+// migration is a step that upgrades the on-disk format by one version. It may
+// rewrite commits, the config and any dataset. The format version is recorded
+// after each step, so a step that fails is run again on the next Load.
+type migration struct {
+	description string
+	run         func(noms datas.Database) error
+}
+
+// migrations are the registered migration steps, in order: migrations[i]
+// upgrades from format version i+1 to i+2. A change to the format, such as to
+// the Commit struct and its schema, must append a step that rewrites existing
+// data. Load runs the steps a database needs.
+var migrations = []migration{}
+
+// FormatVersion returns the format version this version of Replicache writes.
+func FormatVersion() uint64 {
+	return uint64(len(migrations)) + 1
+}
+
+// MigrationPlan describes the migrations that upgrade a database from format
+// version From to To. Steps describes each of them.
+type MigrationPlan struct {
+	From  uint64   `json:"from"`
+	To    uint64   `json:"to"`
+	Steps []string `json:"steps"`
+}
+
+// PlanMigrations returns the migrations that loading the database sp with opts
+// would run, without running them or changing the database.
+func PlanMigrations(sp spec.Spec, opts Options) (MigrationPlan, error) {
+	if !sp.Path.IsEmpty() {
+		return MigrationPlan{}, errors.New("Invalid spec - must not specify a path")
+	}
+	if opts.Lock != LockNone && sp.Protocol == "nbs" {
+		dl, err := lockDir(sp.DatabaseName, LockShared)
+		if err != nil {
+			return MigrationPlan{}, err
+		}
+		defer dl.unlock()
+	}
+	noms, err := openNoms(sp, opts.EncryptionKey)
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+	defer noms.Close()
+	plan, _, err := planMigrations(noms)
+	return plan, err
+}
+
+// planMigrations returns the migrations noms needs and its config.
+func planMigrations(noms datas.Database) (MigrationPlan, ClientConfig, error) {
+	cc, err := readConfig(noms)
+	if err != nil {
+		return MigrationPlan{}, ClientConfig{}, err
+	}
+	from := cc.FormatVersion
+	if from == 0 {
+		from = 1
+		if !noms.GetDataset(MASTER_DATASET).HasHead() {
+			// A new database is created in the current format.
+			from = FormatVersion()
+		}
+	}
+	if from > FormatVersion() {
+		return MigrationPlan{}, ClientConfig{}, fmt.Errorf("%w: the database has format version %d but this version of Replicache supports up to %d. It was opened by a newer version of Replicache and can't be downgraded", ErrNewerFormat, from, FormatVersion())
+	}
+	plan := MigrationPlan{From: from, To: FormatVersion(), Steps: []string{}}
+	for _, m := range migrations[from-1:] {
+		plan.Steps = append(plan.Steps, m.description)
+	}
+	return plan, cc, nil
+}
+
+// migrateLocked runs the migrations the database needs and records the current
+// format version. The mutex must be held when called.
+func (db *DB) migrateLocked() error {
+	plan, cc, err := planMigrations(db.noms)
+	if err != nil {
+		return err
+	}
+	if cc.FormatVersion == plan.To {
+		return nil
+	}
+	if db.readOnly {
+		if len(plan.Steps) > 0 {
+			return fmt.Errorf("Cannot load database read-only: it needs to be migrated from format version %d to %d", plan.From, plan.To)
+		}
+		return nil
+	}
+	for v := plan.From; v < plan.To; v++ {
+		m := migrations[v-1]
+		if err := m.run(db.noms); err != nil {
+			return fmt.Errorf("could not migrate database from format version %d (%s): %w", v, m.description, err)
+		}
+		// The step may have rewritten the config.
+		if cc, err = readConfig(db.noms); err != nil {
+			return err
+		}
+		cc.FormatVersion = v + 1
+		if err := writeConfig(db.noms, cc); err != nil {
+			return err
+		}
+	}
+	if cc.FormatVersion != plan.To {
+		cc.FormatVersion = plan.To
+		return writeConfig(db.noms, cc)
+	}
+	return nil
+}
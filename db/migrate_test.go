@@ -0,0 +1,81 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// setFormatVersion records format version v in the database in dir, without
+// loading it and so without migrating it.
+func setFormatVersion(assert *assert.Assertions, dir string, v uint64) {
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	noms := sp.GetDatabase()
+	cc, err := readConfig(noms)
+	assert.NoError(err)
+	cc.FormatVersion = v
+	assert.NoError(writeConfig(noms, cc))
+	assert.NoError(noms.Close())
+}
+
+func TestMigrations(t *testing.T) {
+	assert := assert.New(t)
+	defer func(orig []migration) {
+		migrations = orig
+	}(migrations)
+
+	db, dir := LoadTempDB(assert)
+	cc, err := readConfig(db.noms)
+	assert.NoError(err)
+	assert.Equal(FormatVersion(), cc.FormatVersion)
+	cid := db.ClientID()
+	assert.NoError(db.Close())
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+
+	fail := true
+	migrations = append(migrations, migration{"add marker", func(noms datas.Database) error {
+		if fail {
+			return errors.New("oops")
+		}
+		_, err := noms.CommitValue(noms.GetDataset("marker"), types.Bool(true))
+		return err
+	}})
+	from := FormatVersion() - 1
+	setFormatVersion(assert, dir, from)
+
+	plan, err := PlanMigrations(sp, Options{})
+	assert.NoError(err)
+	assert.Equal(MigrationPlan{From: from, To: FormatVersion(), Steps: []string{"add marker"}}, plan)
+
+	_, err = LoadWithOptions(sp, Options{Lock: LockShared})
+	assert.Regexp("it needs to be migrated", err.Error())
+	_, err = Load(sp)
+	assert.Regexp("could not migrate database from format version .* \\(add marker\\): oops", err.Error())
+
+	fail = false
+	db, err = Load(sp)
+	assert.NoError(err)
+	assert.Equal(cid, db.ClientID())
+	assert.True(db.noms.GetDataset("marker").HasHead())
+	cc, err = readConfig(db.noms)
+	assert.NoError(err)
+	assert.Equal(FormatVersion(), cc.FormatVersion)
+	assert.NoError(db.Close())
+
+	plan, err = PlanMigrations(sp, Options{})
+	assert.NoError(err)
+	assert.Equal(0, len(plan.Steps))
+
+	setFormatVersion(assert, dir, FormatVersion()+1)
+	_, err = Load(sp)
+	assert.True(errors.Is(err, ErrNewerFormat))
+	assert.Regexp("can't be downgraded", err.Error())
+	_, err = PlanMigrations(sp, Options{})
+	assert.True(errors.Is(err, ErrNewerFormat))
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/attic-labs/noms/go/types"
+
+	"roci.dev/diff-server/util/chk"
+)
+
+// edits is the set of pending writes of a transaction. The keys are sorted
+// lazily, on the first scan after a write, so that they can be merged with the
+// iterator of the basis map. This lets us scan a transaction's data without
+// building a new map. A nil value means the key was removed.
+type edits struct {
+	keys     []string
+	values   map[string]types.Value
+	unsorted bool
+
+	// sortMutex serializes sorting keys between scans, which only hold the
+	// transaction's read lock.
+	sortMutex sync.Mutex
+}
+
+func (e *edits) len() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.keys)
+}
+
+func (e *edits) set(k string, v types.Value) {
+	if e.values == nil {
+		e.values = map[string]types.Value{}
+	}
+	if _, ok := e.values[k]; !ok {
+		if n := len(e.keys); n > 0 && e.keys[n-1] > k {
+			e.unsorted = true
+		}
+		e.keys = append(e.keys, k)
+	}
+	e.values[k] = v
+}
+
+// restore undoes the writes to k since its pending edit was v, or since it had
+// no pending edit if !ok.
+func (e *edits) restore(k string, v types.Value, ok bool) {
+	if ok {
+		e.values[k] = v
+		return
+	}
+	if _, had := e.values[k]; !had {
+		return
+	}
+	delete(e.values, k)
+	for i, ek := range e.keys {
+		if ek == k {
+			e.keys = append(e.keys[:i], e.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// sortedKeys returns the keys in order.
+func (e *edits) sortedKeys() []string {
+	if e == nil {
+		return nil
+	}
+	e.sortMutex.Lock()
+	defer e.sortMutex.Unlock()
+	if e.unsorted {
+		sort.Strings(e.keys)
+		e.unsorted = false
+	}
+	return e.keys
+}
+
+func (e *edits) remove(k string) {
+	e.set(k, nil)
+}
+
+// clone returns a copy of e that is not affected by later edits to e.
+func (e *edits) clone() *edits {
+	if e.len() == 0 {
+		return nil
+	}
+	c := &edits{
+		keys:   append([]string(nil), e.sortedKeys()...),
+		values: make(map[string]types.Value, len(e.values)),
+	}
+	for k, v := range e.values {
+		c.values[k] = v
+	}
+	return c
+}
+
+// entryIter iterates over key-value entries in one direction.
+type entryIter interface {
+	valid() bool
+	entry() (types.String, types.Value)
+	next()
+}
+
+type mapIter struct {
+	it      *types.MapIterator
+	reverse bool
+}
+
+func (i mapIter) valid() bool {
+	return i.it.Valid()
+}
+
+func (i mapIter) entry() (types.String, types.Value) {
+	k, v := i.it.Entry()
+	chk.True(k.Kind() == types.StringKind, "Only keys with string kinds are supported, Noms schema check should have caught this")
+	return k.(types.String), v
+}
+
+func (i mapIter) next() {
+	if i.reverse {
+		i.it.Prev()
+	} else {
+		i.it.Next()
+	}
+}
+
+type editsIter struct {
+	e       *edits
+	keys    []string // e.sortedKeys()
+	i       int
+	reverse bool
+}
+
+func (i *editsIter) valid() bool {
+	return i.i >= 0 && i.i < len(i.keys)
+}
+
+func (i *editsIter) entry() (types.String, types.Value) {
+	k := i.keys[i.i]
+	return types.String(k), i.e.values[k]
+}
+
+func (i *editsIter) next() {
+	if i.reverse {
+		i.i--
+	} else {
+		i.i++
+	}
+}
+
+// mergeIter merges the entries of base and over. Where both have the same key
+// the entry of over wins.
+type mergeIter struct {
+	base, over entryIter
+	reverse    bool
+}
+
+// useOver returns true if the current entry comes from over.
+func (i mergeIter) useOver() bool {
+	if !i.over.valid() {
+		return false
+	}
+	if !i.base.valid() {
+		return true
+	}
+	bk, _ := i.base.entry()
+	ok, _ := i.over.entry()
+	return ok == bk || (ok < bk) != i.reverse
+}
+
+func (i mergeIter) valid() bool {
+	return i.base.valid() || i.over.valid()
+}
+
+func (i mergeIter) entry() (types.String, types.Value) {
+	if i.useOver() {
+		return i.over.entry()
+	}
+	return i.base.entry()
+}
+
+func (i mergeIter) next() {
+	if !i.useOver() {
+		i.base.next()
+		return
+	}
+	if i.base.valid() {
+		bk, _ := i.base.entry()
+		ok, _ := i.over.entry()
+		if ok == bk {
+			i.base.next()
+		}
+	}
+	i.over.next()
+}
@@ -0,0 +1,392 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// PatchFormat is the format of the patch passed to Patch.
+type PatchFormat string
+
+const (
+	// JSONPatch is a JSON Patch (RFC 6902): an array of operations.
+	JSONPatch PatchFormat = "json-patch"
+	// MergePatch is a JSON Merge Patch (RFC 7396).
+	MergePatch PatchFormat = "merge-patch"
+)
+
+// PatchTestError is returned from Patch when a JSON Patch test operation fails.
+type PatchTestError struct {
+	// Op is the index of the failed operation within the patch.
+	Op       int
+	Path     string
+	Expected json.RawMessage
+	// Actual is the value at Path, or nil if there is none or it is a blob.
+	Actual json.RawMessage
+}
+
+func (e PatchTestError) Error() string {
+	if e.Actual == nil {
+		return fmt.Sprintf("test operation %d failed: no value at '%s', expected %s", e.Op, e.Path, e.Expected)
+	}
+	return fmt.Sprintf("test operation %d failed: value at '%s' is %s, expected %s", e.Op, e.Path, e.Actual, e.Expected)
+}
+
+// patchOp is a parsed JSON Patch operation.
+type patchOp struct {
+	name      string
+	path      string
+	toks      []string
+	fromToks  []string
+	value     types.Value
+	valueJSON json.RawMessage
+}
+
+// Patch updates the value at key with patch, which is in the given format. The
+// patch is applied to the stored value directly, so any value can be patched,
+// including blobs, which can be replaced as a whole. Either the whole patch
+// applies or the value is left unchanged.
+func (tx *Transaction) Patch(key string, format PatchFormat, patch []byte) error {
+	var ops []patchOp
+	switch format {
+	case JSONPatch:
+		var err error
+		if ops, err = tx.db.codec.parseJSONPatch(patch, tx.db.noms); err != nil {
+			return err
+		}
+	case MergePatch:
+		if _, err := decodeJSON(patch); err != nil {
+			return fmt.Errorf("could not parse patch '%s': %w", patch, err)
+		}
+	case "":
+		return errors.New("patch format is required")
+	default:
+		return fmt.Errorf("unknown patch format: %s", format)
+	}
+
+	defer tx.lock()()
+
+	if tx.closed {
+		return ErrClosed
+	}
+	current := tx.me.Get(types.String(key))
+	if current == nil {
+		return fmt.Errorf("could not Patch '%s': key does not exist", key)
+	}
+
+	var value types.Value
+	var err error
+	if format == JSONPatch {
+		value, err = tx.db.codec.applyJSONPatch(current, ops)
+		if err != nil {
+			var testErr PatchTestError
+			if errors.As(err, &testErr) {
+				return err
+			}
+			return fmt.Errorf("could not Patch '%s': %w", key, err)
+		}
+	} else {
+		value, err = tx.db.codec.applyMergePatch(current, patch, tx.db.noms)
+		if err != nil {
+			return fmt.Errorf("could not Patch '%s': %w", key, err)
+		}
+	}
+	return tx.set(key, value)
+}
+
+// parseJSONPatch parses the JSON Patch patch and converts the values in its
+// operations to noms values.
+func (c jsonCodec) parseJSONPatch(patch []byte, noms types.ValueReadWriter) ([]patchOp, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(patch, &raw); err != nil {
+		return nil, fmt.Errorf("could not parse patch '%s': %w", patch, err)
+	}
+	ops := make([]patchOp, len(raw))
+	for i, r := range raw {
+		var o struct {
+			Op    string          `json:"op"`
+			Path  *string         `json:"path"`
+			From  *string         `json:"from"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(r, &o); err != nil {
+			return nil, fmt.Errorf("op %d: must be an object", i)
+		}
+		switch o.Op {
+		case "add", "remove", "replace", "move", "copy", "test":
+		case "":
+			return nil, fmt.Errorf("op %d: op field is required", i)
+		default:
+			return nil, fmt.Errorf("op %d: unknown op: %s", i, o.Op)
+		}
+		if o.Path == nil {
+			return nil, fmt.Errorf("op %d: path field is required", i)
+		}
+		op := patchOp{name: o.Op, path: *o.Path, valueJSON: o.Value}
+		var err error
+		if op.toks, err = parseJSONPointer(op.path); err != nil {
+			return nil, fmt.Errorf("op %d: %w", i, err)
+		}
+		switch o.Op {
+		case "move", "copy":
+			if o.From == nil {
+				return nil, fmt.Errorf("op %d: from field is required", i)
+			}
+			if op.fromToks, err = parseJSONPointer(*o.From); err != nil {
+				return nil, fmt.Errorf("op %d: %w", i, err)
+			}
+		case "remove":
+		default:
+			if o.Value == nil {
+				return nil, fmt.Errorf("op %d: value field is required", i)
+			}
+			if op.value, err = c.fromJSON(o.Value, noms); err != nil {
+				return nil, fmt.Errorf("op %d: %w", i, err)
+			}
+		}
+		ops[i] = op
+	}
+	return ops, nil
+}
+
+// applyJSONPatch returns doc with the JSON Patch operations ops applied.
+func (c jsonCodec) applyJSONPatch(doc types.Value, ops []patchOp) (types.Value, error) {
+	for i, op := range ops {
+		var err error
+		switch op.name {
+		case "add":
+			doc, err = nomsAdd(doc, op.toks, op.value)
+		case "remove":
+			doc, _, err = nomsRemove(doc, op.toks)
+		case "replace":
+			if len(op.toks) == 0 {
+				doc = op.value
+				break
+			}
+			if _, err = nomsGet(doc, op.toks); err == nil {
+				doc, _, err = nomsRemove(doc, op.toks)
+			}
+			if err == nil {
+				doc, err = nomsAdd(doc, op.toks, op.value)
+			}
+		case "move":
+			if isPrefix(op.fromToks, op.toks) && len(op.fromToks) < len(op.toks) {
+				err = errors.New("cannot move a value into one of its children")
+				break
+			}
+			var v types.Value
+			doc, v, err = nomsRemove(doc, op.fromToks)
+			if err == nil {
+				doc, err = nomsAdd(doc, op.toks, v)
+			}
+		case "copy":
+			// Values are immutable so the copy can share the original.
+			var v types.Value
+			v, err = nomsGet(doc, op.fromToks)
+			if err == nil {
+				doc, err = nomsAdd(doc, op.toks, v)
+			}
+		case "test":
+			actual, gerr := nomsGet(doc, op.toks)
+			if gerr != nil || !actual.Equals(op.value) {
+				e := PatchTestError{Op: i, Path: op.path, Expected: op.valueJSON}
+				if gerr == nil {
+					e.Actual, _ = c.toJSON(actual)
+				}
+				return nil, e
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s '%s'): %w", i, op.name, op.path, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyMergePatch returns target with the JSON Merge Patch patch applied.
+// target is nil if there is no value to patch.
+func (c jsonCodec) applyMergePatch(target types.Value, patch json.RawMessage, noms types.ValueReadWriter) (types.Value, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(patch), []byte("{")) {
+		return c.fromJSON(patch, noms)
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil {
+		return nil, err
+	}
+	if !isObject(target) {
+		var err error
+		if target, err = c.fromJSON([]byte("{}"), noms); err != nil {
+			return nil, err
+		}
+	}
+	for k, p := range members {
+		var err error
+		if string(bytes.TrimSpace(p)) == "null" {
+			if child(target, k) != nil {
+				target, _, err = nomsRemove(target, []string{k})
+			}
+		} else {
+			var v types.Value
+			if v, err = c.applyMergePatch(child(target, k), p, noms); err == nil {
+				target, err = nomsAdd(target, []string{k}, v)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// isObject returns true if v is the noms value of a JSON object.
+func isObject(v types.Value) bool {
+	switch v.(type) {
+	case types.Map, types.Struct:
+		return true
+	}
+	return false
+}
+
+func isPrefix(prefix, toks []string) bool {
+	if len(prefix) > len(toks) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != toks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses the reference token t as an index into a list of length
+// n, which may be one past the end if end is true. "-" refers to the end.
+func arrayIndex(n uint64, t string, end bool) (uint64, error) {
+	max := int64(n) - 1
+	if end {
+		max = int64(n)
+		if t == "-" {
+			return n, nil
+		}
+	}
+	if t == "" || (len(t) > 1 && t[0] == '0') {
+		return 0, fmt.Errorf("invalid array index '%s'", t)
+	}
+	i, err := strconv.ParseUint(t, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index '%s'", t)
+	}
+	if int64(i) > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// nomsGet returns the value within doc at toks.
+func nomsGet(doc types.Value, toks []string) (types.Value, error) {
+	for _, t := range toks {
+		switch c := doc.(type) {
+		case types.Map, types.Struct:
+			v := child(c, t)
+			if v == nil {
+				return nil, fmt.Errorf("no member '%s'", t)
+			}
+			doc = v
+		case types.List:
+			i, err := arrayIndex(c.Len(), t, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c.Get(i)
+		default:
+			return nil, fmt.Errorf("cannot get '%s' of a non-container value", t)
+		}
+	}
+	return doc, nil
+}
+
+// nomsUpdate returns doc with the container at toks[:len(toks)-1] replaced by
+// the result of calling f with it and the last token.
+func nomsUpdate(doc types.Value, toks []string, f func(c types.Value, t string) (types.Value, error)) (types.Value, error) {
+	if len(toks) == 1 {
+		return f(doc, toks[0])
+	}
+	c, err := nomsGet(doc, toks[:1])
+	if err != nil {
+		return nil, err
+	}
+	nc, err := nomsUpdate(c, toks[1:], f)
+	if err != nil {
+		return nil, err
+	}
+	switch d := doc.(type) {
+	case types.Map:
+		return d.Edit().Set(types.String(toks[0]), nc).Map(), nil
+	case types.Struct:
+		return d.Set(toks[0], nc), nil
+	case types.List:
+		i, _ := arrayIndex(d.Len(), toks[0], false)
+		return d.Edit().Set(i, nc).List(), nil
+	}
+	return doc, nil
+}
+
+// nomsAdd returns doc with v added at toks.
+func nomsAdd(doc types.Value, toks []string, v types.Value) (types.Value, error) {
+	if len(toks) == 0 {
+		return v, nil
+	}
+	return nomsUpdate(doc, toks, func(c types.Value, t string) (types.Value, error) {
+		switch c := c.(type) {
+		case types.Map:
+			return c.Edit().Set(types.String(t), v).Map(), nil
+		case types.Struct:
+			if !types.IsValidStructFieldName(t) {
+				return nil, fmt.Errorf("cannot add '%s' to a struct", t)
+			}
+			return c.Set(t, v), nil
+		case types.List:
+			i, err := arrayIndex(c.Len(), t, true)
+			if err != nil {
+				return nil, err
+			}
+			return c.Edit().Insert(i, v).List(), nil
+		}
+		return nil, fmt.Errorf("cannot add '%s' to a non-container value", t)
+	})
+}
+
+// nomsRemove returns doc with the value at toks removed, and the removed value.
+func nomsRemove(doc types.Value, toks []string) (types.Value, types.Value, error) {
+	if len(toks) == 0 {
+		return nil, nil, errors.New("cannot remove the whole value")
+	}
+	var removed types.Value
+	doc, err := nomsUpdate(doc, toks, func(c types.Value, t string) (types.Value, error) {
+		switch c := c.(type) {
+		case types.Map, types.Struct:
+			removed = child(c, t)
+			if removed == nil {
+				return nil, fmt.Errorf("no member '%s'", t)
+			}
+			if m, ok := c.(types.Map); ok {
+				return m.Edit().Remove(types.String(t)).Map(), nil
+			}
+			return c.(types.Struct).Delete(t), nil
+		case types.List:
+			i, err := arrayIndex(c.Len(), t, false)
+			if err != nil {
+				return nil, err
+			}
+			removed = c.Get(i)
+			return c.Edit().Remove(i, i+1).List(), nil
+		}
+		return nil, fmt.Errorf("cannot remove '%s' from a non-container value", t)
+	})
+	return doc, removed, err
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatch(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	const doc = `{"a":1,"b":{"c":"x","d":[1,2,3]},"e~/f":true}`
+
+	tc := []struct {
+		label    string
+		format   PatchFormat
+		patch    string
+		expected string
+		err      string
+	}{
+		// merge patch
+		{"merge empty", MergePatch, `{}`, doc, ""},
+		{"merge set", MergePatch, `{"a":2,"g":null,"b":{"c":null,"h":[]}}`, `{"a":2,"b":{"d":[1,2,3],"h":[]},"e~/f":true}`, ""},
+		{"merge nested", MergePatch, `{"a":{"x":{"y":1,"z":null}}}`, `{"a":{"x":{"y":1}},"b":{"c":"x","d":[1,2,3]},"e~/f":true}`, ""},
+		{"merge replace", MergePatch, `"x"`, `"x"`, ""},
+		{"merge replace with array", MergePatch, `[{"op":"remove","path":"/a"}]`, `[{"op":"remove","path":"/a"}]`, ""},
+		{"merge bad json", MergePatch, `{`, "", "could not parse patch"},
+
+		{"missing format", "", `{}`, "", "patch format is required"},
+		{"unknown format", "xml-patch", `{}`, "", "unknown patch format: xml-patch"},
+
+		// json patch
+		{"empty", JSONPatch, `[]`, doc, ""},
+		{"add member", JSONPatch, `[{"op":"add","path":"/g","value":null}]`, `{"a":1,"b":{"c":"x","d":[1,2,3]},"e~/f":true,"g":null}`, ""},
+		{"add element", JSONPatch, `[{"op":"add","path":"/b/d/1","value":9},{"op":"add","path":"/b/d/-","value":10}]`, `{"a":1,"b":{"c":"x","d":[1,9,2,3,10]},"e~/f":true}`, ""},
+		{"add root", JSONPatch, `[{"op":"add","path":"","value":[]}]`, `[]`, ""},
+		{"add missing parent", JSONPatch, `[{"op":"add","path":"/x/y","value":1}]`, "", "op 0 (add '/x/y'): no member 'x'"},
+		{"add out of range", JSONPatch, `[{"op":"add","path":"/b/d/4","value":1}]`, "", "array index 4 out of range"},
+		{"remove", JSONPatch, `[{"op":"remove","path":"/e~0~1f"},{"op":"remove","path":"/b/d/0"}]`, `{"a":1,"b":{"c":"x","d":[2,3]}}`, ""},
+		{"remove missing", JSONPatch, `[{"op":"remove","path":"/x"}]`, "", "no member 'x'"},
+		{"replace", JSONPatch, `[{"op":"replace","path":"/b/c","value":{"y":1}}]`, `{"a":1,"b":{"c":{"y":1},"d":[1,2,3]},"e~/f":true}`, ""},
+		{"replace missing", JSONPatch, `[{"op":"replace","path":"/x","value":1}]`, "", "no member 'x'"},
+		{"move", JSONPatch, `[{"op":"move","from":"/b/c","path":"/c"}]`, `{"a":1,"b":{"d":[1,2,3]},"c":"x","e~/f":true}`, ""},
+		{"move into child", JSONPatch, `[{"op":"move","from":"/b","path":"/b/x"}]`, "", "cannot move a value into one of its children"},
+		{"copy", JSONPatch, `[{"op":"copy","from":"/b/d","path":"/d"},{"op":"add","path":"/d/-","value":4}]`, `{"a":1,"b":{"c":"x","d":[1,2,3]},"d":[1,2,3,4],"e~/f":true}`, ""},
+		{"test", JSONPatch, `[{"op":"test","path":"/a","value":1.0},{"op":"test","path":"/b","value":{"d":[1,2,3],"c":"x"}},{"op":"replace","path":"/a","value":2}]`, `{"a":2,"b":{"c":"x","d":[1,2,3]},"e~/f":true}`, ""},
+		{"test fails", JSONPatch, `[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/b/c","value":"y"}]`, "", `test operation 1 failed: value at '/b/c' is "x", expected "y"`},
+		{"test missing", JSONPatch, `[{"op":"test","path":"/x","value":null}]`, "", `test operation 0 failed: no value at '/x', expected null`},
+		{"missing op", JSONPatch, `[{"path":"/a"}]`, "", "op field is required"},
+		{"unknown op", JSONPatch, `[{"op":"frob","path":"/a","value":1}]`, "", "unknown op: frob"},
+		{"missing value", JSONPatch, `[{"op":"add","path":"/a"}]`, "", "op 0: value field is required"},
+		{"bad pointer", JSONPatch, `[{"op":"remove","path":"a"}]`, "", "invalid JSON pointer"},
+		{"bad json", JSONPatch, `[`, "", "could not parse patch"},
+		{"not an array", JSONPatch, `{"a":null}`, "", "could not parse patch"},
+	}
+
+	for _, t := range tc {
+		tx := db.NewTransaction()
+		assert.NoError(tx.Put("doc", []byte(doc)))
+		err := tx.Patch("doc", t.format, []byte(t.patch))
+		if t.err != "" {
+			assert.Error(err, t.label)
+			if err != nil {
+				assert.Contains(err.Error(), t.err, t.label)
+			}
+			t.expected = doc
+		} else {
+			assert.NoError(err, t.label)
+		}
+		actual, err := tx.Get("doc")
+		assert.NoError(err, t.label)
+		assert.JSONEq(t.expected, string(actual), t.label)
+		assert.NoError(tx.Close())
+	}
+
+	tx := db.NewTransaction()
+	err := tx.Patch("doc", JSONPatch, []byte(`[{"op":"test","path":"/a","value":2}]`))
+	assert.Equal("could not Patch 'doc': key does not exist", err.Error())
+	assert.NoError(tx.Put("doc", []byte(doc)))
+	err = tx.Patch("doc", JSONPatch, []byte(`[{"op":"test","path":"/a","value":2}]`))
+	var testErr PatchTestError
+	assert.True(errors.As(err, &testErr))
+	assert.Equal(PatchTestError{Op: 0, Path: "/a", Expected: []byte("2"), Actual: []byte("1")}, testErr)
+	assert.NoError(tx.Close())
+	assert.Equal(ErrClosed, tx.Patch("doc", MergePatch, []byte(`{}`)))
+
+	// Blobs can be tested and replaced.
+	tx = db.NewTransaction()
+	_, err = tx.PutBlob("blob", strings.NewReader("data"))
+	assert.NoError(err)
+	err = tx.Patch("blob", JSONPatch, []byte(`[{"op":"test","path":"","value":"data"}]`))
+	assert.True(errors.As(err, &testErr))
+	assert.Nil(testErr.Actual)
+	assert.NoError(tx.Patch("blob", JSONPatch, []byte(`[{"op":"replace","path":"","value":{"a":1}}]`)))
+	assert.NoError(tx.Patch("blob", MergePatch, []byte(`{"b":2}`)))
+	actual, err := tx.Get("blob")
+	assert.NoError(err)
+	assert.JSONEq(`{"a":1,"b":2}`, string(actual))
+	assert.NoError(tx.Close())
+}
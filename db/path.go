@@ -0,0 +1,96 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+var (
+	// ErrNoSuchKey is returned when there is no entry at a key that must exist.
+	ErrNoSuchKey = errors.New("no such key")
+	// ErrNoSuchPath is returned from GetPath when the entry at the key has no
+	// value at the path.
+	ErrNoSuchPath = errors.New("no such path")
+)
+
+// GetPath returns the JSON encoded value at the JSON Pointer path within the
+// value at the given id. Only the selected value is encoded. It returns an
+// error wrapping ErrNoSuchKey if there is no entry at id, and ErrNoSuchPath if
+// the entry has no value at path.
+func (tx *Transaction) GetPath(id, path string) ([]byte, error) {
+	defer tx.rlock()()
+
+	if tx.closed {
+		return nil, ErrClosed
+	}
+	value := tx.me.Get(types.String(id))
+	if value == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, id)
+	}
+	sub, err := evalJSONPointer(value, path)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchPath, path)
+	}
+	return tx.db.codec.toJSON(sub)
+}
+
+// parseJSONPointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens.
+// The empty pointer refers to the whole value and has no tokens.
+func parseJSONPointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer '%s': must be empty or start with '/'", ptr)
+	}
+	toks := strings.Split(ptr[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return toks, nil
+}
+
+// evalJSONPointer returns the value within v at the JSON Pointer ptr. It navigates
+// maps by key, structs by field name and lists by index. It returns nil if there is
+// no value at ptr.
+func evalJSONPointer(v types.Value, ptr string) (types.Value, error) {
+	toks, err := parseJSONPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range toks {
+		v = child(v, t)
+		if v == nil {
+			return nil, nil
+		}
+	}
+	return v, nil
+}
+
+// child returns the child of v named by the reference token t, or nil if there is none.
+func child(v types.Value, t string) types.Value {
+	switch v := v.(type) {
+	case types.Map:
+		return v.Get(types.String(t))
+	case types.Struct:
+		c, ok := v.MaybeGet(t)
+		if !ok {
+			return nil
+		}
+		return c
+	case types.List:
+		i, err := strconv.ParseUint(t, 10, 64)
+		if err != nil || i >= v.Len() {
+			return nil
+		}
+		return v.Get(i)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPath(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	defer tx.Close()
+	assert.NoError(tx.Put("doc", []byte(`{"a":{"b":[1,{"c":"x"},null]},"d/e":true,"f~g":"h"}`)))
+
+	tc := []struct {
+		key      string
+		path     string
+		expected string
+		err      error
+	}{
+		{"doc", "", `{"a":{"b":[1,{"c":"x"},null]},"d/e":true,"f~g":"h"}`, nil},
+		{"doc", "/a/b/1", `{"c":"x"}`, nil},
+		{"doc", "/a/b/1/c", `"x"`, nil},
+		{"doc", "/a/b/0", `1`, nil},
+		{"doc", "/a/b/2", `null`, nil},
+		{"doc", "/d~1e", `true`, nil},
+		{"doc", "/f~0g", `"h"`, nil},
+		{"doc", "/a/b/3", ``, ErrNoSuchPath},
+		{"doc", "/a/x", ``, ErrNoSuchPath},
+		{"doc", "/a/b/1/c/d", ``, ErrNoSuchPath},
+		{"nope", "/a", ``, ErrNoSuchKey},
+	}
+
+	for _, t := range tc {
+		actual, err := tx.GetPath(t.key, t.path)
+		if t.err != nil {
+			assert.True(errors.Is(err, t.err), "%s %s: %v", t.key, t.path, err)
+			assert.Nil(actual)
+			continue
+		}
+		assert.NoError(err, "%s %s", t.key, t.path)
+		assert.JSONEq(t.expected, string(actual), "%s %s", t.key, t.path)
+	}
+
+	_, err := tx.GetPath("doc", "a")
+	assert.EqualError(err, "invalid JSON pointer 'a': must be empty or start with '/'")
+}
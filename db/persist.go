@@ -0,0 +1,57 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+)
+
+// Persist copies the database, including its history, client ID and local
+// keyspace, into a new on-disk database in dir. It is meant for databases that
+// were loaded in memory. The copy is encrypted with the DB's key, if any. The
+// DB itself is unchanged, and commits wait until the copy is complete.
+func (db *DB) Persist(dir string) error {
+	done, err := db.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	dl, err := lockDir(dir, lockAll)
+	if err != nil {
+		return err
+	}
+	defer dl.unlock()
+
+	sp, err := spec.ForDatabase(dir)
+	if err != nil {
+		return err
+	}
+	sink, err := openNoms(sp, db.key)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+	if !sink.Datasets().Empty() {
+		return fmt.Errorf("could not persist to %s: a database already exists there", dir)
+	}
+
+	defer db.lock()()
+	return copyDatasets(db.noms, sink)
+}
+
+// copyDatasets copies every dataset of src, with everything it references, to
+// sink.
+func copyDatasets(src, sink datas.Database) (err error) {
+	src.Datasets().IterAll(func(k, v types.Value) {
+		if err != nil {
+			return
+		}
+		ref := v.(types.Ref)
+		datas.Pull(src, sink, ref, nil)
+		_, err = sink.SetHead(sink.GetDataset(string(k.(types.String))), ref)
+	})
+	return err
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestPersist(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	mem, err := Load(sp)
+	assert.NoError(err)
+
+	tx := mem.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	assert.NoError(tx.Local().Put("draft", []byte(`1`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	assert.NoError(mem.Persist(dir))
+	assert.Regexp("a database already exists there", mem.Persist(dir).Error())
+
+	db := reloadDB(assert, dir)
+	defer db.Close()
+	assert.Equal(mem.HeadHash(), db.HeadHash())
+	assert.Equal(mem.ClientID(), db.ClientID())
+	tx = db.NewTransaction()
+	defer tx.Close()
+	v, err := tx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"bar"`, string(v))
+	v, err = tx.Local().Get("draft")
+	assert.NoError(err)
+	assert.Equal(`1`, string(v))
+
+	// The in-memory DB is still usable.
+	tx = mem.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"baz"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+}
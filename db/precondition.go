@@ -0,0 +1,120 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// Precondition is an expectation about the entry at a key that must hold for
+// a conditional write to be applied. At most one of the fields may be set. The
+// zero Precondition always holds.
+type Precondition struct {
+	// Absent requires that there is no entry at the key.
+	Absent bool `json:"absent,omitempty"`
+	// Present requires that there is an entry at the key.
+	Present bool `json:"present,omitempty"`
+	// Equals requires that the entry at the key has this JSON value.
+	Equals json.RawMessage `json:"equals,omitempty"`
+}
+
+// PreconditionError is returned from conditional writes when their
+// Precondition does not hold. Nothing is written in that case.
+type PreconditionError struct {
+	Key    string
+	Reason string
+}
+
+func (e PreconditionError) Error() string {
+	return fmt.Sprintf("precondition failed for '%s': %s", e.Key, e.Reason)
+}
+
+// parse validates p and returns the value it expects, if any.
+func (p Precondition) parse(c jsonCodec, noms types.ValueReadWriter) (types.Value, error) {
+	n := 0
+	for _, set := range []bool{p.Absent, p.Present, len(p.Equals) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, errors.New("at most one of absent, present and equals may be set")
+	}
+	if len(p.Equals) == 0 {
+		return nil, nil
+	}
+	v, err := c.fromJSON(p.Equals, noms)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse precondition value '%s': %w", p.Equals, err)
+	}
+	return v, nil
+}
+
+// check returns a PreconditionError if p, with the parsed expected value, does
+// not hold for id. The caller must hold the lock.
+func (tx *Transaction) check(id string, p Precondition, expected types.Value) error {
+	current := tx.me.Get(types.String(id))
+	switch {
+	case p.Absent && current != nil:
+		return PreconditionError{id, "key exists"}
+	case p.Present && current == nil:
+		return PreconditionError{id, "key does not exist"}
+	case expected != nil && current == nil:
+		return PreconditionError{id, "key does not exist"}
+	case expected != nil && !expected.Equals(current):
+		return PreconditionError{id, "value does not match"}
+	}
+	return nil
+}
+
+// PutIf is like Put but only writes if p holds for the current entry at id.
+// Otherwise it returns a PreconditionError.
+func (tx *Transaction) PutIf(id string, json []byte, p Precondition) error {
+	if tx.Closed() {
+		return ErrClosed
+	}
+
+	value, err := tx.db.codec.fromJSON(json, tx.db.noms)
+	if err != nil {
+		return fmt.Errorf("could not Put '%s'='%s': %w", id, json, err)
+	}
+	expected, err := p.parse(tx.db.codec, tx.db.noms)
+	if err != nil {
+		return err
+	}
+
+	defer tx.lock()()
+
+	if tx.closed {
+		return ErrClosed
+	}
+	if err := tx.check(id, p, expected); err != nil {
+		return err
+	}
+	return tx.set(id, value)
+}
+
+// DelIf is like Del but only deletes if p holds for the current entry at id.
+// Otherwise it returns a PreconditionError.
+func (tx *Transaction) DelIf(id string, p Precondition) (bool, error) {
+	if tx.Closed() {
+		return false, ErrClosed
+	}
+
+	expected, err := p.parse(tx.db.codec, tx.db.noms)
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.lock()()
+
+	if tx.closed {
+		return false, ErrClosed
+	}
+	if err := tx.check(id, p, expected); err != nil {
+		return false, err
+	}
+	return tx.remove(id)
+}
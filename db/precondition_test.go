@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	db, err := Load(sp)
+	assert.NoError(err)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"x"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	tc := []struct {
+		label  string
+		del    bool
+		key    string
+		value  string
+		p      Precondition
+		reason string
+		err    string
+		data   string
+	}{
+		{"put unconditional", false, "foo", `2`, Precondition{}, "", "", `map {"foo": 2}`},
+		{"put absent ok", false, "bar", `2`, Precondition{Absent: true}, "", "", `map {"bar": 2, "foo": "x"}`},
+		{"put absent fail", false, "foo", `2`, Precondition{Absent: true}, "key exists", "", `map {"foo": "x"}`},
+		{"put present ok", false, "foo", `2`, Precondition{Present: true}, "", "", `map {"foo": 2}`},
+		{"put present fail", false, "bar", `2`, Precondition{Present: true}, "key does not exist", "", `map {"foo": "x"}`},
+		{"put equals ok", false, "foo", `2`, Precondition{Equals: []byte(`"x"`)}, "", "", `map {"foo": 2}`},
+		{"put equals fail", false, "foo", `2`, Precondition{Equals: []byte(`"y"`)}, "value does not match", "", `map {"foo": "x"}`},
+		{"put equals missing", false, "bar", `2`, Precondition{Equals: []byte(`"x"`)}, "key does not exist", "", `map {"foo": "x"}`},
+		{"put equals bad json", false, "foo", `2`, Precondition{Equals: []byte(`{`)}, "", "could not parse precondition value", `map {"foo": "x"}`},
+		{"put too many", false, "foo", `2`, Precondition{Absent: true, Present: true}, "", "at most one of", `map {"foo": "x"}`},
+		{"del present ok", true, "foo", ``, Precondition{Present: true}, "", "", `map {}`},
+		{"del present fail", true, "bar", ``, Precondition{Present: true}, "key does not exist", "", `map {"foo": "x"}`},
+		{"del absent", true, "bar", ``, Precondition{Absent: true}, "", "", `map {"foo": "x"}`},
+		{"del equals ok", true, "foo", ``, Precondition{Equals: []byte(`"x"`)}, "", "", `map {}`},
+		{"del equals fail", true, "foo", ``, Precondition{Equals: []byte(`1`)}, "value does not match", "", `map {"foo": "x"}`},
+	}
+
+	for _, t := range tc {
+		tx := db.NewTransaction()
+		if t.del {
+			_, err = tx.DelIf(t.key, t.p)
+		} else {
+			err = tx.PutIf(t.key, []byte(t.value), t.p)
+		}
+		var pe PreconditionError
+		if t.reason != "" {
+			assert.True(errors.As(err, &pe), t.label)
+			assert.Equal(PreconditionError{t.key, t.reason}, pe, t.label)
+		} else if t.err != "" {
+			assert.False(errors.As(err, &pe), t.label)
+			assert.Contains(err.Error(), t.err, t.label)
+		} else {
+			assert.NoError(err, t.label)
+		}
+		// Commit regardless to check that failed writes left the data alone.
+		_, err = tx.Commit(log.Default())
+		assert.NoError(err, t.label)
+		assertDataEquals(assert, db, t.data)
+
+		tx = db.NewTransaction()
+		_, err = tx.Batch([]BatchOp{{Op: BatchOpDel, Key: "bar"}, {Op: BatchOpPut, Key: "foo", Value: []byte(`"x"`)}})
+		assert.NoError(err)
+		_, err = tx.Commit(log.Default())
+		assert.NoError(err)
+	}
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// Predicate filters the values returned by a scan. A predicate is either a
+// test of the value at Path or a combination of predicates with And or Or.
+//
+// A test has Exists, Eq, or any of Lt, Lte, Gt and Gte, which must all hold.
+// Eq compares JSON values, numbers by value. The range operators compare
+// numbers with numbers and strings with strings; values of other types don't
+// match. Exists tests whether there is a value at Path.
+type Predicate struct {
+	// Path is a JSON Pointer into the value. The empty path is the whole value.
+	Path   string          `json:"path,omitempty"`
+	Exists *bool           `json:"exists,omitempty"`
+	Eq     json.RawMessage `json:"eq,omitempty"`
+	Lt     json.RawMessage `json:"lt,omitempty"`
+	Lte    json.RawMessage `json:"lte,omitempty"`
+	Gt     json.RawMessage `json:"gt,omitempty"`
+	Gte    json.RawMessage `json:"gte,omitempty"`
+
+	And []Predicate `json:"and,omitempty"`
+	Or  []Predicate `json:"or,omitempty"`
+}
+
+// scanFilter returns true for the values that a scan should return. A nil
+// scanFilter returns all values.
+type scanFilter func(v types.Value) bool
+
+func (f scanFilter) match(v types.Value) bool {
+	return f == nil || f(v)
+}
+
+// compile returns the scanFilter for p, which may be nil.
+func (c jsonCodec) compile(p *Predicate) (scanFilter, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return c.compilePredicate(*p)
+}
+
+func (c jsonCodec) compilePredicate(p Predicate) (scanFilter, error) {
+	isTest := p.Path != "" || p.Exists != nil || p.Eq != nil || p.Lt != nil || p.Lte != nil || p.Gt != nil || p.Gte != nil
+	n := 0
+	for _, b := range []bool{isTest, p.And != nil, p.Or != nil} {
+		if b {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, errors.New("invalid predicate: must have a test, and or or")
+	}
+	if n > 1 {
+		return nil, errors.New("invalid predicate: a test, and and or can't be combined")
+	}
+
+	if p.And != nil || p.Or != nil {
+		ps := p.And
+		if p.Or != nil {
+			ps = p.Or
+		}
+		fs := make([]scanFilter, len(ps))
+		for i, sp := range ps {
+			f, err := c.compilePredicate(sp)
+			if err != nil {
+				return nil, err
+			}
+			fs[i] = f
+		}
+		all := p.And != nil
+		return func(v types.Value) bool {
+			for _, f := range fs {
+				if f(v) != all {
+					return !all
+				}
+			}
+			return all
+		}, nil
+	}
+	return c.compileTest(p)
+}
+
+type rangeTest struct {
+	operand interface{}
+	ok      func(cmp int) bool
+}
+
+func (c jsonCodec) compileTest(p Predicate) (scanFilter, error) {
+	if _, err := parseJSONPointer(p.Path); err != nil {
+		return nil, fmt.Errorf("invalid predicate: %w", err)
+	}
+
+	var ranges []rangeTest
+	for _, r := range []struct {
+		name    string
+		operand json.RawMessage
+		ok      func(cmp int) bool
+	}{
+		{"lt", p.Lt, func(cmp int) bool { return cmp < 0 }},
+		{"lte", p.Lte, func(cmp int) bool { return cmp <= 0 }},
+		{"gt", p.Gt, func(cmp int) bool { return cmp > 0 }},
+		{"gte", p.Gte, func(cmp int) bool { return cmp >= 0 }},
+	} {
+		if r.operand == nil {
+			continue
+		}
+		o, err := decodeJSON(r.operand)
+		if err != nil {
+			return nil, fmt.Errorf("invalid predicate: could not parse %s operand: %w", r.name, err)
+		}
+		switch o.(type) {
+		case json.Number, string:
+		default:
+			return nil, fmt.Errorf("invalid predicate: %s operand must be a number or a string", r.name)
+		}
+		ranges = append(ranges, rangeTest{o, r.ok})
+	}
+
+	n := len(ranges)
+	if p.Exists != nil {
+		n++
+	}
+	if p.Eq != nil {
+		n++
+	}
+	switch {
+	case n == 0:
+		return nil, errors.New("invalid predicate: a test must have exists, eq or a range")
+	case n > 1 && len(ranges) < n:
+		return nil, errors.New("invalid predicate: exists and eq can't be combined with other operators")
+	}
+
+	if p.Exists != nil {
+		exists := *p.Exists
+		return func(v types.Value) bool {
+			sub, _ := evalJSONPointer(v, p.Path)
+			return (sub != nil) == exists
+		}, nil
+	}
+
+	var eq interface{}
+	if p.Eq != nil {
+		var err error
+		if eq, err = decodeJSON(p.Eq); err != nil {
+			return nil, fmt.Errorf("invalid predicate: could not parse eq operand: %w", err)
+		}
+	}
+	return func(v types.Value) bool {
+		sub, _ := evalJSONPointer(v, p.Path)
+		if sub == nil {
+			return false
+		}
+		js, err := c.toJSON(sub)
+		if err != nil {
+			return false
+		}
+		actual, err := decodeJSON(js)
+		if err != nil {
+			return false
+		}
+		if p.Eq != nil {
+			return jsonEqual(actual, eq)
+		}
+		for _, r := range ranges {
+			cmp, ok := jsonCompare(actual, r.operand)
+			if !ok || !r.ok(cmp) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// jsonCompare compares the decoded JSON values a and b if they are both
+// numbers or both strings.
+func jsonCompare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		ar, aok := new(big.Rat).SetString(string(a))
+		br, bok := new(big.Rat).SetString(string(b))
+		if !aok || !bok {
+			return 0, false
+		}
+		return ar.Cmp(br), true
+	}
+	return 0, false
+}
+
+// jsonEqual returns true if the decoded JSON values a and b are equal. Numbers
+// are compared by value, so 1 and 1.0 are equal.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := b[k]
+			if !ok || !jsonEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		ar, aok := new(big.Rat).SetString(string(a))
+		br, bok := new(big.Rat).SetString(string(b))
+		if !aok || !bok {
+			return a == b
+		}
+		return ar.Cmp(br) == 0
+	}
+	return a == b
+}
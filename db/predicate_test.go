@@ -0,0 +1,77 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanWhere(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	defer tx.Close()
+	for k, v := range map[string]string{
+		"a": `{"n":1,"s":"x","t":[true]}`,
+		"b": `{"n":2.5,"s":"y"}`,
+		"c": `{"n":10,"s":"z","t":null}`,
+		"d": `{"n":"10"}`,
+		"e": `7`,
+	} {
+		assert.NoError(tx.Put(k, []byte(v)))
+	}
+
+	tc := []struct {
+		where    string
+		limit    int
+		expected []string
+		err      string
+	}{
+		{`{"path":"/n","eq":1}`, 0, []string{"a"}, ""},
+		{`{"path":"/n","eq":1.0}`, 0, []string{"a"}, ""},
+		{`{"path":"/n","eq":"10"}`, 0, []string{"d"}, ""},
+		{`{"path":"/n","gt":1,"lte":10}`, 0, []string{"b", "c"}, ""},
+		{`{"path":"/n","lt":"2"}`, 0, []string{"d"}, ""},
+		{`{"path":"/s","gte":"y"}`, 0, []string{"b", "c"}, ""},
+		{`{"path":"/t","exists":true}`, 0, []string{"a", "c"}, ""},
+		{`{"path":"/t","exists":false}`, 0, []string{"b", "d", "e"}, ""},
+		{`{"path":"/t/0","eq":true}`, 0, []string{"a"}, ""},
+		{`{"eq":7}`, 0, []string{"e"}, ""},
+		{`{"and":[{"path":"/n","gte":2},{"path":"/s","lt":"z"}]}`, 0, []string{"b"}, ""},
+		{`{"or":[{"path":"/n","eq":1},{"eq":7}]}`, 0, []string{"a", "e"}, ""},
+		{`{"path":"/n","exists":true}`, 2, []string{"a", "b"}, ""},
+
+		{`{}`, 0, nil, "invalid predicate: must have a test, and or or"},
+		{`{"path":"/n","eq":1,"or":[]}`, 0, nil, "invalid predicate: a test, and and or can't be combined"},
+		{`{"path":"/n"}`, 0, nil, "invalid predicate: a test must have exists, eq or a range"},
+		{`{"path":"/n","eq":1,"lt":2}`, 0, nil, "invalid predicate: exists and eq can't be combined with other operators"},
+		{`{"path":"/n","lt":true}`, 0, nil, "invalid predicate: lt operand must be a number or a string"},
+		{`{"path":"n","eq":1}`, 0, nil, "invalid predicate: invalid JSON pointer 'n': must be empty or start with '/'"},
+		{`{"and":[{"path":"/n"}]}`, 0, nil, "invalid predicate: a test must have exists, eq or a range"},
+	}
+
+	for _, t := range tc {
+		var p Predicate
+		assert.NoError(json.Unmarshal([]byte(t.where), &p), t.where)
+		opts := ScanOptions{Where: &p, Limit: t.limit, KeysOnly: true}
+		items, err := tx.Scan(opts)
+		n, cerr := tx.Count(ScanOptions{Where: &p})
+		if t.err != "" {
+			assert.EqualError(err, t.err, t.where)
+			assert.EqualError(cerr, t.err, t.where)
+			continue
+		}
+		assert.NoError(err, t.where)
+		assert.NoError(cerr, t.where)
+		keys := []string{}
+		for _, it := range items {
+			keys = append(keys, it.Key)
+		}
+		assert.Equal(t.expected, keys, t.where)
+		if t.limit == 0 {
+			assert.Equal(len(t.expected), n, t.where)
+		}
+	}
+}
@@ -33,7 +33,8 @@ type puller interface {
 }
 
 type defaultPuller struct {
-	c *http.Client
+	c     *http.Client
+	codec jsonCodec
 }
 
 func (d *defaultPuller) client() *http.Client {
@@ -54,7 +55,7 @@ func (d *defaultPuller) Pull(noms types.ValueReadWriter, baseState Commit, url s
 		ClientViewAuth: clientViewAuth,
 		ClientID:       clientID,
 		BaseStateID:    baseState.Meta.Snapshot.ServerStateID,
-		Checksum:       baseMap.Checksum(),
+		Checksum:       baseState.serverChecksum(),
 	})
 	if err != nil {
 		return Commit{}, servetypes.ClientViewInfo{}, errors.New("could not marshal PullRequest")
@@ -94,6 +95,14 @@ func (d *defaultPuller) Pull(noms types.ValueReadWriter, baseState Commit, url s
 	if pullResp.LastMutationID < baseState.Meta.Snapshot.LastMutationID {
 		return Commit{}, pullResp.ClientViewInfo, fmt.Errorf("client view lastMutationID %d is < previous lastMutationID %d; ignoring", pullResp.LastMutationID, baseState.Meta.Snapshot.LastMutationID)
 	}
+	for i, op := range pullResp.Patch {
+		if len(op.Value) == 0 {
+			continue
+		}
+		if pullResp.Patch[i].Value, err = d.codec.importJSON(op.Value); err != nil {
+			return Commit{}, pullResp.ClientViewInfo, errors.Wrapf(err, "couldn't decode value of patch op %d", i)
+		}
+	}
 	patchedMap, err := kv.ApplyPatch(noms, baseMap, pullResp.Patch)
 	if err != nil {
 		return Commit{}, pullResp.ClientViewInfo, errors.Wrap(err, "couldn't apply patch")
@@ -102,9 +111,28 @@ func (d *defaultPuller) Pull(noms types.ValueReadWriter, baseState Commit, url s
 	if err != nil {
 		return Commit{}, pullResp.ClientViewInfo, errors.Wrapf(err, "response checksum malformed: %s", pullResp.Checksum)
 	}
-	if patchedMap.Checksum() != expectedChecksum.String() {
-		return Commit{}, pullResp.ClientViewInfo, fmt.Errorf("checksum mismatch! Expected %s, got %s", expectedChecksum, patchedMap.Checksum())
+	// In lossless integer mode values with large integers are stored
+	// differently than on the server, and so the server's checksum is only
+	// comparable with the checksum of the data as the server stores it.
+	actualChecksum := patchedMap.Checksum()
+	serverChecksum := ""
+	if actualChecksum != expectedChecksum.String() && d.codec.losslessInts {
+		if actualChecksum, err = d.codec.serverChecksum(patchedMap, noms); err != nil {
+			return Commit{}, pullResp.ClientViewInfo, errors.Wrap(err, "couldn't compute checksum")
+		}
+		serverChecksum = actualChecksum
+	}
+	if actualChecksum != expectedChecksum.String() {
+		return Commit{}, pullResp.ClientViewInfo, fmt.Errorf("checksum mismatch! Expected %s, got %s", expectedChecksum, actualChecksum)
+	}
+	indexes, err := baseState.Indexes(noms)
+	if err != nil {
+		return Commit{}, pullResp.ClientViewInfo, err
+	}
+	indexes = updateIndexes(noms, indexes, baseMap.NomsMap(), patchedMap.NomsMap())
+	newSnapshot := makeSnapshot(noms, baseState.Ref(), pullResp.StateID, noms.WriteValue(patchedMap.NomsMap()), patchedMap.NomsChecksum(), pullResp.LastMutationID, writeIndexes(noms, indexes))
+	if serverChecksum != "" {
+		newSnapshot = withServerChecksum(noms, newSnapshot, serverChecksum)
 	}
-	newSnapshot := makeSnapshot(noms, baseState.Ref(), pullResp.StateID, noms.WriteValue(patchedMap.NomsMap()), patchedMap.NomsChecksum(), pullResp.LastMutationID)
 	return newSnapshot, pullResp.ClientViewInfo, nil
 }
@@ -295,7 +295,7 @@ func TestPull(t *testing.T) {
 			}
 		}
 		m := ed.Build()
-		g := makeGenesis(db.noms, t.initialStateID, db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 1 /*lastMutationID*/)
+		g := makeGenesis(db.noms, t.initialStateID, db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 1 /*lastMutationID*/, types.Ref{})
 		_, err := db.noms.SetHead(db.noms.GetDataset(MASTER_DATASET), db.noms.WriteValue(g.NomsStruct))
 		assert.NoError(err)
 		err = db.Reload()
@@ -50,7 +50,8 @@ type pusher interface {
 }
 
 type defaultPusher struct {
-	c *http.Client
+	c     *http.Client
+	codec jsonCodec
 }
 
 func (d *defaultPusher) client() *http.Client {
@@ -76,11 +77,11 @@ func (d *defaultPusher) Push(pending []Local, url string, dataLayerAuth string,
 	var req BatchPushRequest
 	req.ClientID = obfuscatedClientID
 	for _, p := range pending {
-		var args bytes.Buffer
-		if err := nomsjson.ToJSON(p.Args, &args); err != nil {
+		args, err := d.codec.toJSON(p.Args)
+		if err != nil {
 			return withErrMsg(err.Error())
 		}
-		req.Mutations = append(req.Mutations, Mutation{p.MutationID, p.Name, args.Bytes()})
+		req.Mutations = append(req.Mutations, Mutation{p.MutationID, p.Name, args})
 	}
 	reqBody, err := json.Marshal(req)
 	if err != nil {
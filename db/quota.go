@@ -0,0 +1,150 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// QuotaError is returned from Commit when committing would make the database
+// exceed the quota set with Options.Quota. Nothing is committed.
+type QuotaError struct {
+	// Quota is the quota in bytes.
+	Quota int64
+	// Usage is the size of the database on disk in bytes.
+	Usage int64
+	// Size is the estimated size in bytes of the data the commit writes.
+	Size int64
+}
+
+func (e QuotaError) Error() string {
+	return fmt.Sprintf("commit of about %d bytes would exceed the quota of %d bytes, of which %d are used", e.Size, e.Quota, e.Usage)
+}
+
+// checkQuota returns a QuotaError if committing tx would make the database
+// exceed its quota, and otherwise the estimated size of the commit, which is
+// estimated from the values it writes. Commits that only delete are always
+// allowed, although the space isn't reclaimed on disk. Replays are allowed
+// too, so that a full database can still sync, and so is the data that syncs
+// pull.
+func (tx *Transaction) checkQuota() (int64, error) {
+	if tx.db.quota <= 0 || tx.db.dir == "" || tx.IsReplay() {
+		return 0, nil
+	}
+	size := tx.synced.edits.size() + tx.local.edits.size()
+	if size == 0 {
+		return 0, nil
+	}
+	usage, cached, err := tx.db.diskUsage()
+	if err != nil {
+		return 0, err
+	}
+	if usage+size > tx.db.quota && cached {
+		// The cached usage adds up estimates, so measure before failing.
+		if usage, err = tx.db.measureDiskUsage(); err != nil {
+			return 0, err
+		}
+	}
+	if usage+size > tx.db.quota {
+		return 0, QuotaError{Quota: tx.db.quota, Usage: usage, Size: size}
+	}
+	return size, nil
+}
+
+// usageCache is the disk usage of the database as of a version of its
+// manifest, so that commits don't have to walk the directory.
+type usageCache struct {
+	usage    int64
+	manifest []byte // nil if the usage isn't known.
+}
+
+// diskUsage returns the disk usage of the database and whether it was cached.
+// The cache is used while the manifest is unchanged, which is until someone
+// else than the DB's own commits writes the database.
+func (db *DB) diskUsage() (int64, bool, error) {
+	m, err := readManifest(db.dir)
+	if err != nil {
+		return 0, false, err
+	}
+	db.mu.Lock()
+	c := db.usage
+	db.mu.Unlock()
+	if m != nil && c.manifest != nil && bytes.Equal(m, c.manifest) {
+		return c.usage, true, nil
+	}
+	usage, err := db.measureDiskUsage()
+	return usage, false, err
+}
+
+// measureDiskUsage walks the directory of the database to find its disk
+// usage, and caches it.
+func (db *DB) measureDiskUsage() (int64, error) {
+	m, err := readManifest(db.dir)
+	if err != nil {
+		return 0, err
+	}
+	usage, err := diskUsage(db.dir)
+	if err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	db.usage = usageCache{usage, m}
+	db.mu.Unlock()
+	return usage, nil
+}
+
+// addUsage adds size, the estimated size of a commit that the DB just made,
+// to the cached disk usage.
+func (db *DB) addUsage(size int64) {
+	if size == 0 {
+		return
+	}
+	m, err := readManifest(db.dir)
+	defer db.lock()()
+	if err != nil || m == nil || db.usage.manifest == nil {
+		db.usage = usageCache{}
+		return
+	}
+	db.usage = usageCache{db.usage.usage + size, m}
+}
+
+// size returns the approximate number of bytes the keys and values set in e
+// take when stored.
+func (e *edits) size() int64 {
+	var n int64
+	if e == nil {
+		return n
+	}
+	for k, v := range e.values {
+		if v != nil {
+			n += int64(len(k)) + valueSize(v)
+		}
+	}
+	return n
+}
+
+// valueSize returns the approximate number of bytes v takes when stored.
+func valueSize(v types.Value) int64 {
+	if b, ok := v.(types.Blob); ok {
+		return int64(b.Len())
+	}
+	return int64(len(types.EncodeValue(v).Data()))
+}
+
+// diskUsage returns the total size of the files in dir.
+func diskUsage(dir string) (int64, error) {
+	var n int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n, err
+}
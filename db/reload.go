@@ -0,0 +1,101 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+
+	"roci.dev/diff-server/util/log"
+)
+
+// manifestFileName is the name of the file in which noms records the root of
+// an on-disk database. Every commit, also by other processes, rewrites it.
+const manifestFileName = "manifest"
+
+// SetReloadListener sets the func that is called, from a background goroutine,
+// when the DB reloads because another process changed the head. Reloading is
+// enabled with Options.ReloadInterval. Pass nil to remove the listener.
+func (db *DB) SetReloadListener(f func(oldHead, newHead hash.Hash)) {
+	defer db.lock()()
+	db.reloadListener = f
+}
+
+// readManifest returns the contents of the manifest of the database in dir, or
+// nil if there is none. Noms rewrites the manifest with a new lock hash on every
+// commit, so its contents change whenever the database does, even when its
+// modification time and size don't.
+func readManifest(dir string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// startReloader polls the manifest of the database in dir every interval and
+// reloads the DB when it changes, until Close.
+func (db *DB) startReloader(dir string, interval time.Duration) {
+	db.stopReload = make(chan struct{})
+	last, _ := readManifest(dir)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-db.stopReload:
+				return
+			case <-t.C:
+			}
+			m, err := readManifest(dir)
+			if err != nil || m == nil || bytes.Equal(m, last) {
+				continue
+			}
+			last = m
+			db.reloadChanged()
+		}
+	}()
+}
+
+// reloadChanged reloads the DB and notifies the reload listener if the head
+// changed. The listener is called after the reload has ended, so that it can
+// close the DB. Panics, for example from noms reading a database that another
+// process is writing, are logged so that polling goes on.
+func (db *DB) reloadChanged() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Default().Error().Stack().Msgf("Reloading the database panicked with: %v", r)
+		}
+	}()
+
+	oldHead, newHead, ok := db.reloadHeads()
+	if !ok || newHead == oldHead {
+		return
+	}
+	db.mu.Lock()
+	f := db.reloadListener
+	db.mu.Unlock()
+	if f != nil {
+		f(oldHead, newHead)
+	}
+}
+
+// reloadHeads reloads the DB and returns its heads before and after, or false
+// if it could not reload.
+func (db *DB) reloadHeads() (oldHead, newHead hash.Hash, ok bool) {
+	done, err := db.beginOp()
+	if err != nil {
+		return
+	}
+	defer done()
+
+	oldHead = db.HeadHash()
+	if err := db.Reload(); err != nil {
+		log.Default().Err(err).Msg("Could not reload database")
+		return
+	}
+	return oldHead, db.HeadHash(), true
+}
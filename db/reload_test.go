@@ -0,0 +1,173 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	load := func(opts Options) *DB {
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+		db, err := LoadWithOptions(sp, opts)
+		assert.NoError(err)
+		return db
+	}
+
+	writer := load(Options{})
+	defer writer.Close()
+	reader := load(Options{ReloadInterval: 10 * time.Millisecond})
+	defer reader.Close()
+	reloads := make(chan [2]hash.Hash, 10)
+	reader.SetReloadListener(func(oldHead, newHead hash.Hash) {
+		reloads <- [2]hash.Hash{oldHead, newHead}
+	})
+
+	oldHead := reader.HeadHash()
+	tx := writer.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	select {
+	case r := <-reloads:
+		assert.Equal([2]hash.Hash{oldHead, writer.HeadHash()}, r)
+	case <-time.After(5 * time.Second):
+		assert.Fail("timed out waiting for reload")
+	}
+	assert.Equal(writer.HeadHash(), reader.HeadHash())
+	rtx := reader.NewTransaction()
+	defer rtx.Close()
+	v, err := rtx.Get("foo")
+	assert.NoError(err)
+	assert.Equal(`"bar"`, string(v))
+
+	// Commits by the reader itself don't raise an event.
+	tx = reader.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"baz"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(0, len(reloads))
+
+	// Polling stops on Close.
+	assert.NoError(reader.Close())
+	assert.NoError(writer.Reload())
+	tx = writer.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"qux"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(0, len(reloads))
+}
+
+func TestReloadDoesNotWrite(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	now := time.Unix(1000, 0)
+	opts := Options{Now: func() time.Time { return now }}
+	writer, err := LoadWithOptions(sp, opts)
+	assert.NoError(err)
+	defer writer.Close()
+	reader, err := LoadWithOptions(sp, opts)
+	assert.NoError(err)
+	defer reader.Close()
+
+	tx := writer.NewTransaction()
+	assert.NoError(tx.Local().PutWithTTL("a", []byte(`1`), time.Second))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	root := writer.noms.Datasets().Hash()
+
+	// The entry has expired by the time the reader reloads, but it is only
+	// hidden, not swept.
+	now = now.Add(time.Hour)
+	assert.NoError(reader.Reload())
+	assert.Equal(writer.LocalHash(), reader.LocalHash())
+	rtx := reader.NewTransaction()
+	has, err := rtx.Local().Has("a")
+	assert.NoError(err)
+	assert.False(has)
+	assert.NoError(rtx.Close())
+	writer.noms.Rebase()
+	assert.Equal(root, writer.noms.Datasets().Hash())
+}
+
+func TestReloadPanic(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	writer, err := Load(sp)
+	assert.NoError(err)
+	defer writer.Close()
+	reader, err := LoadWithOptions(sp, Options{ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(err)
+	defer reader.Close()
+	reloads := make(chan hash.Hash, 10)
+	calls := 0
+	reader.SetReloadListener(func(oldHead, newHead hash.Hash) {
+		reloads <- newHead
+		calls++
+		if calls == 1 {
+			panic("listener failed")
+		}
+	})
+
+	// Polling goes on after a panic.
+	for i := 0; i < 2; i++ {
+		tx := writer.NewTransaction()
+		assert.NoError(tx.Put("foo", []byte(fmt.Sprintf("%d", i))))
+		_, err = tx.Commit(log.Default())
+		assert.NoError(err)
+		select {
+		case h := <-reloads:
+			assert.Equal(writer.HeadHash(), h)
+		case <-time.After(5 * time.Second):
+			assert.Fail("timed out waiting for reload")
+		}
+	}
+}
+
+func TestReloadListenerCloses(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	writer, err := Load(sp)
+	assert.NoError(err)
+	defer writer.Close()
+	reader, err := LoadWithOptions(sp, Options{ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(err)
+	closed := make(chan error, 1)
+	reader.SetReloadListener(func(oldHead, newHead hash.Hash) {
+		closed <- reader.Close()
+	})
+
+	tx := writer.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	select {
+	case err := <-closed:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("timed out waiting for the listener to close the DB")
+	}
+}
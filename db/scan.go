@@ -1,6 +1,7 @@
 package db
 
 import (
+	"sort"
 	"strings"
 
 	"github.com/attic-labs/noms/go/types"
@@ -26,16 +27,210 @@ type ScanBound struct {
 type ScanOptions struct {
 	Prefix string     `json:"prefix,omitempty"`
 	Start  *ScanBound `json:"start,omitempty"`
-	Limit  int        `json:"limit,omitempty"`
-	// Future: EndAtID, EndBeforeID
+	// EndAtID is the last id to include, EndBeforeID is the first id to exclude.
+	// If both are set, the more restrictive one applies.
+	EndAtID     string `json:"endAtID,omitempty"`
+	EndBeforeID string `json:"endBeforeID,omitempty"`
+	Limit       int    `json:"limit,omitempty"`
+	// Reverse iterates the matching range from the end. Limit then counts from the end.
+	Reverse bool `json:"reverse,omitempty"`
+	// KeysOnly omits values from the returned items.
+	KeysOnly bool `json:"keysOnly,omitempty"`
+	// Where only returns the items whose values match. Limit counts matching
+	// items.
+	Where *Predicate `json:"where,omitempty"`
 }
 
 type ScanItem struct {
-	Key   string       `json:"key"`
-	Value jsnoms.Value `json:"value"`
+	Key   string        `json:"key"`
+	Value *jsnoms.Value `json:"value,omitempty"`
+	// Blob is set in place of Value if the value is a blob.
+	Blob *BlobInfo `json:"blob,omitempty"`
+	// SecondaryKey is set when scanning a secondary index.
+	SecondaryKey string `json:"secondaryKey,omitempty"`
 }
 
-func scan(data types.Map, opts ScanOptions) ([]ScanItem, error) {
+// setValue sets the Value, or the Blob if v is a blob, of it.
+func (it *ScanItem) setValue(v types.Value) {
+	if b, ok := blobInfo(v); ok {
+		it.Blob = b
+		return
+	}
+	r := jsnoms.Make(nil, v)
+	it.Value = &r
+}
+
+// scan returns the items of data, with the pending edits ed applied, that are
+// matched by opts and f, which is opts.Where compiled. ed may be nil. Start.Index
+// bounds can't be resolved against pending edits, so ed must be empty if opts
+// has one.
+func scan(data types.Map, ed *edits, opts ScanOptions, f scanFilter) ([]ScanItem, error) {
+	lim := opts.Limit
+	if lim == 0 {
+		lim = defaultScanLimit
+	}
+
+	res := []ScanItem{}
+	iterate(data, ed, opts, func(k string, v types.Value) bool {
+		if !f.match(v) {
+			return true
+		}
+		it := ScanItem{Key: k}
+		if !opts.KeysOnly {
+			it.setValue(v)
+		}
+		res = append(res, it)
+		return len(res) < lim
+	})
+	return res, nil
+}
+
+// scanCount returns the number of items matched by opts. Unlike scan there is
+// no default limit: all matching items are counted unless opts.Limit is set.
+func scanCount(data types.Map, ed *edits, opts ScanOptions, f scanFilter) int {
+	n := 0
+	iterate(data, ed, opts, func(k string, v types.Value) bool {
+		if !f.match(v) {
+			return true
+		}
+		n++
+		return opts.Limit == 0 || n < opts.Limit
+	})
+	return n
+}
+
+// hasIndexBound returns true if opts has a Start.Index bound.
+func hasIndexBound(opts ScanOptions) bool {
+	return opts.Start != nil && opts.Start.Index != nil
+}
+
+// resolveIndexBound returns opts with its Start.Index bound, a position in data
+// with the pending edits ed applied, replaced by a Start.ID bound at the key in
+// that position, so that data can be scanned with ed. It returns false if the
+// position is past the end. Finding the key walks the entries before it.
+func resolveIndexBound(data types.Map, ed *edits, opts ScanOptions) (ScanOptions, bool) {
+	if !hasIndexBound(opts) || ed.len() == 0 {
+		return opts, true
+	}
+	pos, n := *opts.Start.Index, uint64(0)
+	var at string
+	found := false
+	iterate(data, ed, ScanOptions{}, func(k string, v types.Value) bool {
+		if n == pos {
+			at, found = k, true
+			return false
+		}
+		n++
+		return true
+	})
+	if !found {
+		return opts, false
+	}
+	start := ScanBound{ID: &ScanID{Value: at}}
+	if id := opts.Start.ID; id != nil && (id.Value > at || id.Value == at && id.Exclusive) {
+		start.ID = id
+	}
+	opts.Start = &start
+	return opts, true
+}
+
+// iterate calls cb with each entry of data, with the pending edits ed applied,
+// that is matched by opts, in order, until cb returns false. opts.Limit is not
+// applied.
+func iterate(data types.Map, ed *edits, opts ScanOptions, cb func(k string, v types.Value) bool) {
+	chk.True(ed.len() == 0 || !hasIndexBound(opts), "Start.Index is not supported with pending edits")
+
+	keys := ed.sortedKeys()
+	var it entryIter
+	inBounds := func(k types.String) bool {
+		return inRange(k, opts)
+	}
+	if opts.Reverse {
+		lowerOK := func(k types.String) bool {
+			return aboveLower(string(k), opts)
+		}
+		if hasIndexBound(opts) {
+			lo := lowerBound(data, opts)
+			if !lo.Valid() {
+				return
+			}
+			lower := lo.Key()
+			lowerOK = func(k types.String) bool {
+				return !k.Less(lower)
+			}
+		}
+		inBounds = func(k types.String) bool {
+			return lowerOK(k) && inRange(k, opts)
+		}
+		i := sort.Search(len(keys), func(i int) bool {
+			return !belowUpper(keys[i], opts)
+		})
+		it = mergeIter{mapIter{upperBound(data, opts), true}, &editsIter{ed, keys, i - 1, true}, true}
+	} else {
+		i := sort.Search(len(keys), func(i int) bool {
+			return aboveLower(keys[i], opts)
+		})
+		it = mergeIter{mapIter{lowerBound(data, opts), false}, &editsIter{ed, keys, i, false}, false}
+	}
+
+	for ; it.valid(); it.next() {
+		k, v := it.entry()
+		if !inBounds(k) {
+			return
+		}
+		if v == nil {
+			// Removed by a pending edit.
+			continue
+		}
+		if !cb(string(k), v) {
+			return
+		}
+	}
+}
+
+// inRange returns true if k is within the prefix and end bounds of opts.
+func inRange(k types.String, opts ScanOptions) bool {
+	ks := string(k)
+	if opts.Prefix != "" && !strings.HasPrefix(ks, opts.Prefix) {
+		return false
+	}
+	return belowUpper(ks, opts)
+}
+
+// aboveLower returns true if k is not excluded by the prefix and start id
+// bounds of opts.
+func aboveLower(k string, opts ScanOptions) bool {
+	if k < opts.Prefix {
+		return false
+	}
+	if opts.Start != nil && opts.Start.ID != nil && opts.Start.ID.Value != "" {
+		if opts.Start.ID.Exclusive {
+			return k > opts.Start.ID.Value
+		}
+		return k >= opts.Start.ID.Value
+	}
+	return true
+}
+
+// belowUpper returns true if k is not excluded by the prefix and end bounds of opts.
+func belowUpper(k string, opts ScanOptions) bool {
+	if opts.Prefix != "" {
+		if end, ok := prefixEnd(opts.Prefix); ok && k >= end {
+			return false
+		}
+	}
+	if opts.EndAtID != "" && k > opts.EndAtID {
+		return false
+	}
+	if opts.EndBeforeID != "" && k >= opts.EndBeforeID {
+		return false
+	}
+	return true
+}
+
+// lowerBound returns an iterator at the first entry of data that is not
+// excluded by the prefix and start bounds of opts.
+func lowerBound(data types.Map, opts ScanOptions) *types.MapIterator {
 	var it *types.MapIterator
 
 	updateIter := func(cand *types.MapIterator) {
@@ -74,27 +269,77 @@ func scan(data types.Map, opts ScanOptions) ([]ScanItem, error) {
 	if it == nil {
 		it = data.Iterator()
 	}
+	return it
+}
 
-	lim := opts.Limit
-	if lim == 0 {
-		lim = 50
+// upperBound returns an iterator at the last entry of data that is not
+// excluded by the prefix and end bounds of opts. The iterator is invalid if
+// there is no such entry.
+func upperBound(data types.Map, opts ScanOptions) *types.MapIterator {
+	var it *types.MapIterator
+
+	updateIter := func(cand *types.MapIterator) {
+		if it == nil {
+			it = cand
+		} else if !it.Valid() {
+			// the current iterator is before the start, no value could be less
+		} else if !cand.Valid() {
+			// the candidate is before the start, all values are greater
+			it = cand
+		} else if cand.Key().Less(it.Key()) {
+			it = cand
+		} else {
+			// the current iterator is <= the candidate
+		}
 	}
 
-	res := []ScanItem{}
-	for ; it.Valid(); it.Next() {
-		k, v := it.Entry()
-		chk.True(k.Kind() == types.StringKind, "Only keys with string kinds are supported, Noms schema check should have caught this")
-		ks := string(k.(types.String))
-		if opts.Prefix != "" && !strings.HasPrefix(ks, opts.Prefix) {
-			break
-		}
-		res = append(res, ScanItem{
-			Key:   ks,
-			Value: jsnoms.Make(nil, v),
-		})
-		if len(res) == lim {
-			break
+	if opts.Prefix != "" {
+		if end, ok := prefixEnd(opts.Prefix); ok {
+			updateIter(lastBefore(data, types.String(end), false))
 		}
 	}
-	return res, nil
+	if opts.EndAtID != "" {
+		updateIter(lastBefore(data, types.String(opts.EndAtID), true))
+	}
+	if opts.EndBeforeID != "" {
+		updateIter(lastBefore(data, types.String(opts.EndBeforeID), false))
+	}
+
+	if it == nil {
+		it = lastBefore(data, "", false)
+	}
+	return it
+}
+
+// lastBefore returns an iterator at the last entry of data with a key less
+// than k, or less than or equal to k if inclusive. If k is empty the iterator
+// is at the last entry of data.
+func lastBefore(data types.Map, k types.String, inclusive bool) *types.MapIterator {
+	var it *types.MapIterator
+	if k != "" {
+		it = data.IteratorFrom(k)
+	}
+	if it == nil || !it.Valid() {
+		if data.Len() == 0 {
+			return data.Iterator()
+		}
+		return data.IteratorAt(data.Len() - 1)
+	}
+	if !(inclusive && it.Key().Equals(k)) {
+		it.Prev()
+	}
+	return it
+}
+
+// prefixEnd returns the smallest string that is greater than every string
+// with the given prefix. It returns false if there is no such string.
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
 }
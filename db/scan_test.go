@@ -98,6 +98,35 @@ func TestScan(t *testing.T) {
 		{ScanOptions{Prefix: "c", Start: &ScanBound{Index: index(0), ID: &ScanID{Value: "a"}}}, []string{}, nil},
 		{ScanOptions{Prefix: "a", Start: &ScanBound{Index: index(100), ID: &ScanID{Value: "a"}}}, []string{}, nil},
 		{ScanOptions{Prefix: "a", Start: &ScanBound{Index: index(0), ID: &ScanID{Value: "z"}}}, []string{}, nil},
+
+		// end bounds
+		{ScanOptions{EndAtID: "ba"}, []string{"0", "a", "ba"}, nil},
+		{ScanOptions{EndBeforeID: "ba"}, []string{"0", "a"}, nil},
+		{ScanOptions{EndAtID: "b"}, []string{"0", "a"}, nil},
+		{ScanOptions{EndAtID: "z"}, []string{"0", "a", "ba", "bb"}, nil},
+		{ScanOptions{EndBeforeID: "0"}, []string{}, nil},
+		{ScanOptions{EndAtID: "bb", EndBeforeID: "bb"}, []string{"0", "a", "ba"}, nil},
+		{ScanOptions{Prefix: "b", EndBeforeID: "bb"}, []string{"ba"}, nil},
+		{ScanOptions{Start: &ScanBound{ID: &ScanID{Value: "a"}}, EndAtID: "ba"}, []string{"a", "ba"}, nil},
+		{ScanOptions{Start: &ScanBound{ID: &ScanID{Value: "b"}}, EndBeforeID: "b"}, []string{}, nil},
+
+		// reverse
+		{ScanOptions{Reverse: true}, []string{"bb", "ba", "a", "0"}, nil},
+		{ScanOptions{Reverse: true, Limit: 2}, []string{"bb", "ba"}, nil},
+		{ScanOptions{Reverse: true, Prefix: "b"}, []string{"bb", "ba"}, nil},
+		{ScanOptions{Reverse: true, Prefix: "a"}, []string{"a"}, nil},
+		{ScanOptions{Reverse: true, Prefix: "c"}, []string{}, nil},
+		{ScanOptions{Reverse: true, Prefix: "/"}, []string{}, nil},
+		{ScanOptions{Reverse: true, EndBeforeID: "ba"}, []string{"a", "0"}, nil},
+		{ScanOptions{Reverse: true, EndAtID: "ba"}, []string{"ba", "a", "0"}, nil},
+		{ScanOptions{Reverse: true, EndAtID: "b"}, []string{"a", "0"}, nil},
+		{ScanOptions{Reverse: true, EndBeforeID: "0"}, []string{}, nil},
+		{ScanOptions{Reverse: true, Start: &ScanBound{ID: &ScanID{Value: "a", Exclusive: true}}}, []string{"bb", "ba"}, nil},
+		{ScanOptions{Reverse: true, Start: &ScanBound{Index: index(1)}, EndBeforeID: "bb"}, []string{"ba", "a"}, nil},
+		{ScanOptions{Reverse: true, Start: &ScanBound{ID: &ScanID{Value: "c"}}}, []string{}, nil},
+
+		// keys only
+		{ScanOptions{KeysOnly: true, Prefix: "b"}, []string{"ba", "bb"}, nil},
 	}
 
 	for i, testCase := range tc {
@@ -118,8 +147,116 @@ func TestScan(t *testing.T) {
 			act := []string{}
 			for _, it := range res {
 				act = append(act, it.Key)
+				assert.Equal(testCase.opts.KeysOnly, it.Value == nil, msg)
 			}
 			assert.Equal(testCase.expected, act, msg)
+
+			n, err := tx.Count(testCase.opts)
+			assert.NoError(err)
+			assert.Equal(len(testCase.expected), n, msg)
 		})
 	}
 }
+
+func TestScanCountLimit(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	d, err := Load(sp)
+	assert.NoError(err)
+
+	tx := d.NewTransaction()
+	for i := 0; i < defaultScanLimit+10; i++ {
+		assert.NoError(tx.Put(fmt.Sprintf("k%03d", i), []byte("true")))
+	}
+
+	items, err := tx.Scan(ScanOptions{})
+	assert.NoError(err)
+	assert.Equal(defaultScanLimit, len(items))
+	n, err := tx.Count(ScanOptions{})
+	assert.NoError(err)
+	assert.Equal(defaultScanLimit+10, n)
+	n, err = tx.Count(ScanOptions{Limit: 5})
+	assert.NoError(err)
+	assert.Equal(5, n)
+	assert.NoError(tx.Close())
+}
+
+func TestScanWithWrites(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	d, err := Load(sp)
+	assert.NoError(err)
+
+	tx := d.NewTransaction()
+	for _, k := range []string{"0", "a", "ba", "bb", "c"} {
+		assert.NoError(tx.Put(k, []byte(fmt.Sprintf("\"%s\"", k))))
+	}
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	tx = d.NewTransaction()
+	defer tx.Close()
+	assert.NoError(tx.Put("a", []byte(`"changed"`)))
+	assert.NoError(tx.Put("b", []byte(`"added"`)))
+	assert.NoError(tx.Put("bc", []byte(`"added"`)))
+	assert.NoError(tx.Put("d", []byte(`"added"`)))
+	assert.NoError(tx.Put("e", []byte(`"added"`)))
+	for _, k := range []string{"0", "bb", "e"} {
+		ok, err := tx.Del(k)
+		assert.NoError(err)
+		assert.True(ok)
+	}
+
+	index := func(v int) *uint64 {
+		vv := uint64(v)
+		return &vv
+	}
+
+	for _, opts := range []ScanOptions{
+		{},
+		{Limit: 2},
+		{Prefix: "b"},
+		{Prefix: "b", Reverse: true},
+		{Start: &ScanBound{ID: &ScanID{Value: "b"}}},
+		{Start: &ScanBound{ID: &ScanID{Value: "b", Exclusive: true}}},
+		{Start: &ScanBound{ID: &ScanID{Value: "bb"}}, Reverse: true},
+		{EndAtID: "bc"},
+		{EndBeforeID: "bc", Reverse: true},
+		{Reverse: true},
+		{Reverse: true, Limit: 2},
+		{Start: &ScanBound{Index: index(2)}},
+		{Start: &ScanBound{Index: index(2)}, Reverse: true},
+	} {
+		js, err := json.Marshal(opts)
+		assert.NoError(err)
+		expected, err := scan(tx.me.Build().NomsMap(), nil, opts, nil)
+		assert.NoError(err)
+		actual, err := tx.Scan(opts)
+		assert.NoError(err)
+		assert.Equal(expected, actual, string(js))
+		n, err := tx.Count(opts)
+		assert.NoError(err)
+		assert.Equal(scanCount(tx.me.Build().NomsMap(), nil, opts, nil), n, string(js))
+	}
+
+	items, err := tx.Scan(ScanOptions{})
+	assert.NoError(err)
+	act := []string{}
+	for _, it := range items {
+		act = append(act, it.Key)
+	}
+	assert.Equal([]string{"a", "b", "ba", "bc", "c", "d"}, act)
+
+	// Writes between scans are merged in order too.
+	assert.NoError(tx.Put("aa", []byte(`"added"`)))
+	assert.NoError(tx.Put("0", []byte(`"added again"`)))
+	items, err = tx.Scan(ScanOptions{Reverse: true})
+	assert.NoError(err)
+	act = []string{}
+	for _, it := range items {
+		act = append(act, it.Key)
+	}
+	assert.Equal([]string{"d", "c", "bc", "ba", "b", "aa", "a", "0"}, act)
+}
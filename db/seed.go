@@ -0,0 +1,31 @@
+package db
+
+import (
+	"fmt"
+	"os"
+)
+
+// readSeed returns the genesis commit of a new database seeded from the export
+// in the file at path. The genesis has the snapshot's data, indexes and server
+// state ID, so that the first pull is a diff from it. The exported client ID
+// and last mutation ID belong to the client the seed was made from and are
+// ignored.
+func (db *DB) readSeed(path string) (Commit, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Commit{}, fmt.Errorf("could not open seed file: %w", err)
+	}
+	defer f.Close()
+	h, data, indexes, mutations, err := db.readExport(f)
+	if err != nil {
+		return Commit{}, fmt.Errorf("could not read seed file %s: %w", path, err)
+	}
+	if len(mutations) > 0 {
+		return Commit{}, fmt.Errorf("seed file %s has pending mutations", path)
+	}
+	genesis := makeGenesis(db.noms, h.ServerStateID, db.noms.WriteValue(data.NomsMap()), data.NomsChecksum(), 0 /*lastMutationID*/, writeIndexes(db.noms, indexes))
+	if h.ServerChecksum != "" {
+		genesis = withServerChecksum(db.noms, genesis, h.ServerChecksum)
+	}
+	return genesis, nil
+}
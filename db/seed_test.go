@@ -0,0 +1,72 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestSeed(t *testing.T) {
+	assert := assert.New(t)
+	src, _ := LoadTempDB(assert)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+
+	ed := kv.NewMap(src.noms).Edit()
+	assert.NoError(ed.Set(types.String("a"), types.String("x")))
+	m := ed.Build()
+	snapshot := makeSnapshot(src.noms, src.Head().Ref(), "ssid1", src.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 3, types.Ref{})
+	src.noms.WriteValue(snapshot.NomsStruct)
+	assert.NoError(src.setHead(snapshot))
+
+	seed := filepath.Join(dir, "seed.jsonl")
+	f, err := os.Create(seed)
+	assert.NoError(err)
+	assert.NoError(src.Export(f, ExportOptions{}))
+	assert.NoError(f.Close())
+
+	load := func(seed string) (*DB, error) {
+		td, err := ioutil.TempDir("", "")
+		assert.NoError(err)
+		sp, err := spec.ForDatabase(td)
+		assert.NoError(err)
+		return LoadWithOptions(sp, Options{SeedFile: seed})
+	}
+
+	db, err := load(seed)
+	assert.NoError(err)
+	head := db.Head()
+	assert.Equal(0, len(head.Parents))
+	assert.Equal("ssid1", head.Meta.Snapshot.ServerStateID)
+	assert.Equal(uint64(0), head.MutationID())
+	assert.Equal(snapshot.Value.Data.TargetHash(), head.Value.Data.TargetHash())
+	assert.NotEqual(src.ClientID(), db.ClientID())
+	tx := db.NewTransaction()
+	v, err := tx.Get("a")
+	assert.NoError(err)
+	assert.Equal(`"x"`, string(v))
+	tx.Close()
+
+	// Seeds can't have pending mutations.
+	tx = src.NewTransactionWithArgs("m1", types.String("arg"), nil, nil)
+	assert.NoError(tx.Put("b", []byte(`1`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	f, err = os.Create(seed)
+	assert.NoError(err)
+	assert.NoError(src.Export(f, ExportOptions{Pending: true}))
+	assert.NoError(f.Close())
+	_, err = load(seed)
+	assert.Regexp("has pending mutations", err.Error())
+
+	_, err = load(filepath.Join(dir, "nope"))
+	assert.Regexp("could not open seed file", err.Error())
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+)
+
+// statsPrefixSeparator ends the top-level prefix of a key that Stats groups
+// keys by. Keys without it are grouped under the empty prefix.
+const statsPrefixSeparator = "/"
+
+// Stats describes the storage used by a database.
+type Stats struct {
+	// DiskBytes is the size of the database on disk. It is 0 for in-memory
+	// databases.
+	DiskBytes int64 `json:"diskBytes"`
+	// Chunks is the number of chunks reachable from the datasets, including
+	// the whole history.
+	Chunks int `json:"chunks"`
+	// Keys and ValueBytes are the number of keys at the head and the
+	// approximate size of their values.
+	Keys       uint64 `json:"keys"`
+	ValueBytes int64  `json:"valueBytes"`
+	// Prefixes breaks down Keys and ValueBytes by the top-level prefix of the
+	// keys, which is the part up to and including the first "/".
+	Prefixes map[string]PrefixStats `json:"prefixes"`
+	// PendingCommits is the number of local commits that haven't been synced.
+	PendingCommits int `json:"pendingCommits"`
+	// HistoryDepth is the number of commits from the head back to genesis,
+	// both included.
+	HistoryDepth int `json:"historyDepth"`
+}
+
+// PrefixStats are the stats of the keys with a top-level prefix.
+type PrefixStats struct {
+	Keys       uint64 `json:"keys"`
+	ValueBytes int64  `json:"valueBytes"`
+}
+
+// Stats returns statistics about the storage of the database. It reads the
+// whole history, so it is not meant to be called often.
+func (db *DB) Stats() (Stats, error) {
+	done, err := db.beginOp()
+	if err != nil {
+		return Stats{}, err
+	}
+	defer done()
+
+	s := Stats{Prefixes: map[string]PrefixStats{}}
+	if db.dir != "" {
+		if s.DiskBytes, err = diskUsage(db.dir); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	v := verifier{noms: db.noms, visited: map[hash.Hash]bool{}}
+	db.noms.Datasets().IterAll(func(k, r types.Value) {
+		v.walk(r.(types.Ref), string(k.(types.String)))
+	})
+	s.Chunks = len(v.visited)
+
+	head := db.Head()
+	head.Data(db.noms).NomsMap().IterAll(func(k, val types.Value) {
+		key := string(k.(types.String))
+		prefix := ""
+		if i := strings.Index(key, statsPrefixSeparator); i >= 0 {
+			prefix = key[:i+len(statsPrefixSeparator)]
+		}
+		size := valueSize(val)
+		ps := s.Prefixes[prefix]
+		ps.Keys++
+		ps.ValueBytes += size
+		s.Prefixes[prefix] = ps
+		s.Keys++
+		s.ValueBytes += size
+	})
+
+	pending, err := pendingCommits(db.noms, head)
+	if err != nil {
+		return Stats{}, err
+	}
+	s.PendingCommits = len(pending)
+	for c := head; ; {
+		s.HistoryDepth++
+		if len(c.Parents) == 0 {
+			break
+		}
+		if c, err = c.Basis(db.noms); err != nil {
+			return Stats{}, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("todo/1", []byte(`"a"`)))
+	assert.NoError(tx.Put("todo/2", []byte(`"b"`)))
+	assert.NoError(tx.Put("x", []byte(`{"big":"`+strings.Repeat("x", 100)+`"}`)))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+
+	s, err := db.Stats()
+	assert.NoError(err)
+	assert.True(s.DiskBytes > 0)
+	assert.True(s.Chunks > 0)
+	assert.Equal(uint64(3), s.Keys)
+	assert.Equal(1, s.PendingCommits)
+	assert.Equal(2, s.HistoryDepth)
+	assert.Equal(2, len(s.Prefixes))
+	assert.Equal(uint64(2), s.Prefixes["todo/"].Keys)
+	assert.Equal(uint64(1), s.Prefixes[""].Keys)
+	assert.True(s.Prefixes[""].ValueBytes > 100)
+	assert.Equal(s.ValueBytes, s.Prefixes["todo/"].ValueBytes+s.Prefixes[""].ValueBytes)
+
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	mem, err := Load(sp)
+	assert.NoError(err)
+	s, err = mem.Stats()
+	assert.NoError(err)
+	assert.Equal(int64(0), s.DiskBytes)
+	assert.Equal(uint64(0), s.Keys)
+	assert.Equal(1, s.HistoryDepth)
+}
+
+func TestQuota(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	assert.NoError(db.Close())
+	usage, err := diskUsage(dir)
+	assert.NoError(err)
+
+	sp, err := spec.ForDatabase(dir)
+	assert.NoError(err)
+	db, err = LoadWithOptions(sp, Options{Quota: usage + 200})
+	assert.NoError(err)
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("small", []byte(`"a"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	// The usage is tracked across the DB's own commits, and measured again
+	// when someone else writes.
+	_, cached, err := db.diskUsage()
+	assert.NoError(err)
+	assert.True(cached)
+	other, err := Load(sp)
+	assert.NoError(err)
+	tx = other.NewTransaction()
+	assert.NoError(tx.Put("other", []byte(`"b"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NoError(other.Close())
+	_, cached, err = db.diskUsage()
+	assert.NoError(err)
+	assert.False(cached)
+	assert.NoError(db.Reload())
+
+	head := db.HeadHash()
+	tx = db.NewTransaction()
+	assert.NoError(tx.Put("big", []byte(`"`+strings.Repeat("x", 1000)+`"`)))
+	_, err = tx.Commit(log.Default())
+	var qe QuotaError
+	assert.True(errors.As(err, &qe))
+	assert.Equal(usage+200, qe.Quota)
+	assert.True(qe.Size > 1000)
+	assert.Equal(head, db.HeadHash())
+
+	// Deleting is allowed.
+	tx = db.NewTransaction()
+	_, err = tx.Del("small")
+	assert.NoError(err)
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.NotEqual(head, db.HeadHash())
+}
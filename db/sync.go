@@ -1,7 +1,6 @@
 package db
 
 import (
-	"bytes"
 	"fmt"
 
 	"github.com/attic-labs/noms/go/hash"
@@ -40,6 +39,15 @@ type SyncInfo struct {
 // Returns an error (and zeros for other return values) in the case of
 // invalid argument values, or internal errors.
 func (db *DB) BeginSync(batchPushURL string, diffServerURL string, diffServerAuth string, dataLayerAuth string, l zl.Logger) (syncHead hash.Hash, syncInfo SyncInfo, err error) {
+	done, err := db.beginOp()
+	if err != nil {
+		return hash.Hash{}, SyncInfo{}, err
+	}
+	defer done()
+	if db.readOnly {
+		return hash.Hash{}, SyncInfo{}, ErrReadOnly
+	}
+
 	syncInfo = SyncInfo{}
 	syncInfo.SyncID = db.newSyncID()
 	l = l.With().Str("syncID", syncInfo.SyncID).Logger()
@@ -85,11 +93,21 @@ func (db *DB) BeginSync(batchPushURL string, diffServerURL string, diffServerAut
 // pending commits that have not yet been included in latest snapshot,
 // then finalization is not yet possible. In that case, those commits
 // that must be replayed are returned. Caller must replay them, then
-// call MaybeEndSync again.
-func (db *DB) MaybeEndSync(syncHead hash.Hash, syncID string) ([]ReplayMutation, error) {
+// call MaybeEndSync again. Once the sync is finalized, the hash of the
+// head that the sync head replaced is returned too.
+func (db *DB) MaybeEndSync(syncHead hash.Hash, syncID string) ([]ReplayMutation, hash.Hash, error) {
+	done, err := db.beginOp()
+	if err != nil {
+		return []ReplayMutation{}, hash.Hash{}, err
+	}
+	defer done()
+	if db.readOnly {
+		return []ReplayMutation{}, hash.Hash{}, ErrReadOnly
+	}
+
 	syncHeadCommit, err := ReadCommit(db.Noms(), syncHead)
 	if err != nil {
-		return []ReplayMutation{}, err
+		return []ReplayMutation{}, hash.Hash{}, err
 	}
 
 	defer db.lock()()
@@ -98,15 +116,15 @@ func (db *DB) MaybeEndSync(syncHead hash.Hash, syncID string) ([]ReplayMutation,
 	// Stop if someone landed a sync since this sync started (see explanation below).
 	syncSnapshot, err := baseSnapshot(db.noms, syncHeadCommit)
 	if err != nil {
-		return []ReplayMutation{}, err
+		return []ReplayMutation{}, hash.Hash{}, err
 	}
 	syncSnapshotBasis, err := syncSnapshot.Basis(db.noms)
 	if err != nil {
-		return []ReplayMutation{}, err
+		return []ReplayMutation{}, hash.Hash{}, err
 	}
 	headSnapshot, err := baseSnapshot(db.noms, head)
 	if err != nil {
-		return []ReplayMutation{}, err
+		return []ReplayMutation{}, hash.Hash{}, err
 	}
 	// BeginSync() added a new snapshot commit whose basis is the forkpoint.
 	// E.g., in below diagram, BeginSync added SS2, the sync snapshot, and SS1
@@ -121,47 +139,48 @@ func (db *DB) MaybeEndSync(syncHead hash.Hash, syncID string) ([]ReplayMutation,
 	// some other sync landed a new snapshot on master and we have to abort. We do
 	// not expect this in normal operation, we're being defensive.
 	if !syncSnapshotBasis.NomsStruct.Equals(headSnapshot.NomsStruct) {
-		return []ReplayMutation{}, fmt.Errorf("found a newer snapshot %s on master", headSnapshot.NomsStruct.Hash())
+		return []ReplayMutation{}, hash.Hash{}, fmt.Errorf("found a newer snapshot %s on master", headSnapshot.NomsStruct.Hash())
 	}
 
 	// Determine if there are any pending mutations that we need to replay.
 	pendingCommits, err := pendingCommits(db.noms, head)
 	if err != nil {
-		return []ReplayMutation{}, err
+		return []ReplayMutation{}, hash.Hash{}, err
 	}
 	commitsToReplay := filterIDsLessThanOrEqualTo(pendingCommits, syncHeadCommit.MutationID())
-	var replay []ReplayMutation
 	if len(commitsToReplay) > 0 {
+		var replay []ReplayMutation
 		for _, c := range commitsToReplay {
-			var args bytes.Buffer
-			err = nomsjson.ToJSON(c.Meta.Local.Args, &args)
+			args, err := db.codec.toJSON(c.Meta.Local.Args)
 			if err != nil {
-				return []ReplayMutation{}, err
+				return []ReplayMutation{}, hash.Hash{}, err
 			}
 			replay = append(replay, ReplayMutation{
 				Mutation{
 					ID:   c.Meta.Local.MutationID,
 					Name: string(c.Meta.Local.Name),
-					Args: args.Bytes(),
+					Args: args,
 				},
 				&nomsjson.Hash{
 					Hash: c.Ref().TargetHash(),
 				},
 			})
 		}
-		return replay, nil
+		return replay, hash.Hash{}, nil
 	}
 
-	// TODO check invariants from synchead back to syncsnapshot.
+	if err := checkPending(db.noms, syncHeadCommit); err != nil {
+		return []ReplayMutation{}, hash.Hash{}, fmt.Errorf("invalid sync head %s: %w", syncHead, err)
+	}
 
 	// Sync is complete. Can't ffwd because sync head is dangling.
 	_, err = db.noms.SetHead(db.noms.GetDataset(MASTER_DATASET), syncHeadCommit.Ref())
 	if err != nil {
-		return []ReplayMutation{}, err
+		return []ReplayMutation{}, hash.Hash{}, err
 	}
 	db.head = syncHeadCommit
 
-	return []ReplayMutation{}, nil
+	return []ReplayMutation{}, head.NomsStruct.Hash(), nil
 }
 
 func filterIDsLessThanOrEqualTo(commits []Commit, filter uint64) (filtered []Commit) {
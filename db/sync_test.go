@@ -30,7 +30,7 @@ func TestDB_BeginSync(t *testing.T) {
 	commits.addGenesis(assert, db).addSnapshot(assert, db).addLocal(assert, db, d)
 	headSnapshot, err := baseSnapshot(db.Noms(), commits.head())
 	assert.NoError(err)
-	syncSnapshot := makeSnapshot(db.noms, headSnapshot.Ref(), "newssid", db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), 43)
+	syncSnapshot := makeSnapshot(db.noms, headSnapshot.Ref(), "newssid", db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), 43, types.Ref{})
 
 	tests := []struct {
 		name string
@@ -140,7 +140,7 @@ func TestDB_BeginSync(t *testing.T) {
 
 			headSnapshot, err := baseSnapshot(db.Noms(), commits.head())
 			assert.NoError(err)
-			syncSnapshot = makeSnapshot(db.noms, headSnapshot.Ref(), tt.pullSSID, db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), 43)
+			syncSnapshot = makeSnapshot(db.noms, headSnapshot.Ref(), tt.pullSSID, db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), 43, types.Ref{})
 			// Ensure it is not saved so we can check that it is by sync.
 			assert.Nil(db.noms.ReadValue(syncSnapshot.NomsStruct.Hash()))
 
@@ -321,13 +321,14 @@ func TestDB_MaybeEndSync(t *testing.T) {
 				masterIndex := 1 + i
 				original := master[masterIndex]
 				assert.True(original.Type() == CommitTypeLocal)
-				replayed := makeLocal(db.noms, syncBranch.head().Ref(), d, original.MutationID(), original.Meta.Local.Name, original.Meta.Local.Args, original.Value.Data, original.Value.Checksum)
+				replayed := makeLocal(db.noms, syncBranch.head().Ref(), d, original.MutationID(), original.Meta.Local.Name, original.Meta.Local.Args, original.Value.Data, original.Value.Checksum, types.Ref{})
 				db.noms.WriteValue(replayed.NomsStruct)
 				syncBranch = append(syncBranch, replayed)
 			}
 			syncHead := syncBranch.head()
 
-			gotReplay, err := db.MaybeEndSync(syncHead.NomsStruct.Hash(), "syncID")
+			oldHead := db.HeadHash()
+			gotReplay, prevHead, err := db.MaybeEndSync(syncHead.NomsStruct.Hash(), "syncID")
 
 			if tt.expErr != "" {
 				assert.Error(err)
@@ -352,7 +353,9 @@ func TestDB_MaybeEndSync(t *testing.T) {
 			// If successful...
 			if tt.expErr == "" && len(tt.expReplayIds) == 0 {
 				assert.True(syncHead.NomsStruct.Equals(db.Head().NomsStruct))
+				assert.Equal(oldHead, prevHead)
 			} else {
+				assert.True(prevHead.IsEmpty())
 				assert.True(master.head().NomsStruct.Equals(db.Head().NomsStruct))
 			}
 		})
@@ -23,7 +23,7 @@ func (t testCommits) head() Commit {
 
 func (t *testCommits) addGenesis(assert *assert.Assertions, db *DB) *testCommits {
 	m := kv.NewMap(db.noms)
-	genesis := makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0)
+	genesis := makeGenesis(db.noms, "", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 0, types.Ref{})
 	db.noms.WriteValue(marshal.MustMarshal(db.noms, genesis.NomsStruct))
 	*t = append(*t, genesis)
 	return t
@@ -32,7 +32,7 @@ func (t *testCommits) addGenesis(assert *assert.Assertions, db *DB) *testCommits
 func (t *testCommits) addSnapshot(assert *assert.Assertions, db *DB) *testCommits {
 	m := kv.NewMap(db.noms)
 	basis := (*t).head()
-	snapshot := makeSnapshot(db.noms, basis.Ref(), fmt.Sprintf("ssid%d", len(*t)-1), db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), basis.MutationID())
+	snapshot := makeSnapshot(db.noms, basis.Ref(), fmt.Sprintf("ssid%d", len(*t)-1), db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), basis.MutationID(), types.Ref{})
 	db.noms.WriteValue(marshal.MustMarshal(db.noms, snapshot.NomsStruct))
 	*t = append(*t, snapshot)
 	return t
@@ -41,7 +41,7 @@ func (t *testCommits) addSnapshot(assert *assert.Assertions, db *DB) *testCommit
 func (t *testCommits) addLocal(assert *assert.Assertions, db *DB, d datetime.DateTime) *testCommits {
 	m := kv.NewMap(db.noms)
 	basis := (*t).head()
-	local := makeLocal(db.noms, basis.Ref(), d, basis.NextMutationID(), fmt.Sprintf("TxName%d", len(*t)-1), types.NewList(db.noms), db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum())
+	local := makeLocal(db.noms, basis.Ref(), d, basis.NextMutationID(), fmt.Sprintf("TxName%d", len(*t)-1), types.NewList(db.noms), db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), types.Ref{})
 	db.noms.WriteValue(marshal.MustMarshal(db.noms, local.NomsStruct))
 	*t = append(*t, local)
 	return t
@@ -1,17 +1,16 @@
 package db
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/types"
 	zl "github.com/rs/zerolog"
 
 	"roci.dev/diff-server/kv"
-	nomsjson "roci.dev/diff-server/util/noms/json"
 	"roci.dev/diff-server/util/time"
 )
 
@@ -22,21 +21,67 @@ var (
 )
 
 // Transaction represents a read and write transaction. Changes to the database
-// are not committed until Commit is called.
+// are not committed until Commit is called. A Transaction reads and writes the
+// synced data, and its Local view the local keyspace.
 // Transactions are thread safe.
 type Transaction struct {
+	*txState
+	*keyspace
+}
+
+// txState is the state shared by the views of a transaction.
+type txState struct {
 	db       *DB
 	basis    Commit
-	me       *kv.MapEditor
-	wrote    bool
 	closed   bool
 	name     string
 	args     types.Value
 	original *Commit // non-nil for replay transactions.
 
+	synced *keyspace
+	local  *keyspace
+
+	createdIndexes map[string]IndexDefinition
+	droppedIndexes map[string]bool
+
+	// committedHead and committedLocal are the hashes of the head and the
+	// local keyspace data that Commit set, if it set them.
+	committedHead  hash.Hash
+	committedLocal hash.Hash
+
+	// scannedIndexes caches the overlays of the indexes scanned since the last
+	// write. It is guarded by scanMutex as scans only hold the read lock.
+	scannedIndexes map[string]indexOverlay
+	scanMutex      sync.Mutex
+
 	mutex sync.RWMutex
 }
 
+// abort closes the transaction without committing.
+func (tx *txState) abort() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	tx.closed = true
+}
+
+// keyspace is the data of one keyspace as modified by a transaction.
+type keyspace struct {
+	base    types.Map // the data at the start of the transaction.
+	me      *kv.MapEditor
+	edits   edits // the writes in me, for scanning without building me.
+	wrote   bool
+	isLocal bool
+	expires *expiriesEditor // the expiry times of keys with a TTL, local keyspace only.
+}
+
+func newKeyspace(data kv.Map, isLocal bool) *keyspace {
+	return &keyspace{
+		base:    data.NomsMap(),
+		me:      data.Edit(),
+		isLocal: isLocal,
+	}
+}
+
 func (tx *Transaction) rlock() func() {
 	tx.mutex.RLock()
 	return func() {
@@ -74,9 +119,7 @@ func (tx *Transaction) Get(id string) ([]byte, error) {
 	if value == nil {
 		return nil, nil
 	}
-	var b bytes.Buffer
-	err := nomsjson.ToJSON(value, &b)
-	return b.Bytes(), err
+	return tx.db.codec.toJSON(value)
 }
 
 // Has returns true if the database has an entry with the given id.
@@ -98,7 +141,39 @@ func (tx *Transaction) Scan(opts ScanOptions) ([]ScanItem, error) {
 	if tx.closed {
 		return nil, ErrClosed
 	}
-	return scan(tx.me.Build().NomsMap(), opts)
+	f, err := tx.db.codec.compile(opts.Where)
+	if err != nil {
+		return nil, err
+	}
+	data, ed := tx.scanData(opts)
+	return scan(data, ed, opts, f)
+}
+
+// Count returns the number of entries in the database matched by opts. All
+// matching entries are counted unless opts.Limit is set.
+func (tx *Transaction) Count(opts ScanOptions) (int, error) {
+	defer tx.rlock()()
+
+	if tx.closed {
+		return 0, ErrClosed
+	}
+	f, err := tx.db.codec.compile(opts.Where)
+	if err != nil {
+		return 0, err
+	}
+	data, ed := tx.scanData(opts)
+	return scanCount(data, ed, opts, f), nil
+}
+
+// scanData returns the data to scan with opts: the basis data and the pending
+// edits that are merged with it while iterating. Start.Index bounds refer to
+// positions in the modified data though, so in that case the edits are applied
+// up front.
+func (tx *Transaction) scanData(opts ScanOptions) (types.Map, *edits) {
+	if hasIndexBound(opts) && tx.edits.len() > 0 {
+		return tx.me.Build().NomsMap(), nil
+	}
+	return tx.base, &tx.edits
 }
 
 // Put adds or updates an existing entry in the database.
@@ -107,19 +182,27 @@ func (tx *Transaction) Put(id string, json []byte) error {
 		return ErrClosed
 	}
 
-	value, err := nomsjson.FromJSON(json, tx.db.noms)
+	value, err := tx.db.codec.fromJSON(json, tx.db.noms)
 	if err != nil {
 		return fmt.Errorf("could not Put '%s'='%s': %w", id, json, err)
 	}
 
 	defer tx.lock()()
 
-	err = tx.me.Set(types.String(id), value)
+	return tx.set(id, value)
+}
+
+// set puts value at id. The caller must hold the write lock.
+func (tx *Transaction) set(id string, value types.Value) error {
+	err := tx.me.Set(types.String(id), value)
 	if err != nil {
 		return fmt.Errorf("could not Put '%s'='%s': %w", id, value, err)
 	}
 
+	tx.edits.set(id, value)
+	tx.clearExpiry(id)
 	tx.wrote = true
+	tx.scannedIndexes = nil
 	return nil
 }
 
@@ -131,18 +214,181 @@ func (tx *Transaction) Del(id string) (ok bool, err error) {
 	if tx.closed {
 		return false, ErrClosed
 	}
+	return tx.remove(id)
+}
 
+// remove deletes the entry at id, if any. The caller must hold the write lock.
+func (tx *Transaction) remove(id string) (ok bool, err error) {
 	k := types.String(id)
 	ok = tx.me.Has(k)
 	if ok {
 		err = tx.me.Remove(k)
 		if err == nil {
+			tx.edits.remove(id)
+			tx.clearExpiry(id)
 			tx.wrote = true
+			tx.scannedIndexes = nil
 		}
 	}
 	return ok, err
 }
 
+// clearExpiry removes the TTL of id, if any. The caller must hold the write lock.
+func (tx *Transaction) clearExpiry(id string) {
+	if tx.expires != nil {
+		tx.expires.Remove(types.String(id))
+	}
+}
+
+// CreateIndex adds a secondary index with the given name and definition. The
+// index is built when the transaction is committed. Creating an index that
+// already exists with the same definition is a no-op.
+func (tx *Transaction) CreateIndex(name string, def IndexDefinition) error {
+	defer tx.lock()()
+
+	if tx.closed {
+		return ErrClosed
+	}
+	if tx.isLocal {
+		return ErrLocalIndex
+	}
+	if name == "" {
+		return errors.New("index name must be non-empty")
+	}
+	if _, err := parseJSONPointer(def.JSONPath); err != nil {
+		return err
+	}
+	indexes, err := tx.basis.Indexes(tx.db.noms)
+	if err != nil {
+		return err
+	}
+	existing, ok := tx.createdIndexes[name]
+	if !ok && !tx.droppedIndexes[name] {
+		var idx Index
+		idx, ok = indexes[name]
+		existing = idx.Definition
+	}
+	if ok {
+		if existing != def {
+			return fmt.Errorf("index %s already exists with a different definition", name)
+		}
+		return nil
+	}
+
+	if tx.createdIndexes == nil {
+		tx.createdIndexes = map[string]IndexDefinition{}
+	}
+	tx.createdIndexes[name] = def
+	tx.wrote = true
+	tx.scannedIndexes = nil
+	return nil
+}
+
+// DropIndex removes the secondary index with the given name.
+func (tx *Transaction) DropIndex(name string) error {
+	defer tx.lock()()
+
+	if tx.closed {
+		return ErrClosed
+	}
+	if tx.isLocal {
+		return ErrLocalIndex
+	}
+	if _, ok := tx.createdIndexes[name]; ok {
+		delete(tx.createdIndexes, name)
+		tx.scannedIndexes = nil
+		return nil
+	}
+	indexes, err := tx.basis.Indexes(tx.db.noms)
+	if err != nil {
+		return err
+	}
+	if _, ok := indexes[name]; !ok || tx.droppedIndexes[name] {
+		return fmt.Errorf("%w: %s", ErrNoSuchIndex, name)
+	}
+	if tx.droppedIndexes == nil {
+		tx.droppedIndexes = map[string]bool{}
+	}
+	tx.droppedIndexes[name] = true
+	tx.wrote = true
+	tx.scannedIndexes = nil
+	return nil
+}
+
+// ScanIndex is like Scan but iterates the named secondary index. The ScanOptions
+// bounds apply to the secondary keys, and the returned items carry the primary
+// keys and values.
+func (tx *Transaction) ScanIndex(name string, opts ScanOptions) ([]ScanItem, error) {
+	defer tx.rlock()()
+
+	if tx.closed {
+		return nil, ErrClosed
+	}
+	if tx.isLocal {
+		return nil, ErrLocalIndex
+	}
+	idx, err := tx.scannedIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := tx.db.codec.compile(opts.Where)
+	if err != nil {
+		return nil, err
+	}
+	return scanIndex(idx, func(k types.String) types.Value {
+		return tx.me.Get(k)
+	}, opts, f)
+}
+
+// scannedIndex returns the overlay of the named index for the pending writes.
+// Only that index is updated, nothing is written, and the overlay is cached
+// until the next write. The caller must hold the read lock.
+func (tx *Transaction) scannedIndex(name string) (indexOverlay, error) {
+	tx.scanMutex.Lock()
+	defer tx.scanMutex.Unlock()
+	if idx, ok := tx.scannedIndexes[name]; ok {
+		return idx, nil
+	}
+
+	var idx indexOverlay
+	if def, ok := tx.createdIndexes[name]; ok {
+		idx = newIndexOverlay(def, types.NewMap(tx.db.noms), tx.base, true, &tx.edits)
+	} else {
+		indexes, err := tx.basis.Indexes(tx.db.noms)
+		if err != nil {
+			return indexOverlay{}, err
+		}
+		basis, ok := indexes[name]
+		if !ok || tx.droppedIndexes[name] {
+			return indexOverlay{}, fmt.Errorf("%w: %s", ErrNoSuchIndex, name)
+		}
+		idx = newIndexOverlay(basis.Definition, basis.Data.TargetValue(tx.db.noms).(types.Map), tx.base, false, &tx.edits)
+	}
+	if tx.scannedIndexes == nil {
+		tx.scannedIndexes = map[string]indexOverlay{}
+	}
+	tx.scannedIndexes[name] = idx
+	return idx, nil
+}
+
+// indexes returns the indexes of the basis updated for data, which is the synced
+// data as modified by this transaction, and for the indexes created and dropped
+// in this transaction.
+func (tx *Transaction) indexes(data types.Map) (map[string]Index, error) {
+	indexes, err := tx.basis.Indexes(tx.db.noms)
+	if err != nil {
+		return nil, err
+	}
+	for name := range tx.droppedIndexes {
+		delete(indexes, name)
+	}
+	indexes = updateIndexes(tx.db.noms, indexes, tx.basis.Data(tx.db.noms).NomsMap(), data)
+	for name, def := range tx.createdIndexes {
+		indexes[name] = buildIndex(tx.db.noms, def, data)
+	}
+	return indexes, nil
+}
+
 // Close the transaction without committing any possible changes done in this
 // transaction.
 func (tx *Transaction) Close() error {
@@ -152,13 +398,17 @@ func (tx *Transaction) Close() error {
 		return ErrClosed
 	}
 	tx.closed = true
+	tx.db.forget(tx.txState)
 	return nil
 }
 
 // Commit tries to commit the changes made to the database in this transaction.
 // If this returns without an error the commit succeeded and the (possibly) new
-// ref of the database head is returned. If there were no writes in the
-// transaction the returned ref is the unchanged ref used as the basis.
+// ref of the database head is returned. If there were no writes to the synced
+// data in the transaction the returned ref is the unchanged ref used as the
+// basis. Writes to the local keyspace are committed along with the new head
+// but don't create a commit of their own. Replay transactions only commit the
+// synced data: their local writes were applied when the mutation first ran.
 func (tx *Transaction) Commit(l zl.Logger) (types.Ref, error) {
 	defer tx.lock()()
 
@@ -167,17 +417,49 @@ func (tx *Transaction) Commit(l zl.Logger) (types.Ref, error) {
 	}
 
 	tx.closed = true
+	tx.db.forget(tx.txState)
+	done, err := tx.db.beginOp()
+	if err != nil {
+		return types.Ref{}, err
+	}
+	defer done()
+
+	if tx.db.readOnly && (tx.synced.wrote || tx.local.wrote) {
+		return types.Ref{}, ErrReadOnly
+	}
+	size, err := tx.checkQuota()
+	if err != nil {
+		return types.Ref{}, err
+	}
 
-	if !tx.wrote {
+	var newLocal *localState
+	if tx.local.wrote && !tx.IsReplay() {
+		newLocal = &localState{tx.local.me.Build(), tx.local.expires.Map()}
+	}
+
+	if !tx.synced.wrote {
+		if newLocal == nil {
+			return tx.basis.Ref(), nil
+		}
+		if err := tx.db.commit(nil, tx.local.base, newLocal); err != nil {
+			return types.Ref{}, tx.commitError(err, l)
+		}
+		tx.db.addUsage(size)
+		tx.committedLocal = newLocal.data.NomsMap().Hash()
 		return tx.basis.Ref(), nil
 	}
 
 	// Commmit.
 	basis := tx.basis.Ref()
 
-	newMap := tx.me.Build()
+	newMap := tx.synced.me.Build()
 	newDataChecksum := newMap.NomsChecksum()
 	newData := tx.db.noms.WriteValue(newMap.NomsMap())
+	indexes, err := tx.indexes(newMap.NomsMap())
+	if err != nil {
+		return types.Ref{}, err
+	}
+	newIndexes := writeIndexes(tx.db.noms, indexes)
 
 	var commit Commit
 	if tx.IsReplay() {
@@ -188,21 +470,48 @@ func (tx *Transaction) Commit(l zl.Logger) (types.Ref, error) {
 		if err != nil {
 			return types.Ref{}, err
 		}
-		commit = makeReplayedLocal(tx.db.noms, basis, time.DateTime(), tx.basis.NextMutationID(), tx.name, tx.args, newData, newDataChecksum, (*tx.original).Ref())
+		commit = makeReplayedLocal(tx.db.noms, basis, time.DateTime(), tx.basis.NextMutationID(), tx.name, tx.args, newData, newDataChecksum, (*tx.original).Ref(), newIndexes)
 		return tx.db.noms.WriteValue(commit.NomsStruct), nil
 	}
 
-	commit = makeLocal(tx.db.noms, basis, time.DateTime(), tx.basis.NextMutationID(), tx.name, tx.args, newData, newDataChecksum)
+	commit = makeLocal(tx.db.noms, basis, time.DateTime(), tx.basis.NextMutationID(), tx.name, tx.args, newData, newDataChecksum, newIndexes)
 	ref := tx.db.noms.WriteValue(commit.NomsStruct)
-	err := tx.db.setHead(commit)
+	err = tx.db.commit(&commit, tx.local.base, newLocal)
 	if err == nil {
+		tx.db.addUsage(size)
+		tx.committedHead = ref.TargetHash()
+		if newLocal != nil {
+			tx.committedLocal = newLocal.data.NomsMap().Hash()
+		}
 		return ref, nil
 	}
+	return types.Ref{}, tx.commitError(err, l)
+}
+
+// Changes returns the hashes of the head and of the local keyspace data that
+// the transaction is based on, and those after it was committed, from which
+// the changes of its commit can be diffed. The old and new hashes are equal if
+// the commit didn't change them, such as the head for replays, or if the
+// transaction wasn't committed.
+func (tx *Transaction) Changes() (oldHead, newHead, oldLocal, newLocal hash.Hash) {
+	defer tx.rlock()()
+	oldHead, newHead = tx.basis.NomsStruct.Hash(), tx.committedHead
+	oldLocal, newLocal = tx.local.base.Hash(), tx.committedLocal
+	if newHead.IsEmpty() {
+		newHead = oldHead
+	}
+	if newLocal.IsEmpty() {
+		newLocal = oldLocal
+	}
+	return oldHead, newHead, oldLocal, newLocal
+}
+
+// commitError wraps an error from DB.commit in a CommitError.
+func (tx *Transaction) commitError(err error, l zl.Logger) error {
 	if !errors.Is(err, datas.ErrMergeNeeded) && !errors.Is(err, datas.ErrOptimisticLockFailed) {
 		l.Err(err).Msg("Unexpected error from FastForward")
 	}
-	err = NewCommitError(err)
-	return types.Ref{}, err
+	return NewCommitError(err)
 }
 
 func ValidateReplayParams(original Commit, name string, args types.Value, mutationID uint64) error {
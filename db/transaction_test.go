@@ -3,6 +3,7 @@ package db
 import (
 	"testing"
 
+	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/marshal"
 	"github.com/attic-labs/noms/go/nomdl"
 	"github.com/attic-labs/noms/go/spec"
@@ -321,3 +322,39 @@ func TestReplayWriteTransaction(t *testing.T) {
 		}
 	}
 }
+
+func TestTransactionChanges(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+	head, local := db.HeadHash(), db.LocalHash()
+
+	tx := db.NewTransaction()
+	assert.NoError(tx.Put("a", []byte("1")))
+	assert.NoError(tx.Local().Put("b", []byte("2")))
+	oldHead, newHead, oldLocal, newLocal := tx.Changes()
+	assert.Equal([]hash.Hash{head, head, local, local}, []hash.Hash{oldHead, newHead, oldLocal, newLocal})
+
+	// Another commit lands before this one is diffed, which must not be part
+	// of its changes.
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+	committedHead, committedLocal := db.HeadHash(), db.LocalHash()
+	other := db.NewTransaction()
+	assert.NoError(other.Put("c", []byte("3")))
+	assert.NoError(other.Local().Put("d", []byte("4")))
+	_, err = other.Commit(log.Default())
+	assert.NoError(err)
+	oldHead, newHead, oldLocal, newLocal = tx.Changes()
+	assert.Equal([]hash.Hash{head, committedHead, local, committedLocal}, []hash.Hash{oldHead, newHead, oldLocal, newLocal})
+
+	// Local writes only.
+	tx = db.NewTransaction()
+	assert.NoError(tx.Local().Put("b", []byte("5")))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	oldHead, newHead, oldLocal, newLocal = tx.Changes()
+	assert.Equal(oldHead, newHead)
+	assert.Equal(db.HeadHash(), newHead)
+	assert.NotEqual(oldLocal, newLocal)
+	assert.Equal(db.LocalHash(), newLocal)
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/attic-labs/noms/go/types"
+
+	"roci.dev/diff-server/util/chk"
+)
+
+// ErrSyncedTTL is returned from PutWithTTL on the synced data.
+var ErrSyncedTTL = errors.New("TTLs are only supported in the local keyspace")
+
+// PutWithTTL is like Put but the entry expires after ttl: it is hidden from
+// transactions that start after then, and removed by the next sweep. Any other
+// write to id clears its TTL. Only the local keyspace supports TTLs.
+func (tx *Transaction) PutWithTTL(id string, json []byte, ttl time.Duration) error {
+	if !tx.isLocal {
+		return ErrSyncedTTL
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("could not Put '%s': TTL must be positive", id)
+	}
+	if tx.Closed() {
+		return ErrClosed
+	}
+
+	value, err := tx.db.codec.fromJSON(json, tx.db.noms)
+	if err != nil {
+		return fmt.Errorf("could not Put '%s'='%s': %w", id, json, err)
+	}
+
+	defer tx.lock()()
+
+	if tx.closed {
+		return ErrClosed
+	}
+	if err := tx.set(id, value); err != nil {
+		return err
+	}
+	at := tx.db.now().Add(ttl)
+	tx.expires.Set(types.String(id), types.Number(unixMillis(at)))
+	return nil
+}
+
+// expiries are the expiry times of the keys put with a TTL, in unix
+// milliseconds. They are kept both by key, to clear a key's TTL when it is
+// written, and by time, so that finding the expired keys only reads those.
+type expiries struct {
+	byKey  types.Map // Map<String, Number>
+	byTime types.Map // Map<String, String> from expiryKey to key.
+}
+
+func newExpiries(noms types.ValueReadWriter) expiries {
+	return expiries{types.NewMap(noms), types.NewMap(noms)}
+}
+
+// indexExpiries returns the expiries for byKey, building the index by time.
+func indexExpiries(noms types.ValueReadWriter, byKey types.Map) expiries {
+	ed := types.NewMap(noms).Edit()
+	byKey.IterAll(func(k, v types.Value) {
+		ed.Set(expiryKey(k.(types.String), v.(types.Number)), k)
+	})
+	return expiries{byKey, ed.Map()}
+}
+
+func (e expiries) Empty() bool {
+	return e.byKey.Empty()
+}
+
+func (e expiries) Edit() *expiriesEditor {
+	return &expiriesEditor{e.byKey.Edit(), e.byTime.Edit()}
+}
+
+// expiryKey returns the key in expiries.byTime of key, which expires at
+// millis. The zero-padded time sorts the keys by when they expire.
+func expiryKey(key types.String, millis types.Number) types.String {
+	return types.String(fmt.Sprintf("%020d\x00%s", int64(millis), key))
+}
+
+type expiriesEditor struct {
+	byKey  *types.MapEditor
+	byTime *types.MapEditor
+}
+
+// Get returns the expiry time of key, or nil if it has no TTL.
+func (ee *expiriesEditor) Get(key types.String) types.Value {
+	if v := ee.byKey.Get(key); v != nil {
+		return v.Value()
+	}
+	return nil
+}
+
+func (ee *expiriesEditor) Set(key types.String, millis types.Number) {
+	ee.Remove(key)
+	ee.byKey.Set(key, millis)
+	ee.byTime.Set(expiryKey(key, millis), key)
+}
+
+func (ee *expiriesEditor) Remove(key types.String) {
+	if v := ee.Get(key); v != nil {
+		ee.byTime.Remove(expiryKey(key, v.(types.Number)))
+		ee.byKey.Remove(key)
+	}
+}
+
+func (ee *expiriesEditor) Map() expiries {
+	return expiries{ee.byKey.Map(), ee.byTime.Map()}
+}
+
+// newLocalKeyspace returns the keyspace for ls in a transaction that starts at
+// now. The entries that have expired by then are removed up front, but that
+// alone doesn't count as a write.
+func newLocalKeyspace(ls localState, now time.Time) *keyspace {
+	ks := newKeyspace(ls.data, true)
+	ks.expires = ls.expires.Edit()
+	for _, k := range expiredKeys(ls.expires, now) {
+		chk.NoError(ks.me.Remove(k))
+		ks.edits.remove(string(k))
+		ks.expires.Remove(k)
+	}
+	return ks
+}
+
+// Sweep removes the expired entries from the local keyspace and returns their
+// number. Expired entries are also swept when the DB is loaded.
+func (db *DB) Sweep() (int, error) {
+	defer db.lock()()
+	if db.closed {
+		return 0, ErrDBClosed
+	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	return db.sweepLocked()
+}
+
+func (db *DB) sweepLocked() (int, error) {
+	expired := expiredKeys(db.local.expires, db.now())
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	me := db.local.data.Edit()
+	ee := db.local.expires.Edit()
+	for _, k := range expired {
+		if err := me.Remove(k); err != nil {
+			return 0, err
+		}
+		ee.Remove(k)
+	}
+	return len(expired), db.writeLocalLocked(localState{me.Build(), ee.Map()}, db.head)
+}
+
+// expiredKeys returns the keys in expires that have expired at now. Only the
+// expired entries of the index by time are read.
+func expiredKeys(expires expiries, now time.Time) []types.String {
+	var res []types.String
+	end := expiryKey("", types.Number(unixMillis(now)+1))
+	expires.byTime.Iter(func(k, v types.Value) bool {
+		if k.(types.String) >= end {
+			return true
+		}
+		res = append(res, v.(types.String))
+		return false
+	})
+	return res
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
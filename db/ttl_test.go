@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+)
+
+func TestTTL(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	now := time.Unix(1000, 0)
+	opts := Options{Now: func() time.Time { return now }}
+	load := func() *DB {
+		sp, err := spec.ForDatabase(dir)
+		assert.NoError(err)
+		db, err := LoadWithOptions(sp, opts)
+		assert.NoError(err)
+		return db
+	}
+	keys := func(tx *Transaction) []string {
+		items, err := tx.Local().Scan(ScanOptions{KeysOnly: true})
+		assert.NoError(err)
+		r := []string{}
+		for _, it := range items {
+			r = append(r, it.Key)
+		}
+		return r
+	}
+
+	db := load()
+	head := db.HeadHash()
+	tx := db.NewTransaction()
+	assert.True(errors.Is(tx.PutWithTTL("a", []byte(`1`), time.Minute), ErrSyncedTTL))
+	assert.EqualError(tx.Local().PutWithTTL("a", []byte(`1`), 0), "could not Put 'a': TTL must be positive")
+	assert.NoError(tx.Local().PutWithTTL("a", []byte(`1`), time.Minute))
+	assert.NoError(tx.Local().PutWithTTL("b", []byte(`2`), time.Hour))
+	assert.NoError(tx.Local().PutWithTTL("c", []byte(`3`), time.Minute))
+	assert.NoError(tx.Local().Put("c", []byte(`3`)))
+	assert.NoError(tx.Local().Put("d", []byte(`4`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	tx = db.NewTransaction()
+	assert.Equal([]string{"a", "b", "c", "d"}, keys(tx))
+	tx.Close()
+
+	// Expired entries are hidden.
+	now = now.Add(2 * time.Minute)
+	tx = db.NewTransaction()
+	assert.Equal([]string{"b", "c", "d"}, keys(tx))
+	has, err := tx.Local().Has("a")
+	assert.NoError(err)
+	assert.False(has)
+	v, err := tx.Local().Get("a")
+	assert.NoError(err)
+	assert.Nil(v)
+	tx.Close()
+
+	// And swept.
+	n, err := db.Sweep()
+	assert.NoError(err)
+	assert.Equal(1, n)
+	n, err = db.Sweep()
+	assert.NoError(err)
+	assert.Equal(0, n)
+	assert.False(db.local.data.NomsMap().Has(types.String("a")))
+	assert.Equal(head, db.HeadHash())
+
+	// Committing a write also removes expired entries.
+	now = now.Add(2 * time.Hour)
+	tx = db.NewTransaction()
+	assert.NoError(tx.Local().Put("e", []byte(`5`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	assert.False(db.local.data.NomsMap().Has(types.String("b")))
+	assert.True(db.local.expires.Empty())
+
+	// Loading sweeps.
+	tx = db.NewTransaction()
+	assert.NoError(tx.Local().PutWithTTL("f", []byte(`6`), time.Second))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+	now = now.Add(time.Second)
+	db = load()
+	assert.False(db.local.data.NomsMap().Has(types.String("f")))
+	tx = db.NewTransaction()
+	defer tx.Close()
+	assert.Equal([]string{"c", "d", "e"}, keys(tx))
+	assert.Equal(head, db.HeadHash())
+}
+
+func TestExpiredKeys(t *testing.T) {
+	assert := assert.New(t)
+	sp, err := spec.ForDatabase("mem")
+	assert.NoError(err)
+	noms := sp.GetDatabase()
+
+	ee := newExpiries(noms).Edit()
+	ee.Set("c", 3000)
+	ee.Set("a", 1000)
+	ee.Set("b", 1000)
+	ee.Set("d", 500)
+	// Setting a key again replaces its expiry.
+	ee.Set("d", 20000)
+	ee.Set("e", 10000)
+	ee.Remove("e")
+	e := ee.Map()
+	assert.Equal(uint64(4), e.byTime.Len())
+
+	for _, tc := range []struct {
+		now      int64
+		expected []types.String
+	}{
+		{999, nil},
+		{1000, []types.String{"a", "b"}},
+		{2999, []types.String{"a", "b"}},
+		{3000, []types.String{"a", "b", "c"}},
+		{20000, []types.String{"a", "b", "c", "d"}},
+	} {
+		assert.Equal(tc.expected, expiredKeys(e, time.Unix(0, tc.now*int64(time.Millisecond))), "%d", tc.now)
+	}
+
+	// The index by time is rebuilt for data written without it.
+	assert.True(e.byTime.Equals(indexExpiries(noms, e.byKey).byTime))
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
+
+	"roci.dev/diff-server/kv"
+)
+
+// VerifyCheck names an invariant that Verify checks.
+type VerifyCheck string
+
+const (
+	// VerifyCheckReachability is violated by chunks that are referenced but
+	// missing.
+	VerifyCheckReachability VerifyCheck = "reachability"
+	// VerifyCheckSchema is violated by commits that don't conform to the commit
+	// schema or whose data or indexes can't be read.
+	VerifyCheckSchema VerifyCheck = "schema"
+	// VerifyCheckChecksum is violated by commits, or the local keyspace, whose
+	// checksum doesn't match their data.
+	VerifyCheckChecksum VerifyCheck = "checksum"
+	// VerifyCheckMutationID is violated by local commits whose mutation ID is
+	// not greater than the mutation ID of their basis.
+	VerifyCheckMutationID VerifyCheck = "mutationID"
+	// VerifyCheckLastMutationID is violated by snapshots whose last mutation ID
+	// is less than that of an earlier snapshot.
+	VerifyCheckLastMutationID VerifyCheck = "lastMutationID"
+)
+
+// VerifyIssue is a violated invariant found by Verify. Hash is the commit, or
+// chunk, that violates it.
+type VerifyIssue struct {
+	Check   VerifyCheck `json:"check"`
+	Hash    string      `json:"hash"`
+	Message string      `json:"message"`
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// Commits is the number of commits checked.
+	Commits int           `json:"commits"`
+	Issues  []VerifyIssue `json:"issues"`
+}
+
+// OK returns true if no issues were found.
+func (r VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Verify checks the integrity of the database: that every chunk reachable from
+// its datasets is present and that every commit from the head back to genesis
+// conforms to the schema, has the checksum of its data and has a mutation ID
+// consistent with its basis. The local keyspace's checksum is checked too.
+// Verify reads the whole history, so it is meant as a diagnostic tool.
+// Violations are reported in the VerifyReport, the error is only for failing
+// to run the checks.
+func (db *DB) Verify() (VerifyReport, error) {
+	done, err := db.beginOp()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer done()
+
+	v := verifier{
+		noms:      db.noms,
+		visited:   map[hash.Hash]bool{},
+		checksums: map[hash.Hash]types.String{},
+		report:    VerifyReport{Issues: []VerifyIssue{}},
+	}
+	db.noms.Datasets().IterAll(func(k, r types.Value) {
+		v.walk(r.(types.Ref), fmt.Sprintf("dataset %s", k.(types.String)))
+	})
+	v.checkChain(db.Head().NomsStruct.Hash())
+
+	ds := db.noms.GetDataset(LOCAL_DATASET)
+	if ds.HasHead() {
+		var ld localData
+		if err := marshal.Unmarshal(ds.HeadValue(), &ld); err != nil {
+			v.add(VerifyCheckSchema, ds.HeadRef().TargetHash(), "could not unmarshal local keyspace: %s", err)
+		} else {
+			v.checkChecksum(ds.HeadRef().TargetHash(), "local keyspace", ld.Data, ld.Checksum)
+		}
+	}
+	return v.report, nil
+}
+
+type verifier struct {
+	noms      types.ValueReadWriter
+	visited   map[hash.Hash]bool
+	checksums map[hash.Hash]types.String // the checksums of the data maps checked so far.
+	report    VerifyReport
+}
+
+func (v *verifier) add(check VerifyCheck, h hash.Hash, format string, args ...interface{}) {
+	v.report.Issues = append(v.report.Issues, VerifyIssue{check, h.String(), fmt.Sprintf(format, args...)})
+}
+
+// walk reports the chunks reachable from r that are missing. what describes r.
+func (v *verifier) walk(r types.Ref, what string) {
+	stack := []hash.Hash{r.TargetHash()}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if v.visited[h] {
+			continue
+		}
+		v.visited[h] = true
+		val := v.noms.ReadValue(h)
+		if val == nil {
+			v.add(VerifyCheckReachability, h, "chunk %s reachable from %s is missing", h, what)
+			continue
+		}
+		val.WalkRefs(func(r types.Ref) {
+			stack = append(stack, r.TargetHash())
+		})
+	}
+}
+
+// checkChain checks the commits from the one with hash h back to genesis.
+func (v *verifier) checkChain(h hash.Hash) {
+	var newer *Commit // the snapshot most recently checked, which is the next newer one.
+	for {
+		c, ok := v.readCommit(h)
+		if !ok {
+			return
+		}
+		v.report.Commits++
+		v.checkChecksum(h, "commit", c.Value.Data, c.Value.Checksum)
+		if _, err := c.Indexes(v.noms); err != nil {
+			v.add(VerifyCheckSchema, h, "%s", err)
+		}
+		if c.Type() == CommitTypeSnapshot {
+			if newer != nil && c.MutationID() > newer.MutationID() {
+				v.add(VerifyCheckLastMutationID, h, "snapshot has lastMutationID %d, greater than %d of later snapshot %s",
+					c.MutationID(), newer.MutationID(), newer.NomsStruct.Hash())
+			}
+			s := c
+			newer = &s
+		}
+
+		switch len(c.Parents) {
+		case 0:
+			return
+		case 1:
+		default:
+			v.add(VerifyCheckSchema, h, "commit has %d parents", len(c.Parents))
+			return
+		}
+		basisHash := c.Parents[0].TargetHash()
+		basis, ok := v.readCommit(basisHash)
+		if !ok {
+			return
+		}
+		if c.Type() == CommitTypeLocal && c.MutationID() <= basis.MutationID() {
+			v.add(VerifyCheckMutationID, h, "local commit has mutation ID %d, not greater than %d of its basis %s",
+				c.MutationID(), basis.MutationID(), basisHash)
+		}
+		h = basisHash
+	}
+}
+
+// readCommit reads the commit with hash h and checks it against the schema.
+// Missing commits have been reported by walk already.
+func (v *verifier) readCommit(h hash.Hash) (Commit, bool) {
+	val := v.noms.ReadValue(h)
+	if val == nil {
+		return Commit{}, false
+	}
+	if t := types.TypeOf(val); !types.IsSubtype(schema, t) {
+		v.add(VerifyCheckSchema, h, "commit has non-Replicache type %s", t.Describe())
+		return Commit{}, false
+	}
+	var c Commit
+	if err := marshal.Unmarshal(val, &c); err != nil {
+		v.add(VerifyCheckSchema, h, "could not unmarshal commit: %s", err)
+		return Commit{}, false
+	}
+	return c, true
+}
+
+// checkChecksum checks that checksum is the checksum of the map that data refers
+// to. h is the commit, described by what, with the data.
+func (v *verifier) checkChecksum(h hash.Hash, what string, data types.Ref, checksum types.String) {
+	dh := data.TargetHash()
+	actual, ok := v.checksums[dh]
+	if !ok {
+		var err error
+		if actual, err = v.computeChecksum(data); err != nil {
+			v.add(VerifyCheckSchema, h, "could not read data of %s: %s", what, err)
+			return
+		}
+		v.checksums[dh] = actual
+	}
+	if actual != checksum {
+		v.add(VerifyCheckChecksum, h, "%s has checksum %s but its data has checksum %s", what, checksum, actual)
+	}
+}
+
+// computeChecksum returns the checksum of the map that data refers to. Missing
+// chunks make noms panic, which is returned as an error.
+func (v *verifier) computeChecksum(data types.Ref) (checksum types.String, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	m, ok := data.TargetValue(v.noms).(types.Map)
+	if !ok {
+		return "", fmt.Errorf("data %s is not a map", data.TargetHash())
+	}
+	ed := kv.NewMap(v.noms).Edit()
+	m.IterAll(func(k, val types.Value) {
+		if err == nil {
+			err = ed.Set(k, val)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return ed.Build().NomsChecksum(), nil
+}
+
+// checkPending checks the mutation IDs of the local commits from c back to its
+// snapshot, which must be strictly increasing.
+func checkPending(noms types.ValueReadWriter, c Commit) error {
+	pending, err := pendingCommits(noms, c)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	prev, err := pending[0].Basis(noms)
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if p.MutationID() <= prev.MutationID() {
+			return fmt.Errorf("commit %s has mutation ID %d, not greater than %d of its basis", p.NomsStruct.Hash(), p.MutationID(), prev.MutationID())
+		}
+		prev = p
+	}
+	return nil
+}
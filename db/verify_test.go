@@ -0,0 +1,62 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/attic-labs/noms/go/util/datetime"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/kv"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := LoadTempDB(assert)
+
+	tx := db.NewTransactionWithArgs("m1", types.String("arg"), nil, nil)
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	assert.NoError(tx.Local().Put("draft", []byte(`1`)))
+	_, err := tx.Commit(log.Default())
+	assert.NoError(err)
+
+	r, err := db.Verify()
+	assert.NoError(err)
+	assert.True(r.OK(), "%v", r.Issues)
+	assert.Equal(2, r.Commits)
+
+	// A snapshot with a wrong checksum and a lower lastMutationID than its
+	// basis, and a local commit that reuses the mutation ID of its basis.
+	m := kv.NewMap(db.noms)
+	ed := m.Edit()
+	assert.NoError(ed.Set(types.String("a"), types.Number(1)))
+	snapshot := makeSnapshot(db.noms, db.Head().Ref(), "ssid", db.noms.WriteValue(ed.Build().NomsMap()), m.NomsChecksum(), 0, types.Ref{})
+	db.noms.WriteValue(snapshot.NomsStruct)
+	higher := makeSnapshot(db.noms, snapshot.Ref(), "ssid2", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 5, types.Ref{})
+	db.noms.WriteValue(higher.NomsStruct)
+	lower := makeSnapshot(db.noms, higher.Ref(), "ssid3", db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), 4, types.Ref{})
+	db.noms.WriteValue(lower.NomsStruct)
+	local := makeLocal(db.noms, lower.Ref(), datetime.Now(), 4, "m2", types.NewList(db.noms), db.noms.WriteValue(m.NomsMap()), m.NomsChecksum(), types.Ref{})
+	db.noms.WriteValue(local.NomsStruct)
+	assert.NoError(db.setHead(local))
+
+	r, err = db.Verify()
+	assert.NoError(err)
+	assert.Equal(6, r.Commits)
+	checks := map[VerifyCheck]hash.Hash{}
+	for _, i := range r.Issues {
+		checks[i.Check] = hash.Parse(i.Hash)
+	}
+	assert.Equal(map[VerifyCheck]hash.Hash{
+		VerifyCheckChecksum:       snapshot.NomsStruct.Hash(),
+		VerifyCheckLastMutationID: higher.NomsStruct.Hash(),
+		VerifyCheckMutationID:     local.NomsStruct.Hash(),
+	}, checks)
+	assert.Equal(3, len(r.Issues))
+
+	assert.NoError(db.Close())
+	_, err = db.Verify()
+	assert.Equal(ErrDBClosed, err)
+}
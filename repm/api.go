@@ -1,10 +1,13 @@
 package repm
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/attic-labs/noms/go/hash"
 	zl "github.com/rs/zerolog"
@@ -14,15 +17,28 @@ import (
 )
 
 type connection struct {
+	name               string
 	dir                string
 	db                 *db.DB
 	transactions       map[int]*db.Transaction
 	transactionCounter int
 	transactionMutex   sync.RWMutex
+	inMemory           bool
+	watchMutex         sync.Mutex // guards watches, which reloads notify from another goroutine.
+	watches            map[int]watch
+	watchCounter       int
+	cursors            map[int]cursor
+	cursorCounter      int
 }
 
-func newConnection(d *db.DB, p string) *connection {
-	return &connection{db: d, dir: p, transactions: map[int]*db.Transaction{}, transactionCounter: 1}
+// cursor is an open scan cursor and the ID of the transaction it belongs to.
+type cursor struct {
+	txID int
+	sc   *db.ScanCursor
+}
+
+func newConnection(name string, d *db.DB, p string) *connection {
+	return &connection{name: name, db: d, dir: p, transactions: map[int]*db.Transaction{}, transactionCounter: 1, watches: map[int]watch{}, watchCounter: 1, cursors: map[int]cursor{}, cursorCounter: 1}
 }
 
 func (conn *connection) findTransaction(txID int) (*db.Transaction, error) {
@@ -38,10 +54,28 @@ func (conn *connection) findTransaction(txID int) (*db.Transaction, error) {
 	return nil, fmt.Errorf("Invalid transaction ID: %d", txID)
 }
 
+// transaction returns the transaction of req, or its Local view if req is for
+// the local keyspace.
+func (conn *connection) transaction(req transactionRequest) (*db.Transaction, error) {
+	tx, err := conn.findTransaction(req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Local {
+		return tx.Local(), nil
+	}
+	return tx, nil
+}
+
 func (conn *connection) removeTransaction(txID int) {
 	conn.transactionMutex.Lock()
 	defer conn.transactionMutex.Unlock()
 	delete(conn.transactions, txID)
+	for id, c := range conn.cursors {
+		if c.txID == txID {
+			delete(conn.cursors, id)
+		}
+	}
 }
 
 func (conn *connection) dispatchGetRoot(reqBytes []byte) ([]byte, error) {
@@ -59,6 +93,106 @@ func (conn *connection) dispatchGetRoot(reqBytes []byte) ([]byte, error) {
 	return mustMarshal(res), nil
 }
 
+// dispatchPersist copies an in-memory database to disk, where opening it without
+// inMemory finds it. The open database stays in memory.
+func (conn *connection) dispatchPersist(reqBytes []byte) ([]byte, error) {
+	var req persistRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	if !conn.inMemory {
+		return nil, errors.New("database is not in memory")
+	}
+	if err := conn.db.Persist(conn.dir); err != nil {
+		return nil, err
+	}
+	return mustMarshal(persistResponse{}), nil
+}
+
+// dispatchExport writes the database to a file in the format of db.Export, to
+// back it up or move it to another device.
+func (conn *connection) dispatchExport(reqBytes []byte) ([]byte, error) {
+	var req exportRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Path == "" {
+		return nil, errors.New("path field is required")
+	}
+	opts := db.ExportOptions{Pending: req.Pending}
+	if req.Hash != nil {
+		opts.Commit = req.Hash.Hash
+	}
+	f, err := os.Create(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.db.Export(f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(req.Path)
+		return nil, err
+	}
+	return mustMarshal(exportResponse{}), nil
+}
+
+// dispatchImport reads a file written by export into the database, which must
+// be empty.
+func (conn *connection) dispatchImport(reqBytes []byte, l zl.Logger) ([]byte, error) {
+	var req importRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Path == "" {
+		return nil, errors.New("path field is required")
+	}
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	oldHead := conn.db.HeadHash()
+	if err := conn.db.Import(f, db.ImportOptions{AdoptClientID: req.AdoptClientID}); err != nil {
+		return nil, err
+	}
+	head := conn.db.HeadHash()
+	conn.notifyWatches(oldHead, head, l)
+	return mustMarshal(importResponse{Head: jsnoms.Hash{Hash: head}}), nil
+}
+
+func (conn *connection) dispatchStats(reqBytes []byte) ([]byte, error) {
+	var req statsRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := conn.db.Stats()
+	if err != nil {
+		return nil, err
+	}
+	return mustMarshal(statsResponse{stats}), nil
+}
+
+// dispatchVerify checks the integrity of the database. Violations are reported
+// in the response, not as an error.
+func (conn *connection) dispatchVerify(reqBytes []byte) ([]byte, error) {
+	var req verifyRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	report, err := conn.db.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return mustMarshal(verifyResponse{report}), nil
+}
+
 func (conn *connection) dispatchHas(reqBytes []byte) ([]byte, error) {
 	var req hasRequest
 	err := json.Unmarshal(reqBytes, &req)
@@ -66,7 +200,7 @@ func (conn *connection) dispatchHas(reqBytes []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	tx, err := conn.findTransaction(req.TransactionID)
+	tx, err := conn.transaction(req.transactionRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +220,7 @@ func (conn *connection) dispatchGet(reqBytes []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	tx, err := conn.findTransaction(req.TransactionID)
+	tx, err := conn.transaction(req.transactionRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -102,22 +236,217 @@ func (conn *connection) dispatchGet(reqBytes []byte) ([]byte, error) {
 	return mustMarshal(res), nil
 }
 
+func (conn *connection) dispatchGetPath(reqBytes []byte) ([]byte, error) {
+	var req getPathRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	v, err := tx.GetPath(req.Key, req.Path)
+	res := getPathResponse{}
+	switch {
+	case errors.Is(err, db.ErrNoSuchKey):
+	case errors.Is(err, db.ErrNoSuchPath):
+		res.Has = true
+	case err != nil:
+		return nil, err
+	default:
+		res.Has = true
+		res.HasPath = true
+		res.Value = v
+	}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchPutBlob(reqBytes []byte) ([]byte, error) {
+	var req putBlobRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	var info db.BlobInfo
+	if req.Offset != nil {
+		info, err = tx.WriteBlob(req.Key, *req.Offset, req.Data)
+	} else {
+		info, err = tx.PutBlob(req.Key, bytes.NewReader(req.Data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := putBlobResponse{info}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchGetBlob(reqBytes []byte) ([]byte, error) {
+	var req getBlobRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	data, info, err := tx.ReadBlob(req.Key, req.Offset, req.Length)
+	res := getBlobResponse{}
+	if errors.Is(err, db.ErrNoSuchKey) {
+		return mustMarshal(res), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Has = true
+	res.Data = data
+	res.BlobInfo = &info
+	return mustMarshal(res), nil
+}
+
 func (conn *connection) dispatchScan(reqBytes []byte) ([]byte, error) {
 	var req scanRequest
 	err := json.Unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
-	tx, err := conn.findTransaction(req.TransactionID)
+	tx, err := conn.transaction(req.transactionRequest)
 	if err != nil {
 		return nil, err
 	}
+	if req.CountOnly {
+		if req.IndexName != "" {
+			return nil, errors.New("countOnly is not supported for index scans")
+		}
+		n, err := tx.Count(req.ScanOptions)
+		if err != nil {
+			return nil, err
+		}
+		return mustMarshal(scanCountResponse{Count: n}), nil
+	}
 	var items scanResponse
-	items, err = tx.Scan(db.ScanOptions(req.ScanOptions))
+	if req.IndexName != "" {
+		items, err = tx.ScanIndex(req.IndexName, req.ScanOptions)
+	} else {
+		items, err = tx.Scan(req.ScanOptions)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return mustMarshal(items), nil
+	return conn.db.ExportJSON(mustMarshal(items))
+}
+
+func (conn *connection) dispatchCreateIndex(reqBytes []byte) ([]byte, error) {
+	var req createIndexRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.CreateIndex(req.Name, req.IndexDefinition)
+	if err != nil {
+		return nil, err
+	}
+	res := createIndexResponse{}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchDropIndex(reqBytes []byte) ([]byte, error) {
+	var req dropIndexRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.DropIndex(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	res := dropIndexResponse{}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchOpenScan(reqBytes []byte) ([]byte, error) {
+	var req openScanRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := tx.OpenScan(req.ScanOptions, req.Continuation)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.transactionMutex.Lock()
+	cursorID := conn.cursorCounter
+	conn.cursorCounter++
+	conn.cursors[cursorID] = cursor{req.TransactionID, sc}
+	conn.transactionMutex.Unlock()
+
+	res := openScanResponse{
+		CursorID: cursorID,
+	}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchScanNext(reqBytes []byte) ([]byte, error) {
+	var req scanNextRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	conn.transactionMutex.RLock()
+	c, ok := conn.cursors[req.CursorID]
+	conn.transactionMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Invalid cursor ID: %d", req.CursorID)
+	}
+	items, err := c.sc.Next(req.Count)
+	if err != nil {
+		return nil, err
+	}
+	res := scanNextResponse{
+		Items:        items,
+		Continuation: c.sc.Continuation(),
+		Done:         c.sc.Done(),
+	}
+	if res.Done {
+		conn.transactionMutex.Lock()
+		delete(conn.cursors, req.CursorID)
+		conn.transactionMutex.Unlock()
+	}
+	return conn.db.ExportJSON(mustMarshal(res))
+}
+
+func (conn *connection) dispatchCloseScan(reqBytes []byte) ([]byte, error) {
+	var req closeScanRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	conn.transactionMutex.Lock()
+	defer conn.transactionMutex.Unlock()
+	if _, ok := conn.cursors[req.CursorID]; !ok {
+		return nil, fmt.Errorf("Invalid cursor ID: %d", req.CursorID)
+	}
+	delete(conn.cursors, req.CursorID)
+	res := closeScanResponse{}
+	return mustMarshal(res), nil
 }
 
 func (conn *connection) dispatchPut(reqBytes []byte) ([]byte, error) {
@@ -129,15 +458,29 @@ func (conn *connection) dispatchPut(reqBytes []byte) ([]byte, error) {
 	if len(req.Value) == 0 {
 		return nil, errors.New("value field is required")
 	}
-	tx, err := conn.findTransaction(req.TransactionID)
+	tx, err := conn.transaction(req.transactionRequest)
 	if err != nil {
 		return nil, err
 	}
-	err = tx.Put(req.Key, req.Value)
-	if err != nil {
-		return nil, err
+	if req.TTL > 0 {
+		if p := req.Precondition; p.Absent || p.Present || len(p.Equals) > 0 {
+			return nil, errors.New("ttl can't be combined with a precondition")
+		}
+		err = tx.PutWithTTL(req.Key, req.Value, time.Duration(req.TTL)*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		return mustMarshal(putResponse{}), nil
 	}
 	res := putResponse{}
+	err = tx.PutIf(req.Key, req.Value, req.Precondition)
+	if err != nil {
+		var preErr db.PreconditionError
+		if !errors.As(err, &preErr) {
+			return nil, err
+		}
+		res.PreconditionFailed = true
+	}
 	return mustMarshal(res), nil
 }
 
@@ -147,16 +490,80 @@ func (conn *connection) dispatchDel(reqBytes []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	tx, err := conn.findTransaction(req.TransactionID)
+	tx, err := conn.transaction(req.transactionRequest)
 	if err != nil {
 		return nil, err
 	}
-	ok, err := tx.Del(req.Key)
+	ok, err := tx.DelIf(req.Key, req.Precondition)
+	res := delResponse{
+		Ok: ok,
+	}
+	if err != nil {
+		var preErr db.PreconditionError
+		if !errors.As(err, &preErr) {
+			return nil, err
+		}
+		res.PreconditionFailed = true
+	}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchPatch(reqBytes []byte) ([]byte, error) {
+	var req patchRequest
+	err := json.Unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
-	res := delResponse{
-		Ok: ok,
+	if len(req.Patch) == 0 {
+		return nil, errors.New("patch field is required")
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Patch(req.Key, req.Format, req.Patch)
+	if err != nil {
+		return nil, err
+	}
+	res := patchResponse{}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchBatch(reqBytes []byte) ([]byte, error) {
+	var req batchRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.transaction(req.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	results, err := tx.Batch(req.Ops)
+	if err != nil {
+		return nil, err
+	}
+	res := batchResponse{
+		Results: results,
+	}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchDiff(reqBytes []byte) ([]byte, error) {
+	var req diffRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.From == nil || req.To == nil {
+		return nil, errors.New("from and to fields are required")
+	}
+	changes, err := conn.db.Diff(req.From.Hash, req.To.Hash, req.DiffOptions)
+	if err != nil {
+		return nil, err
+	}
+	res := diffResponse{
+		Changes: changes,
 	}
 	return mustMarshal(res), nil
 }
@@ -178,16 +585,19 @@ func (conn *connection) dispatchBeginSync(reqBytes []byte, l zl.Logger) ([]byte,
 	return mustMarshal(res), nil
 }
 
-func (conn *connection) dispatchMaybeEndSync(reqBytes []byte) ([]byte, error) {
+func (conn *connection) dispatchMaybeEndSync(reqBytes []byte, l zl.Logger) ([]byte, error) {
 	var req maybeEndSyncRequest
 	err := json.Unmarshal(reqBytes, &req)
 	if err != nil {
 		return nil, err
 	}
-	replay, err := conn.db.MaybeEndSync(req.SyncHead.Hash, req.SyncID)
+	replay, prevHead, err := conn.db.MaybeEndSync(req.SyncHead.Hash, req.SyncID)
 	if err != nil {
 		return nil, fmt.Errorf("sync %s failed: %w", req.SyncID, err)
 	}
+	if !prevHead.IsEmpty() {
+		conn.notifyWatches(prevHead, req.SyncHead.Hash, l)
+	}
 	res := maybeEndSyncResponse{
 		ReplayMutations: replay,
 	}
@@ -204,7 +614,7 @@ func (conn *connection) newTransaction(name string, jsonArgs json.RawMessage, ba
 	if name == "" && len(jsonArgs) == 0 {
 		tx = conn.db.NewTransaction()
 	} else {
-		nomsArgs, err := jsnoms.FromJSON(jsonArgs, conn.db.Noms())
+		nomsArgs, err := conn.db.FromJSON(jsonArgs)
 		if err != nil {
 			return 0, err
 		}
@@ -295,12 +705,20 @@ func (conn *connection) dispatchCommitTransaction(reqBytes []byte, l zl.Logger)
 		res.Ref = &jsnoms.Hash{
 			Hash: commitRef.TargetHash(),
 		}
+		oldHead, newHead, oldLocal, newLocal := tx.Changes()
+		conn.notifyWatches(oldHead, newHead, l)
+		conn.notifyLocalWatches(oldLocal, newLocal, l)
 	} else {
 		var commitErr db.CommitError
-		if !errors.As(err, &commitErr) {
+		var quotaErr db.QuotaError
+		switch {
+		case errors.As(err, &commitErr):
+			res.RetryCommit = true
+		case errors.As(err, &quotaErr):
+			res.QuotaExceeded = true
+		default:
 			return nil, err
 		}
-		res.RetryCommit = true
 	}
 
 	return mustMarshal(res), nil
@@ -74,7 +74,28 @@ func TestBasics(t *testing.T) {
 		{"scan", `{"transactionId": 5, "prefix": "foo"}`, `[{"key":"foo","value":"bar"},{"key":"foopa","value":"doopa"}]`, ""},
 		{"scan", `{"transactionId": 5, "start": {"id": {"value": "foo"}}}`, `[{"key":"foo","value":"bar"},{"key":"foopa","value":"doopa"}]`, ""},
 		{"scan", `{"transactionId": 5, "start": {"id": {"value": "foo", "exclusive": true}}}`, `[{"key":"foopa","value":"doopa"}]`, ""},
+		{"scan", `{"transactionId": 5, "prefix": "foo", "reverse": true, "keysOnly": true}`, `[{"key":"foopa"},{"key":"foo"}]`, ""},
+		{"scan", `{"transactionId": 5, "endBeforeID": "foopa"}`, `[{"key":"foo","value":"bar"}]`, ""},
+		{"scan", `{"transactionId": 5, "endAtID": "foopa", "countOnly": true}`, `{"count":2}`, ""},
+		{"openScan", `{"transactionId": 5, "prefix": "foo"}`, `{"cursorId":1}`, ""},
+		{"scanNext", `{"cursorId": 1, "count": 1}`, `{"items":[{"key":"foo","value":"bar"}],"continuation":"Zm9v"}`, ""},
+		{"scanNext", `{"cursorId": 1, "count": 1}`, `{"items":[{"key":"foopa","value":"doopa"}],"continuation":"Zm9vcGE"}`, ""},
+		{"scanNext", `{"cursorId": 1}`, `{"items":[],"continuation":"Zm9vcGE","done":true}`, ""},
+		{"scanNext", `{"cursorId": 1}`, ``, "Invalid cursor ID: 1"},
+		{"openScan", `{"transactionId": 5, "continuation": "Zm9v"}`, `{"cursorId":2}`, ""},
+		{"scanNext", `{"cursorId": 2, "count": 1}`, `{"items":[{"key":"foopa","value":"doopa"}],"continuation":"Zm9vcGE"}`, ""},
+		{"openScan", `{"transactionId": 5}`, `{"cursorId":3}`, ""},
+		{"closeScan", `{"cursorId": 3}`, `{}`, ""},
+		{"closeScan", `{"cursorId": 3}`, ``, "Invalid cursor ID: 3"},
 		{"closeTransaction", `{"transactionId":5}`, `{}`, ""},
+		{"scanNext", `{"cursorId": 2}`, ``, "Invalid cursor ID: 2"},
+
+		// diff
+		{"diff", invalidRequest, ``, invalidRequestError},
+		{"diff", `{"from": "e99uif9c7bpavajrt666es1ki52dv239"}`, ``, "from and to fields are required"},
+		{"diff", `{"from": "e99uif9c7bpavajrt666es1ki52dv239", "to": "hafgie633fm1pg70olfum414ossa6mt6"}`, `{"changes":[{"op":"add","key":"foo","newValue":"bar"}]}`, ""},
+		{"diff", `{"from": "hafgie633fm1pg70olfum414ossa6mt6", "to": "3enaqu4u7lfn58th9b3dnfp90sf9nrc2", "prefix": "foop"}`, `{"changes":[{"op":"add","key":"foopa","newValue":"doopa"}]}`, ""},
+		{"diff", `{"from": "3enaqu4u7lfn58th9b3dnfp90sf9nrc2", "to": "3enaqu4u7lfn58th9b3dnfp90sf9nrc2"}`, `{"changes":[]}`, ""},
 
 		// Open transaction for replay
 		{"openTransaction", `{"name": "foo", "args": [], "rebaseOpts": {"basis": "e99uif9c7bpavajrt666es1ki52dv239", "original": "e99uif9c7bpavajrt666es1ki52dv239"}}`, ``, "only local mutations"}, // bad basis
@@ -88,6 +109,78 @@ func TestBasics(t *testing.T) {
 		{"openTransaction", `{"name": "foo", "args": []}`, `{"transactionId":9}`, ""},
 		{"commitTransaction", `{"transactionId":9}`, `{"ref":"3enaqu4u7lfn58th9b3dnfp90sf9nrc2"}`, ""},
 
+		// indexes
+		{"openTransaction", `{}`, `{"transactionId":10}`, ""},
+		{"createIndex", `{"transactionId": 10, "name": "byValue", "keyPrefix": "foo", "jsonPath": ""}`, `{}`, ""},
+		{"createIndex", `{"transactionId": 10, "name": "byValue", "keyPrefix": "foo", "jsonPath": "/x"}`, ``, "already exists"},
+		{"scan", `{"transactionId": 10, "indexName": "byValue", "prefix": "d"}`, `[{"key":"foopa","value":"doopa","secondaryKey":"doopa"}]`, ""},
+		{"scan", `{"transactionId": 10, "indexName": "nope"}`, ``, "no such index: nope"},
+		{"dropIndex", `{"transactionId": 10, "name": "byValue"}`, `{}`, ""},
+		{"dropIndex", `{"transactionId": 10, "name": "byValue"}`, ``, "no such index: byValue"},
+		{"closeTransaction", `{"transactionId": 10}`, `{}`, ""},
+
+		// batch
+		{"batch", invalidRequest, ``, invalidRequestError},
+		{"batch", `{"ops": []}`, ``, "Missing transaction ID"},
+		{"openTransaction", `{}`, `{"transactionId":11}`, ""},
+		{"batch", `{"transactionId": 11, "ops": [{"op": "put", "key": "a", "value": 1}, {"op": "del", "key": "foo"}, {"op": "del", "key": "nope"}]}`, `{"results":[{"ok":true},{"ok":true},{"ok":false}]}`, ""},
+		{"batch", `{"transactionId": 11, "ops": [{"op": "del", "key": "a"}, {"op": "put", "key": "b"}]}`, ``, "op 1: value field is required"},
+		{"scan", `{"transactionId": 11}`, `[{"key":"a","value":1},{"key":"foopa","value":"doopa"}]`, ""},
+		{"closeTransaction", `{"transactionId": 11}`, `{}`, ""},
+
+		// conditional writes
+		{"openTransaction", `{}`, `{"transactionId":12}`, ""},
+		{"put", `{"transactionId": 12, "key": "foo", "value": "baz", "precondition": {"absent": true}}`, `{"preconditionFailed":true}`, ""},
+		{"put", `{"transactionId": 12, "key": "foo", "value": "baz", "precondition": {"equals": "nope"}}`, `{"preconditionFailed":true}`, ""},
+		{"put", `{"transactionId": 12, "key": "foo", "value": "baz", "precondition": {"equals": "bar"}}`, `{}`, ""},
+		{"put", `{"transactionId": 12, "key": "foo", "value": "baz", "precondition": {"absent": true, "present": true}}`, ``, "at most one of"},
+		{"del", `{"transactionId": 12, "key": "nope", "precondition": {"present": true}}`, `{"ok":false,"preconditionFailed":true}`, ""},
+		{"del", `{"transactionId": 12, "key": "foo", "precondition": {"equals": "baz"}}`, `{"ok":true}`, ""},
+		{"closeTransaction", `{"transactionId": 12}`, `{}`, ""},
+
+		// patch
+		{"patch", invalidRequest, ``, invalidRequestError},
+		{"openTransaction", `{}`, `{"transactionId":13}`, ""},
+		{"patch", `{"transactionId": 13, "key": "foo"}`, ``, "patch field is required"},
+		{"put", `{"transactionId": 13, "key": "obj", "value": {"a": 1}}`, `{}`, ""},
+		{"patch", `{"transactionId": 13, "key": "obj", "patch": {}}`, ``, "patch format is required"},
+		{"patch", `{"transactionId": 13, "key": "obj", "format": "json-patch", "patch": [{"op": "add", "path": "/b", "value": [true]}]}`, `{}`, ""},
+		{"patch", `{"transactionId": 13, "key": "obj", "format": "merge-patch", "patch": {"a": null}}`, `{}`, ""},
+		{"get", `{"transactionId": 13, "key": "obj"}`, `{"has":true,"value":{"b":[true]}}`, ""},
+		{"patch", `{"transactionId": 13, "key": "obj", "format": "json-patch", "patch": [{"op": "test", "path": "/b/0", "value": false}]}`, ``, "test operation 0 failed: value at '/b/0' is true, expected false"},
+		{"patch", `{"transactionId": 13, "key": "obj", "format": "merge-patch", "patch": [1, 2]}`, `{}`, ""},
+		{"get", `{"transactionId": 13, "key": "obj"}`, `{"has":true,"value":[1,2]}`, ""},
+		{"patch", `{"transactionId": 13, "key": "nope", "format": "merge-patch", "patch": {}}`, ``, "key does not exist"},
+		{"closeTransaction", `{"transactionId": 13}`, `{}`, ""},
+
+		// getPath
+		{"getPath", invalidRequest, ``, invalidRequestError},
+		{"getPath", `{"key": "foo"}`, ``, "Missing transaction ID"},
+		{"openTransaction", `{}`, `{"transactionId":14}`, ""},
+		{"put", `{"transactionId": 14, "key": "obj", "value": {"a": [1, {"b": "c"}]}}`, `{}`, ""},
+		{"getPath", `{"transactionId": 14, "key": "obj", "path": "/a/1"}`, `{"has":true,"hasPath":true,"value":{"b":"c"}}`, ""},
+		{"getPath", `{"transactionId": 14, "key": "obj", "path": "/a/2"}`, `{"has":true,"hasPath":false}`, ""},
+		{"getPath", `{"transactionId": 14, "key": "nope", "path": "/a"}`, `{"has":false,"hasPath":false}`, ""},
+		{"getPath", `{"transactionId": 14, "key": "obj", "path": "a"}`, ``, "invalid JSON pointer"},
+		{"closeTransaction", `{"transactionId": 14}`, `{}`, ""},
+
+		// scan where
+		{"openTransaction", `{}`, `{"transactionId":15}`, ""},
+		{"scan", `{"transactionId": 15, "where": {"path": "", "gte": "c"}}`, `[{"key":"foopa","value":"doopa"}]`, ""},
+		{"scan", `{"transactionId": 15, "where": {"or": [{"eq": "bar"}, {"eq": "doopa"}]}, "limit": 1}`, `[{"key":"foo","value":"bar"}]`, ""},
+		{"scan", `{"transactionId": 15, "where": {"path": "", "exists": true}, "countOnly": true}`, `{"count":2}`, ""},
+		{"scan", `{"transactionId": 15, "where": {}}`, ``, "invalid predicate"},
+		{"closeTransaction", `{"transactionId": 15}`, `{}`, ""},
+
+		// local keyspace and TTLs
+		{"openTransaction", `{}`, `{"transactionId":16}`, ""},
+		{"put", `{"transactionId": 16, "key": "p", "value": 1, "ttl": 1000}`, ``, "TTLs are only supported in the local keyspace"},
+		{"put", `{"transactionId": 16, "key": "p", "value": 1, "ttl": 1000, "local": true, "precondition": {"absent": true}}`, ``, "ttl can't be combined with a precondition"},
+		{"put", `{"transactionId": 16, "key": "p", "value": 1, "ttl": 1000, "local": true}`, `{}`, ""},
+		{"has", `{"transactionId": 16, "key": "p", "local": true}`, `{"has":true}`, ""},
+		{"has", `{"transactionId": 16, "key": "p"}`, `{"has":false}`, ""},
+		{"closeTransaction", `{"transactionId": 16}`, `{}`, ""},
+
 		// TODO: other scan operators
 	}
 
@@ -0,0 +1,55 @@
+package repm
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobs(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"putBlob", `{"transactionId": 1, "key": "b", "data": "aGVsbG8="}`, `^{"size":5,"hash":"\w{32}"}$`, ""},
+		{"putBlob", `{"transactionId": 1, "key": "b", "data": "IHdvcmxk", "offset": 5}`, `^{"size":11,"hash":"\w{32}"}$`, ""},
+		{"putBlob", `{"transactionId": 1, "key": "b", "data": "IQ==", "offset": 12}`, ``, "offset 12 is beyond the end of the blob"},
+		{"getBlob", `{"transactionId": 1, "key": "b"}`, `^{"has":true,"data":"aGVsbG8gd29ybGQ=","size":11,"hash":"\w{32}"}$`, ""},
+		{"getBlob", `{"transactionId": 1, "key": "b", "offset": 6, "length": 5}`, `^{"has":true,"data":"d29ybGQ=","size":11,"hash":"\w{32}"}$`, ""},
+		{"getBlob", `{"transactionId": 1, "key": "nope"}`, `^{"has":false}$`, ""},
+		{"put", `{"transactionId": 1, "key": "j", "value": 1}`, `{}`, ""},
+		{"getBlob", `{"transactionId": 1, "key": "j"}`, ``, "value at 'j' is not a blob"},
+		{"putBlob", `{"transactionId": 1, "key": "j", "data": "IQ==", "offset": 0}`, ``, "value at 'j' is not a blob"},
+		{"get", `{"transactionId": 1, "key": "b"}`, ``, "value is a blob"},
+		{"scan", `{"transactionId": 1}`, `^\[{"key":"b","blob":{"size":11,"hash":"\w{32}"}},{"key":"j","value":1}\]$`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+		{"openTransaction", `{}`, `{"transactionId":2}`, ""},
+		{"getBlob", `{"transactionId": 2, "key": "b", "offset": 11}`, `^{"has":true,"size":11,"hash":"\w{32}"}$`, ""},
+		{"closeTransaction", `{"transactionId": 2}`, `{}`, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"sync/atomic"
 
+	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/spec"
 	zl "github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
@@ -70,6 +71,8 @@ func Init(storageDir, tempDir string, logger Logger) {
 func deinit() {
 	connections = map[string]*connection{}
 	repDir = ""
+	changeListener = nil
+	headChangeListener = nil
 }
 
 // Dispatch send an API request to Replicache, JSON-serialized parameters, and returns the response.
@@ -103,11 +106,15 @@ func Dispatch(dbName, rpc string, data []byte) (ret []byte, err error) {
 	case "list":
 		return list(l)
 	case "open":
-		return nil, open(dbName, l)
+		return nil, open(dbName, data, l)
 	case "close":
 		return nil, close(dbName)
 	case "drop":
 		return nil, drop(dbName)
+	case "rotateKey":
+		return nil, rotateKey(dbName, data)
+	case "planMigrations":
+		return planMigrations(dbName, data)
 	case "version":
 		return []byte(version.Version()), nil
 	case "profile":
@@ -132,18 +139,54 @@ func Dispatch(dbName, rpc string, data []byte) (ret []byte, err error) {
 		return conn.dispatchHas(data)
 	case "get":
 		return conn.dispatchGet(data)
+	case "getPath":
+		return conn.dispatchGetPath(data)
+	case "putBlob":
+		return conn.dispatchPutBlob(data)
+	case "getBlob":
+		return conn.dispatchGetBlob(data)
 	case "scan":
 		return conn.dispatchScan(data)
+	case "openScan":
+		return conn.dispatchOpenScan(data)
+	case "scanNext":
+		return conn.dispatchScanNext(data)
+	case "closeScan":
+		return conn.dispatchCloseScan(data)
 	case "put":
 		return conn.dispatchPut(data)
 	case "del":
 		return conn.dispatchDel(data)
+	case "patch":
+		return conn.dispatchPatch(data)
+	case "batch":
+		return conn.dispatchBatch(data)
+	case "createIndex":
+		return conn.dispatchCreateIndex(data)
+	case "dropIndex":
+		return conn.dispatchDropIndex(data)
+	case "diff":
+		return conn.dispatchDiff(data)
+	case "watch":
+		return conn.dispatchWatch(data)
+	case "unwatch":
+		return conn.dispatchUnwatch(data)
 	case "beginSync":
 		return conn.dispatchBeginSync(data, l)
 	case "maybeEndSync":
-		return conn.dispatchMaybeEndSync(data)
+		return conn.dispatchMaybeEndSync(data, l)
 	case "openTransaction":
 		return conn.dispatchOpenTransaction(data)
+	case "persist":
+		return conn.dispatchPersist(data)
+	case "export":
+		return conn.dispatchExport(data)
+	case "import":
+		return conn.dispatchImport(data, l)
+	case "verify":
+		return conn.dispatchVerify(data)
+	case "stats":
+		return conn.dispatchStats(data)
 	case "closeTransaction":
 		return conn.dispatchCloseTransaction(data)
 	case "commitTransaction":
@@ -200,7 +243,9 @@ func list(l zl.Logger) (resBytes []byte, err error) {
 }
 
 // Open a Replicache database. If the named database doesn't exist it is created.
-func open(dbName string, l zl.Logger) error {
+// The optional request configures the database. Open fails if another process
+// has the database open.
+func open(dbName string, data []byte, l zl.Logger) error {
 	if repDir == "" {
 		return errors.New("Replicache is uninitialized - must call init first")
 	}
@@ -212,22 +257,60 @@ func open(dbName string, l zl.Logger) error {
 		return nil
 	}
 
+	var req openRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+	}
+
 	p := dbPath(repDir, dbName)
-	sp, err := spec.ForDatabase(p)
+	loc := p
+	if req.InMemory {
+		loc = "mem"
+	}
+	sp, err := spec.ForDatabase(loc)
 	if err != nil {
 		return err
 	}
-	db, err := db.Load(sp)
+	opts := db.Options{
+		LosslessIntegers: req.LosslessIntegers,
+		Lock:             db.LockExclusive,
+		SeedFile:         req.SeedFile,
+		Quota:            req.Quota,
+	}
+	if req.ReadOnly {
+		opts.Lock = db.LockShared
+	}
+	if req.AutoReload {
+		opts.ReloadInterval = autoReloadInterval
+	}
+	if len(req.EncryptionKey) > 0 {
+		opts.EncryptionKey = req.EncryptionKey
+	}
+	db, err := db.LoadWithOptions(sp, opts)
 	if err != nil {
 		return err
 	}
 
-	l.Info().Msgf("Opened Replicache instance at: %s with tempdir: %s and ClientID: %s", p, os.TempDir(), db.ClientID())
-	connections[dbName] = newConnection(db, p)
+	if req.InMemory {
+		l.Info().Msgf("Opened in-memory Replicache instance with ClientID: %s", db.ClientID())
+	} else {
+		l.Info().Msgf("Opened Replicache instance at: %s with tempdir: %s and ClientID: %s", p, os.TempDir(), db.ClientID())
+	}
+	conn := newConnection(dbName, db, p)
+	conn.inMemory = req.InMemory
+	if req.AutoReload {
+		db.SetReloadListener(func(oldHead, newHead hash.Hash) {
+			conn.onReload(oldHead, newHead, l)
+		})
+	}
+	connections[dbName] = conn
 	return nil
 }
 
-// Close releases the resources held by the specified open database.
+// Close releases the resources held by the specified open database. Its open
+// transactions are aborted.
 func close(dbName string) error {
 	if dbName == "" {
 		return errors.New("dbName must be non-empty")
@@ -236,8 +319,11 @@ func close(dbName string) error {
 	if conn == nil {
 		return nil
 	}
+	conn.watchMutex.Lock()
+	conn.watches = map[int]watch{}
+	conn.watchMutex.Unlock()
 	delete(connections, dbName)
-	return nil
+	return conn.db.Close()
 }
 
 // Drop closes and deletes the specified local database. Remote replicas in the group are not affected.
@@ -256,11 +342,76 @@ func drop(dbName string) error {
 			return fmt.Errorf("open database %s has directory %s, which is different than specified %s",
 				dbName, conn.dir, p)
 		}
-		close(dbName)
+		if err := close(dbName); err != nil {
+			return err
+		}
 	}
 	return os.RemoveAll(p)
 }
 
+// RotateKey re-encrypts the specified database, which must be closed, with a
+// new key.
+func rotateKey(dbName string, data []byte) error {
+	if repDir == "" {
+		return errors.New("Replicache is uninitialized - must call init first")
+	}
+	if dbName == "" {
+		return errors.New("dbName must be non-empty")
+	}
+	if _, ok := connections[dbName]; ok {
+		return errors.New("database must be closed to rotate its key")
+	}
+
+	var req rotateKeyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+	var oldKey, newKey []byte
+	if len(req.OldKey) > 0 {
+		oldKey = req.OldKey
+	}
+	if len(req.NewKey) > 0 {
+		newKey = req.NewKey
+	}
+	return db.RotateKey(dbPath(repDir, dbName), oldKey, newKey)
+}
+
+// PlanMigrations returns the migrations that opening the specified database
+// would run. Open and new databases need none.
+func planMigrations(dbName string, data []byte) ([]byte, error) {
+	if repDir == "" {
+		return nil, errors.New("Replicache is uninitialized - must call init first")
+	}
+	if dbName == "" {
+		return nil, errors.New("dbName must be non-empty")
+	}
+	p := dbPath(repDir, dbName)
+	if _, err := os.Stat(p); connections[dbName] != nil || os.IsNotExist(err) {
+		v := db.FormatVersion()
+		return mustMarshal(planMigrationsResponse{db.MigrationPlan{From: v, To: v, Steps: []string{}}}), nil
+	}
+
+	var req planMigrationsRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+	}
+	sp, err := spec.ForDatabase(p)
+	if err != nil {
+		return nil, err
+	}
+	opts := db.Options{Lock: db.LockExclusive}
+	if len(req.EncryptionKey) > 0 {
+		opts.EncryptionKey = req.EncryptionKey
+	}
+	plan, err := db.PlanMigrations(sp, opts)
+	if err != nil {
+		return nil, err
+	}
+	return mustMarshal(planMigrationsResponse{plan}), nil
+}
+
 func dbPath(root, name string) string {
 	return path.Join(root, base64.RawURLEncoding.EncodeToString([]byte(name)))
 }
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/attic-labs/noms/go/spec"
 	"github.com/attic-labs/noms/go/types"
 	zl "github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -16,6 +17,7 @@ import (
 	"roci.dev/diff-server/util/log"
 	"roci.dev/diff-server/util/time"
 	"roci.dev/diff-server/util/version"
+	"roci.dev/replicache-client/db"
 )
 
 func mm(assert *assert.Assertions, in interface{}) []byte {
@@ -231,6 +233,306 @@ func TestList(t *testing.T) {
 	assert.Equal(`{"databases":[{"name":"db1"}]}`, string(rb))
 }
 
+func TestOpenInUse(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	sp, err := spec.ForDatabase(dbPath(dir, "db1"))
+	assert.NoError(err)
+	other, err := db.LoadWithOptions(sp, db.Options{Lock: db.LockExclusive})
+	assert.NoError(err)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.Regexp("^database in use: ", err.Error())
+
+	assert.NoError(other.Close())
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+}
+
+func TestInMemory(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"open", `{"inMemory": true}`, ``, ""},
+		{"openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"put", `{"transactionId": 1, "key": "foo", "value": "bar"}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+		{"list", ``, `{"databases":[]}`, ""},
+		{"persist", `{}`, `{}`, ""},
+		{"persist", `{}`, ``, "a database already exists there"},
+		{"list", ``, `{"databases":[{"name":"db1"}]}`, ""},
+		{"close", ``, ``, ""},
+
+		// Reopened from disk.
+		{"open", ``, ``, ""},
+		{"persist", `{}`, ``, "database is not in memory"},
+		{"openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"get", `{"transactionId": 1, "key": "foo"}`, `{"has":true,"value":"bar"}`, ""},
+		{"close", ``, ``, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	const keyA = `"YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="`
+	const keyB = `"YmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmI="`
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"open", `{"encryptionKey": "YQ=="}`, ``, "encryption key must be 32 bytes"},
+		{"open", `{"encryptionKey": ` + keyA + `}`, ``, ""},
+		{"openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"put", `{"transactionId": 1, "key": "foo", "value": "bar"}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+		{"rotateKey", `{"oldKey": ` + keyA + `, "newKey": ` + keyB + `}`, ``, "database must be closed"},
+		{"close", ``, ``, ""},
+		{"open", `{"encryptionKey": ` + keyB + `}`, ``, "wrong encryption key"},
+		{"rotateKey", `{"oldKey": ` + keyA + `, "newKey": ` + keyB + `}`, ``, ""},
+		{"open", `{"encryptionKey": ` + keyA + `}`, ``, "wrong encryption key"},
+		{"open", `{"encryptionKey": ` + keyB + `}`, ``, ""},
+		{"openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"get", `{"transactionId": 1, "key": "foo"}`, `{"has":true,"value":"bar"}`, ""},
+		{"close", ``, ``, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	exportPath := path.Join(dir, "export.jsonl")
+
+	tc := []struct {
+		db               string
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"db1", "open", ``, ``, ""},
+		{"db1", "openTransaction", `{"name": "m1", "args": []}`, `{"transactionId":1}`, ""},
+		{"db1", "put", `{"transactionId": 1, "key": "foo", "value": "bar"}`, `{}`, ""},
+		{"db1", "commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+		{"db1", "export", `{}`, ``, "path field is required"},
+		{"db1", "export", `{"path": "` + exportPath + `", "pending": true}`, `{}`, ""},
+		{"db1", "import", `{"path": "` + exportPath + `"}`, ``, "can only import into an empty database"},
+		{"db2", "open", ``, ``, ""},
+		{"db2", "import", `{"path": "` + exportPath + `"}`, `^{"head":"\w{32}"}$`, ""},
+		{"db2", "openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"db2", "get", `{"transactionId": 1, "key": "foo"}`, `{"has":true,"value":"bar"}`, ""},
+		{"db2", "close", ``, ``, ""},
+		{"db1", "close", ``, ``, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch(t.db, t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	seedPath := path.Join(dir, "seed.jsonl")
+	badSeedPath := path.Join(dir, "bad.jsonl")
+	assert.NoError(ioutil.WriteFile(badSeedPath, []byte(`{"header":{"version":1,"checksum":"00000000"}}`), 0644))
+
+	tc := []struct {
+		db               string
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"db1", "open", ``, ``, ""},
+		{"db1", "export", `{"path": "` + seedPath + `"}`, `{}`, ""},
+		{"db1", "close", ``, ``, ""},
+		{"db2", "open", `{"seedFile": "` + badSeedPath + `"}`, ``, "checksum mismatch in snapshot"},
+		{"db2", "open", `{"seedFile": "` + path.Join(dir, "nope") + `"}`, ``, "could not open seed file"},
+		{"db2", "open", `{"seedFile": "` + seedPath + `"}`, ``, ""},
+		{"db2", "close", ``, ``, ""},
+		// The seed is ignored once the database exists.
+		{"db2", "open", `{"seedFile": "` + badSeedPath + `"}`, ``, ""},
+		{"db2", "close", ``, ``, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch(t.db, t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"open", ``, ``, ""},
+		{"verify", `{}`, `^{"commits":1,"issues":\[\]}$`, ""},
+		{"openTransaction", `{"name": "m1", "args": []}`, `{"transactionId":1}`, ""},
+		{"put", `{"transactionId": 1, "key": "foo", "value": "bar"}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+		{"verify", `{}`, `^{"commits":2,"issues":\[\]}$`, ""},
+		{"close", ``, ``, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"planMigrations", ``, `{"from":1,"to":1,"steps":[]}`, ""},
+		{"list", ``, `{"databases":[]}`, ""},
+		{"open", ``, ``, ""},
+		{"planMigrations", ``, `{"from":1,"to":1,"steps":[]}`, ""},
+		{"close", ``, ``, ""},
+		{"planMigrations", `{}`, `{"from":1,"to":1,"steps":[]}`, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Equal(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
+func TestStatsAndQuota(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"open", ``, ``, ""},
+		{"stats", `{}`, `^{"diskBytes":\d+,"chunks":\d+,"keys":0,"valueBytes":0,"prefixes":{},"pendingCommits":0,"historyDepth":1}$`, ""},
+		{"openTransaction", `{"name": "m1", "args": []}`, `{"transactionId":1}`, ""},
+		{"put", `{"transactionId": 1, "key": "todo/1", "value": "bar"}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+		{"stats", `{}`, `"keys":1,"valueBytes":\d+,"prefixes":{"todo/":{"keys":1,"valueBytes":\d+}},"pendingCommits":1,"historyDepth":2}$`, ""},
+		{"close", ``, ``, ""},
+		{"open", `{"quota": 1}`, ``, ""},
+		{"openTransaction", `{"name": "m2", "args": []}`, `{"transactionId":1}`, ""},
+		{"put", `{"transactionId": 1, "key": "todo/2", "value": "baz"}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"quotaExceeded":true}$`, ""},
+		{"openTransaction", `{"name": "m3", "args": []}`, `{"transactionId":2}`, ""},
+		{"del", `{"transactionId": 2, "key": "todo/1"}`, `{"ok":true}`, ""},
+		{"commitTransaction", `{"transactionId": 2}`, `^{"ref":"\w{32}"}$`, ""},
+		{"close", ``, ``, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+}
+
 func TestLogLevel(t *testing.T) {
 	defer deinit()
 	defer time.SetFake()()
@@ -11,6 +11,90 @@ import (
 	jsnoms "roci.dev/diff-server/util/noms/json"
 )
 
+type openRequest struct {
+	// LosslessIntegers preserves integers beyond 2^53 in values. A database
+	// must always be opened with the setting it was created with.
+	LosslessIntegers bool `json:"losslessIntegers,omitempty"`
+	// AutoReload watches the database for commits by other processes and
+	// reloads it when there are any. See SetHeadChangeListener. Only one
+	// process at a time can open a database for writing, so the others open
+	// it ReadOnly.
+	AutoReload bool `json:"autoReload,omitempty"`
+	// ReadOnly opens the database for reading only, which allows it to be
+	// open in other processes at the same time, including one that writes it.
+	// Writes fail.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// InMemory keeps the database in memory only. It is lost on close unless
+	// it is persisted.
+	InMemory bool `json:"inMemory,omitempty"`
+	// EncryptionKey encrypts the database at rest. The host provides it, for
+	// example from the platform keychain, and must pass the same key every time
+	// the database is opened.
+	EncryptionKey []byte `json:"encryptionKey,omitempty"`
+	// SeedFile is the path of a snapshot export, such as one bundled with the
+	// app, that a new database starts from. It is ignored if the database
+	// exists.
+	SeedFile string `json:"seedFile,omitempty"`
+	// Quota is the size in bytes the database may grow to on disk. Commits
+	// that would exceed it fail with quotaExceeded.
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// planMigrationsRequest asks which migrations opening a database would run,
+// without running them.
+type planMigrationsRequest struct {
+	EncryptionKey []byte `json:"encryptionKey,omitempty"`
+}
+
+type planMigrationsResponse struct {
+	db.MigrationPlan
+}
+
+// rotateKeyRequest re-encrypts a closed database. Omit OldKey to encrypt a
+// database that isn't encrypted yet and NewKey to decrypt it.
+type rotateKeyRequest struct {
+	OldKey []byte `json:"oldKey,omitempty"`
+	NewKey []byte `json:"newKey,omitempty"`
+}
+
+type persistRequest struct{}
+
+type persistResponse struct{}
+
+// exportRequest writes an export of the database to the file at Path. Hash
+// chooses the commit to export and defaults to the head.
+type exportRequest struct {
+	Path    string       `json:"path"`
+	Hash    *jsnoms.Hash `json:"hash,omitempty"`
+	Pending bool         `json:"pending,omitempty"`
+}
+
+type exportResponse struct{}
+
+// importRequest imports the export in the file at Path into the database, which
+// must be empty. AdoptClientID takes over the client ID of the export; see
+// db.ImportOptions.
+type importRequest struct {
+	Path          string `json:"path"`
+	AdoptClientID bool   `json:"adoptClientID,omitempty"`
+}
+
+type importResponse struct {
+	Head jsnoms.Hash `json:"head"`
+}
+
+type statsRequest struct{}
+
+type statsResponse struct {
+	db.Stats
+}
+
+type verifyRequest struct{}
+
+type verifyResponse struct {
+	db.VerifyReport
+}
+
 type getRootRequest struct {
 }
 
@@ -37,33 +121,198 @@ type getResponse struct {
 	Value json.RawMessage `json:"value,omitempty"`
 }
 
+type getPathRequest struct {
+	transactionRequest
+	Key  string `json:"key"`
+	Path string `json:"path"`
+}
+
+// getPathResponse distinguishes a missing key (has is false) from a missing
+// path within an existing value (has is true and hasPath is false).
+type getPathResponse struct {
+	Has     bool            `json:"has"`
+	HasPath bool            `json:"hasPath"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+type putBlobRequest struct {
+	transactionRequest
+	Key string `json:"key"`
+	// Data is base64 encoded.
+	Data []byte `json:"data"`
+	// Offset, if set, writes Data into the existing blob at this offset instead
+	// of replacing the value.
+	Offset *uint64 `json:"offset,omitempty"`
+}
+
+type putBlobResponse struct {
+	db.BlobInfo
+}
+
+type getBlobRequest struct {
+	transactionRequest
+	Key    string `json:"key"`
+	Offset uint64 `json:"offset,omitempty"`
+	// Length is the maximum number of bytes to return. If 0 the rest of the
+	// blob is returned.
+	Length uint64 `json:"length,omitempty"`
+}
+
+type getBlobResponse struct {
+	Has bool `json:"has"`
+	// Data is base64 encoded.
+	Data []byte `json:"data,omitempty"`
+	*db.BlobInfo
+}
+
 type scanRequest struct {
 	transactionRequest
 	db.ScanOptions
+	// IndexName, if set, scans the named secondary index instead of the primary keys.
+	IndexName string `json:"indexName,omitempty"`
+	// CountOnly returns a scanCountResponse with the number of matching items.
+	CountOnly bool `json:"countOnly,omitempty"`
 }
 
 type scanResponse []db.ScanItem
 
+type scanCountResponse struct {
+	Count int `json:"count"`
+}
+
 type scanItem struct {
 	Key   string       `json:"key"`
 	Value jsnoms.Value `json:"value"`
 }
 
+type openScanRequest struct {
+	transactionRequest
+	db.ScanOptions
+	Continuation string `json:"continuation,omitempty"`
+}
+
+type openScanResponse struct {
+	CursorID int `json:"cursorId"`
+}
+
+type scanNextRequest struct {
+	CursorID int `json:"cursorId"`
+	// Count is the maximum number of items to return. Defaults to the scan limit.
+	Count int `json:"count,omitempty"`
+}
+
+type scanNextResponse struct {
+	Items        []db.ScanItem `json:"items"`
+	Continuation string        `json:"continuation,omitempty"`
+	Done         bool          `json:"done,omitempty"`
+}
+
+type closeScanRequest struct {
+	CursorID int `json:"cursorId"`
+}
+
+type closeScanResponse struct{}
+
 type putRequest struct {
 	transactionRequest
-	Key   string          `json:"key"`
-	Value json.RawMessage `json:"value"`
+	Key          string          `json:"key"`
+	Value        json.RawMessage `json:"value"`
+	Precondition db.Precondition `json:"precondition"`
+	// TTL, in milliseconds, expires the entry. Only supported with local.
+	TTL int64 `json:"ttl,omitempty"`
 }
 
-type putResponse struct{}
+type putResponse struct {
+	PreconditionFailed bool `json:"preconditionFailed,omitempty"`
+}
 
 type delRequest struct {
 	transactionRequest
-	Key string `json:"key"`
+	Key          string          `json:"key"`
+	Precondition db.Precondition `json:"precondition"`
 }
 
 type delResponse struct {
-	Ok bool `json:"ok"`
+	Ok                 bool `json:"ok"`
+	PreconditionFailed bool `json:"preconditionFailed,omitempty"`
+}
+
+type patchRequest struct {
+	transactionRequest
+	Key string `json:"key"`
+	// Format is "json-patch" or "merge-patch".
+	Format db.PatchFormat  `json:"format"`
+	Patch  json.RawMessage `json:"patch"`
+}
+
+type patchResponse struct{}
+
+type batchRequest struct {
+	transactionRequest
+	Ops []db.BatchOp `json:"ops"`
+}
+
+type batchResponse struct {
+	Results []db.BatchResult `json:"results"`
+}
+
+type createIndexRequest struct {
+	transactionRequest
+	Name string `json:"name"`
+	db.IndexDefinition
+}
+
+type createIndexResponse struct{}
+
+type dropIndexRequest struct {
+	transactionRequest
+	Name string `json:"name"`
+}
+
+type dropIndexResponse struct{}
+
+type diffRequest struct {
+	From *jsnoms.Hash `json:"from"`
+	To   *jsnoms.Hash `json:"to"`
+	db.DiffOptions
+}
+
+type diffResponse struct {
+	Changes []db.DiffChange `json:"changes"`
+}
+
+type watchRequest struct {
+	// At most one of Prefix and Keys may be set. If neither is set, all changes are watched.
+	Prefix string   `json:"prefix,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+	// Local watches the local keyspace instead of the synced data.
+	Local bool `json:"local,omitempty"`
+}
+
+type watchResponse struct {
+	WatchID int `json:"watchId"`
+}
+
+type unwatchRequest struct {
+	WatchID int `json:"watchId"`
+}
+
+type unwatchResponse struct{}
+
+// changeNotification is delivered to the ChangeListener when a commit or sync
+// changes keys matched by a watch.
+type changeNotification struct {
+	WatchID int             `json:"watchId"`
+	Head    jsnoms.Hash     `json:"head"`
+	Local   bool            `json:"local,omitempty"`
+	Changes []db.DiffChange `json:"changes"`
+}
+
+// headChangeNotification is delivered to the HeadChangeListener when the head
+// changes because another process committed to the database.
+type headChangeNotification struct {
+	OldHead jsnoms.Hash `json:"oldHead"`
+	Head    jsnoms.Hash `json:"head"`
 }
 
 type beginSyncRequest struct {
@@ -106,6 +355,9 @@ type openTransactionResponse struct {
 
 type transactionRequest struct {
 	TransactionID int `json:"transactionId"`
+	// Local addresses the local keyspace instead of the synced data. It is
+	// ignored when closing and committing transactions.
+	Local bool `json:"local,omitempty"`
 }
 
 type closeTransactionRequest transactionRequest
@@ -118,4 +370,7 @@ type commitTransactionRequest transactionRequest
 type commitTransactionResponse struct {
 	Ref         *jsnoms.Hash `json:"ref,omitempty"`
 	RetryCommit bool         `json:"retryCommit,omitempty"`
+	// QuotaExceeded is set when the commit failed because it would have made
+	// the database exceed its quota.
+	QuotaExceeded bool `json:"quotaExceeded,omitempty"`
 }
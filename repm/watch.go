@@ -0,0 +1,195 @@
+package repm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/attic-labs/noms/go/hash"
+	zl "github.com/rs/zerolog"
+
+	jsnoms "roci.dev/diff-server/util/noms/json"
+	"roci.dev/replicache-client/db"
+)
+
+// ChangeListener receives notifications about changes to watched keys. OnChange is
+// called synchronously from within the Dispatch call that changed the head, with a
+// JSON-serialized changeNotification. When another process changes the head of a
+// database opened with autoReload, OnChange is called from a background goroutine
+// instead.
+type ChangeListener interface {
+	OnChange(dbName string, data []byte)
+}
+
+var changeListener ChangeListener
+
+// SetChangeListener sets the listener that receives notifications for all watches.
+// Pass nil to stop receiving notifications.
+func SetChangeListener(listener ChangeListener) {
+	changeListener = listener
+}
+
+// autoReloadInterval is how often databases opened with autoReload check for
+// commits by other processes.
+const autoReloadInterval = time.Second
+
+// HeadChangeListener receives notifications when the head of a database opened
+// with autoReload changes because another process committed to it. OnHeadChange
+// is called from a background goroutine with a JSON-serialized
+// headChangeNotification.
+type HeadChangeListener interface {
+	OnHeadChange(dbName string, data []byte)
+}
+
+var headChangeListener HeadChangeListener
+
+// SetHeadChangeListener sets the listener that receives head change notifications
+// for all databases. Pass nil to stop receiving notifications.
+func SetHeadChangeListener(listener HeadChangeListener) {
+	headChangeListener = listener
+}
+
+// onReload notifies the listeners that the head changed from oldHead to newHead
+// because another process committed.
+func (conn *connection) onReload(oldHead, newHead hash.Hash, l zl.Logger) {
+	conn.notifyWatches(oldHead, newHead, l)
+	if headChangeListener != nil {
+		headChangeListener.OnHeadChange(conn.name, mustMarshal(headChangeNotification{
+			OldHead: jsnoms.Hash{Hash: oldHead},
+			Head:    jsnoms.Hash{Hash: newHead},
+		}))
+	}
+}
+
+type watch struct {
+	prefix string
+	keys   map[string]bool
+	local  bool
+}
+
+// matches returns true if a change to key is relevant to this watch.
+func (w watch) matches(key string) bool {
+	if len(w.keys) > 0 {
+		return w.keys[key]
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
+
+func (conn *connection) dispatchWatch(reqBytes []byte) ([]byte, error) {
+	var req watchRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Prefix != "" && len(req.Keys) > 0 {
+		return nil, errors.New("at most one of prefix and keys may be specified")
+	}
+	w := watch{prefix: req.Prefix, local: req.Local}
+	if len(req.Keys) > 0 {
+		w.keys = map[string]bool{}
+		for _, k := range req.Keys {
+			w.keys[k] = true
+		}
+	}
+
+	conn.watchMutex.Lock()
+	watchID := conn.watchCounter
+	conn.watchCounter++
+	conn.watches[watchID] = w
+	conn.watchMutex.Unlock()
+
+	res := watchResponse{
+		WatchID: watchID,
+	}
+	return mustMarshal(res), nil
+}
+
+func (conn *connection) dispatchUnwatch(reqBytes []byte) ([]byte, error) {
+	var req unwatchRequest
+	err := json.Unmarshal(reqBytes, &req)
+	if err != nil {
+		return nil, err
+	}
+	conn.watchMutex.Lock()
+	defer conn.watchMutex.Unlock()
+	if _, ok := conn.watches[req.WatchID]; !ok {
+		return nil, fmt.Errorf("Invalid watch ID: %d", req.WatchID)
+	}
+	delete(conn.watches, req.WatchID)
+	res := unwatchResponse{}
+	return mustMarshal(res), nil
+}
+
+// notifyWatches delivers the changes between the commits with hashes from and to
+// to every watch they are relevant to. Errors computing the diff are logged rather
+// than returned because the operation that changed the head has already succeeded.
+func (conn *connection) notifyWatches(from, to hash.Hash, l zl.Logger) {
+	if from == to || len(conn.currentWatches()) == 0 || changeListener == nil {
+		return
+	}
+	changes, err := conn.db.Diff(from, to, db.DiffOptions{})
+	if err != nil {
+		l.Err(err).Msgf("Could not compute changes from %s to %s", from, to)
+		return
+	}
+	conn.deliverChanges(changes, to, false)
+}
+
+// notifyLocalWatches is like notifyWatches for the changes between the local
+// keyspace data with hashes from and to.
+func (conn *connection) notifyLocalWatches(from, to hash.Hash, l zl.Logger) {
+	if from == to || len(conn.currentWatches()) == 0 || changeListener == nil {
+		return
+	}
+	changes, err := conn.db.DiffLocal(from, to, db.DiffOptions{})
+	if err != nil {
+		l.Err(err).Msgf("Could not compute local changes from %s to %s", from, to)
+		return
+	}
+	conn.deliverChanges(changes, conn.db.HeadHash(), true)
+}
+
+// deliverChanges notifies the watches of the keyspace, local or synced, of the
+// relevant changes, in ascending order of watch ID.
+func (conn *connection) deliverChanges(changes []db.DiffChange, head hash.Hash, local bool) {
+	watches := conn.currentWatches()
+	ids := make([]int, 0, len(watches))
+	for id := range watches {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, watchID := range ids {
+		w := watches[watchID]
+		if w.local != local {
+			continue
+		}
+		n := changeNotification{
+			WatchID: watchID,
+			Head:    jsnoms.Hash{Hash: head},
+			Local:   local,
+		}
+		for _, c := range changes {
+			if w.matches(c.Key) {
+				n.Changes = append(n.Changes, c)
+			}
+		}
+		if len(n.Changes) > 0 {
+			changeListener.OnChange(conn.name, mustMarshal(n))
+		}
+	}
+}
+
+// currentWatches returns a copy of the watches, so that listeners can change
+// them while being notified.
+func (conn *connection) currentWatches() map[int]watch {
+	conn.watchMutex.Lock()
+	defer conn.watchMutex.Unlock()
+	r := make(map[int]watch, len(conn.watches))
+	for id, w := range conn.watches {
+		r[id] = w
+	}
+	return r
+}
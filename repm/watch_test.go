@@ -0,0 +1,201 @@
+package repm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	gotime "time"
+
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/util/log"
+	"roci.dev/diff-server/util/time"
+	"roci.dev/replicache-client/db"
+)
+
+type fakeChangeListener struct {
+	dbNames       []string
+	notifications []string
+}
+
+func (f *fakeChangeListener) OnChange(dbName string, data []byte) {
+	f.dbNames = append(f.dbNames, dbName)
+	f.notifications = append(f.notifications, string(data))
+}
+
+func TestWatch(t *testing.T) {
+	defer deinit()
+	defer time.SetFake()()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	listener := &fakeChangeListener{}
+	SetChangeListener(listener)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+
+	tc := []struct {
+		rpc              string
+		req              string
+		expectedResponse string
+		expectedError    string
+	}{
+		{"watch", `{"prefix": "a/", "keys": ["b"]}`, ``, "at most one of prefix and keys"},
+		{"watch", `{"prefix": "a/"}`, `{"watchId":1}`, ""},
+		{"watch", `{"keys": ["b", "c"]}`, `{"watchId":2}`, ""},
+		{"unwatch", `{"watchId": 3}`, ``, "Invalid watch ID: 3"},
+
+		{"openTransaction", `{}`, `{"transactionId":1}`, ""},
+		{"put", `{"transactionId": 1, "key": "a/1", "value": 1}`, `{}`, ""},
+		{"put", `{"transactionId": 1, "key": "d", "value": 2}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 1}`, `^{"ref":"\w{32}"}$`, ""},
+
+		{"unwatch", `{"watchId": 1}`, `{}`, ""},
+
+		{"openTransaction", `{}`, `{"transactionId":2}`, ""},
+		{"put", `{"transactionId": 2, "key": "a/2", "value": 3}`, `{}`, ""},
+		{"del", `{"transactionId": 2, "key": "a/1"}`, `{"ok":true}`, ""},
+		{"put", `{"transactionId": 2, "key": "c", "value": 4}`, `{}`, ""},
+		{"commitTransaction", `{"transactionId": 2}`, `^{"ref":"\w{32}"}$`, ""},
+
+		// No writes, no notifications.
+		{"openTransaction", `{}`, `{"transactionId":3}`, ""},
+		{"commitTransaction", `{"transactionId": 3}`, `^{"ref":"\w{32}"}$`, ""},
+
+		// Local writes only notify local watches.
+		{"watch", `{"prefix": "d", "local": true}`, `{"watchId":4}`, ""},
+		{"openTransaction", `{}`, `{"transactionId":4}`, ""},
+		{"put", `{"transactionId": 4, "key": "draft", "value": 5, "local": true}`, `{}`, ""},
+		{"get", `{"transactionId": 4, "key": "draft"}`, `{"has":false}`, ""},
+		{"get", `{"transactionId": 4, "key": "draft", "local": true}`, `{"has":true,"value":5}`, ""},
+		{"createIndex", `{"transactionId": 4, "name": "i", "keyPrefix": "", "jsonPath": "", "local": true}`, ``, "not supported in the local keyspace"},
+		{"commitTransaction", `{"transactionId": 4}`, `^{"ref":"\w{32}"}$`, ""},
+	}
+
+	for _, t := range tc {
+		res, err := Dispatch("db1", t.rpc, []byte(t.req))
+		if t.expectedError != "" {
+			assert.Nil(res, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedError, err.Error(), "test case %s: %s", t.rpc, t.req)
+		} else {
+			assert.NoError(err, "test case %s: %s", t.rpc, t.req)
+			assert.Regexp(t.expectedResponse, string(res), "test case %s: %s", t.rpc, t.req)
+		}
+	}
+
+	assert.Equal([]string{"db1", "db1", "db1"}, listener.dbNames)
+	assert.Regexp(`^{"watchId":1,"head":"\w+","changes":\[{"op":"add","key":"a/1","newValue":1}\]}$`, listener.notifications[0])
+	assert.Regexp(`^{"watchId":2,"head":"\w+","changes":\[{"op":"add","key":"c","newValue":4}\]}$`, listener.notifications[1])
+	assert.Regexp(`^{"watchId":4,"head":"\w+","local":true,"changes":\[{"op":"add","key":"draft","newValue":5}\]}$`, listener.notifications[2])
+
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	assert.Equal(0, len(connections["db1"].watches))
+}
+
+func TestWatchOrder(t *testing.T) {
+	defer deinit()
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	listener := &fakeChangeListener{}
+	SetChangeListener(listener)
+	defer SetChangeListener(nil)
+
+	_, err = Dispatch("db1", "open", nil)
+	assert.NoError(err)
+	const numWatches = 8
+	for i := 0; i < numWatches; i++ {
+		_, err = Dispatch("db1", "watch", []byte(`{}`))
+		assert.NoError(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		res, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf(`{"transactionId":%d}`, i), string(res))
+		_, err = Dispatch("db1", "put", []byte(fmt.Sprintf(`{"transactionId": %d, "key": "k", "value": %d}`, i, i)))
+		assert.NoError(err)
+		_, err = Dispatch("db1", "commitTransaction", []byte(fmt.Sprintf(`{"transactionId": %d}`, i)))
+		assert.NoError(err)
+	}
+
+	assert.Equal(3*numWatches, len(listener.notifications))
+	for i, n := range listener.notifications {
+		assert.Regexp(fmt.Sprintf(`^{"watchId":%d,`, i%numWatches+1), n)
+	}
+}
+
+type fakeHeadChangeListener chan string
+
+func (f fakeHeadChangeListener) OnHeadChange(dbName string, data []byte) {
+	f <- dbName + ": " + string(data)
+}
+
+func TestAutoReload(t *testing.T) {
+	defer deinit()
+
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	Init(dir, "", nil)
+	heads := make(fakeHeadChangeListener, 10)
+	SetHeadChangeListener(heads)
+	listener := &fakeChangeListener{}
+	SetChangeListener(listener)
+
+	// Another process writes the database while this one reads it.
+	sp, err := spec.ForDatabase(dbPath(dir, "db1"))
+	assert.NoError(err)
+	other, err := db.LoadWithOptions(sp, db.Options{Lock: db.LockExclusive})
+	assert.NoError(err)
+	_, err = Dispatch("db1", "open", []byte(`{"autoReload": true}`))
+	assert.True(errors.Is(err, db.ErrDatabaseInUse), "%v", err)
+	_, err = Dispatch("db1", "open", []byte(`{"autoReload": true, "readOnly": true}`))
+	assert.NoError(err)
+	_, err = Dispatch("db1", "watch", []byte(`{}`))
+	assert.NoError(err)
+
+	tx := other.NewTransaction()
+	assert.NoError(tx.Put("foo", []byte(`"bar"`)))
+	_, err = tx.Commit(log.Default())
+	assert.NoError(err)
+
+	select {
+	case n := <-heads:
+		assert.Regexp(`^db1: {"oldHead":"\w{32}","head":"`+other.HeadHash().String()+`"}$`, n)
+	case <-gotime.After(5 * gotime.Second):
+		assert.Fail("timed out waiting for head change")
+	}
+	assert.Equal(other.HeadHash(), connections["db1"].db.HeadHash())
+	assert.Equal([]string{"db1"}, listener.dbNames)
+	assert.Regexp(`^{"watchId":1,"head":"\w+","changes":\[{"op":"add","key":"foo","newValue":"bar"}\]}$`, listener.notifications[0])
+
+	res, err := Dispatch("db1", "openTransaction", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"transactionId":1}`, string(res))
+	res, err = Dispatch("db1", "get", []byte(`{"transactionId": 1, "key": "foo"}`))
+	assert.NoError(err)
+	assert.Equal(`{"has":true,"value":"bar"}`, string(res))
+
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+	assert.NoError(other.Close())
+
+	// Readers can also load the database while this process writes it.
+	_, err = Dispatch("db1", "open", []byte(`{"autoReload": true}`))
+	assert.NoError(err)
+	other, err = db.LoadWithOptions(sp, db.Options{Lock: db.LockShared})
+	assert.NoError(err)
+	assert.NoError(other.Close())
+	_, err = Dispatch("db1", "close", nil)
+	assert.NoError(err)
+}